@@ -0,0 +1,384 @@
+// vi: sw=4 ts=4:
+/*
+	Mnemonic:	client.go
+	Abstract:	A client for Go programs which send requests to tokay. The client
+				owns a writer on tokay's request exchange and a reader on its
+				response exchange; requests are matched to responses by msg_key so
+				that any number of goroutines may use one client at once.
+
+				Each method takes a context; the call returns when the response
+				arrives, or with the context's error when it is cancelled or its
+				deadline passes (a late response is then discarded). A response
+				whose state isn't OK is returned along with a *State_error.
+
+					c, err := client.Mk_client( broker.Mk_rmq( host, port, user, pw ), "tokay_req", "tokay_resp" )
+					...
+					resp, err := c.Show( ctx, "all" )
+					for _, vf := range resp.Parsed.Vfs { ... }
+
+				Exchanges are given as tokay_req accepts them: name[:type+opts[:key]].
+
+	Date:		18 October 2026
+*/
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/streadway/amqp"
+	"github.com/att/gopkgs/uuid"
+
+	"github.com/att/vfd.gaol/tokay/lib/broker"
+	"github.com/att/vfd.gaol/tokay/lib/profile"
+	"github.com/att/vfd.gaol/tokay/lib/vfcfg"
+	"github.com/att/vfd.gaol/tokay/lib/vfdshow"
+)
+
+var Err_closed = errors.New( "tokay client is closed" )
+
+/*
+	A response from tokay. Msg holds the lines of the msg field; Parsed is set for
+	show responses which tokay could parse.
+*/
+type Response struct {
+	Sender	string
+	State	string
+	Msg		[]string
+	Msg_key	string
+	Data	json.RawMessage			// VFd's response when tokay includes it
+	Parsed	*vfdshow.Show
+	Raw		[]byte					// the response as received
+}
+
+/*
+	Returned when tokay (or VFd) answered with a state other than OK.
+*/
+type State_error struct {
+	State	string
+	Msg		string
+}
+
+func (e *State_error) Error( ) ( string ) {
+	return fmt.Sprintf( "%s: %s", e.State, e.Msg )
+}
+
+/*
+	Returned by Add when the config isn't valid; nothing is sent.
+*/
+type Config_error struct {
+	Problems	[]vfcfg.Field_error
+}
+
+func (e *Config_error) Error( ) ( string ) {
+	msgs := make( []string, 0, len( e.Problems ) )
+	for _, p := range e.Problems {
+		if ! p.Warning {
+			msgs = append( msgs, p.Error() )
+		}
+	}
+	return "VF config is not valid: " + strings.Join( msgs, "; " )
+}
+
+type Client struct {
+	w			broker.Writer
+	r			broker.Reader
+	resp_key	string						// routing key tokay sends our responses with
+	mu			sync.Mutex
+	pending		map[string]chan []byte		// waiting callers by msg_key
+	done		chan bool
+	closed		bool
+}
+
+/*
+	Split name[:type[:key]] with defaults for the missing parts.
+*/
+func split_exch( exch string, etype string, key string ) ( string, string, string ) {
+	tokens := strings.Split( exch, ":" )
+	switch len( tokens ) {
+		case 3:
+			key = tokens[2]
+			fallthrough
+		case 2:
+			etype = tokens[1]
+	}
+
+	return tokens[0], etype, key
+}
+
+/*
+	Connect to tokay's request and response exchanges through the broker.
+*/
+func Mk_client( b broker.Broker, req_exch string, resp_exch string ) ( *Client, error ) {
+	c := &Client {
+		resp_key:	uuid.NewRandom().String(),
+		pending:	make( map[string]chan []byte ),
+		done:		make( chan bool ),
+	}
+
+	name, etype, key := split_exch( req_exch, "direct+!du+ad", "tokay_req" )
+	w, err := b.Mk_writer( name, etype, &key )
+	if err != nil {
+		return nil, fmt.Errorf( "unable to attach a writer to %s: %s", name, err )
+	}
+	w.Start_writer( key )
+
+	name, etype, _ = split_exch( resp_exch, "direct+!du+ad", "" )		// our key is always the generated one
+	r, err := b.Mk_reader( name, etype, &c.resp_key )
+	if err != nil {
+		w.Close()
+		return nil, fmt.Errorf( "unable to attach a reader to %s: %s", name, err )
+	}
+
+	c.w = w
+	c.r = r
+	dch := make( chan amqp.Delivery, 4096 )
+	if err = r.Start_eating( dch ); err != nil {
+		r.Close()
+		w.Close()
+		return nil, fmt.Errorf( "unable to read from %s: %s", name, err )
+	}
+	go c.dispatch( dch )
+
+	return c, nil
+}
+
+/*
+	Connect using a profile environment: host, port, exchanges, credentials and
+	TLS come from the environment. RMQ_UNAME and RMQ_PW in the process environment
+	win over the credentials file as they do for tokay_req.
+*/
+func Mk_env_client( env *profile.Env ) ( *Client, error ) {
+	if env == nil {
+		return nil, fmt.Errorf( "no profile environment given" )
+	}
+
+	uname := os.Getenv( "RMQ_UNAME" )
+	pw := os.Getenv( "RMQ_PW" )
+	if uname == "" || pw == "" {
+		cuname, cpw, err := env.Creds()
+		if err != nil {
+			return nil, err
+		}
+		if uname == "" {
+			uname = cuname
+		}
+		if pw == "" {
+			pw = cpw
+		}
+	}
+
+	host, port, req_exch, resp_exch := env.Host, env.Port, env.Req_exch, env.Resp_exch
+	if host == "" {
+		host = "localhost"
+	}
+	if port == "" {
+		port = "5672"
+	}
+	if req_exch == "" {
+		req_exch = "tokay_req"
+	}
+	if resp_exch == "" {
+		resp_exch = "tokay_resp"
+	}
+
+	var b broker.Broker = broker.Mk_rmq( host, port, uname, pw )
+	if env.Tls != nil {
+		tcfg, err := broker.Tls_config( profile.Expand( env.Tls.Ca ), profile.Expand( env.Tls.Cert ), profile.Expand( env.Tls.Key ), env.Tls.Skip_verify )
+		if err != nil {
+			return nil, err
+		}
+		b = broker.Mk_amqp( host, port, uname, pw, tcfg )
+	}
+
+	return Mk_client( b, req_exch, resp_exch )
+}
+
+/*
+	Hand each response to the caller waiting for its msg_key; responses nobody is
+	waiting for (the caller gave up) are dropped.
+*/
+func (c *Client) dispatch( dch chan amqp.Delivery ) {
+	for {
+		select {
+			case d := <- dch:
+				var meta struct {
+					Msg_key	string	`json:"msg_key"`
+				}
+				if json.Unmarshal( d.Body, &meta ) != nil {
+					continue
+				}
+
+				c.mu.Lock()
+				ch := c.pending[meta.Msg_key]
+				delete( c.pending, meta.Msg_key )
+				c.mu.Unlock()
+
+				if ch != nil {
+					ch <- d.Body					// buffered; never blocks
+				}
+
+			case <- c.done:
+				return
+		}
+	}
+}
+
+/*
+	Stop the reader and writer. Calls waiting for a response return Err_closed.
+*/
+func (c *Client) Close( ) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.closed = true
+	c.pending = make( map[string]chan []byte )
+	c.mu.Unlock()
+
+	close( c.done )
+	c.r.Stop()
+	c.r.Close()
+	c.w.Close()
+}
+
+/*
+	Build the request with a new msg_key, send it, and wait for the response.
+*/
+func (c *Client) call( ctx context.Context, build func( exch_key string, msg_key string ) ( string ) ) ( *Response, error ) {
+	msg_key := uuid.NewRandom().String()
+	ch := make( chan []byte, 1 )
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, Err_closed
+	}
+	c.pending[msg_key] = ch
+	c.mu.Unlock()
+
+	forget := func() {
+		c.mu.Lock()
+		delete( c.pending, msg_key )
+		c.mu.Unlock()
+	}
+
+	select {
+		case c.w.Port() <- build( c.resp_key, msg_key ):
+
+		case <- ctx.Done():
+			forget()
+			return nil, ctx.Err()
+
+		case <- c.done:
+			return nil, Err_closed
+	}
+
+	select {
+		case body := <- ch:
+			return mk_response( body )
+
+		case <- ctx.Done():
+			forget()
+			return nil, ctx.Err()
+
+		case <- c.done:
+			return nil, Err_closed
+	}
+}
+
+/*
+	Unpack a response; a state other than OK is returned as a *State_error along
+	with the response.
+*/
+func mk_response( body []byte ) ( *Response, error ) {
+	var r struct {
+		Sender	string				`json:"sender"`
+		State	string				`json:"state"`
+		Msg		json.RawMessage		`json:"msg"`
+		Msg_key	string				`json:"msg_key"`
+		Data	json.RawMessage		`json:"data"`
+		Parsed	*vfdshow.Show		`json:"parsed"`
+	}
+	if err := json.Unmarshal( body, &r ); err != nil {
+		return nil, fmt.Errorf( "response is not valid json: %s", err )
+	}
+
+	resp := &Response {
+		Sender:		r.Sender,
+		State:		r.State,
+		Msg_key:	r.Msg_key,
+		Data:		r.Data,
+		Parsed:		r.Parsed,
+		Raw:		body,
+	}
+	if len( r.Msg ) > 0 {
+		resp.Msg = vfdshow.Lines( r.Msg )
+	}
+
+	if resp.State != "OK" {
+		return resp, &State_error { State: resp.State, Msg: strings.Join( resp.Msg, "; " ) }
+	}
+	return resp, nil
+}
+
+/*
+	Add a VF config as target. The config is validated before it is sent; a
+	*Config_error is returned if it has errors.
+*/
+func (c *Client) Add( ctx context.Context, target string, cfg []byte ) ( *Response, error ) {
+	if _, problems := Add_req( "", "", target, cfg ); vfcfg.Errors( problems ) > 0 {
+		return nil, &Config_error { Problems: problems }
+	}
+
+	return c.call( ctx, func( ek string, mk string ) ( string ) {
+		req, _ := Add_req( ek, mk, target, cfg )
+		return req
+	} )
+}
+
+/*
+	Delete the VF config added as target.
+*/
+func (c *Client) Delete( ctx context.Context, target string ) ( *Response, error ) {
+	return c.call( ctx, func( ek string, mk string ) ( string ) {
+		return Delete_req( ek, mk, target )
+	} )
+}
+
+/*
+	Show what (all if empty). Parsed in the response has the PFs and VFs.
+*/
+func (c *Client) Show( ctx context.Context, what string ) ( *Response, error ) {
+	return c.call( ctx, func( ek string, mk string ) ( string ) {
+		return Show_req( ek, mk, what )
+	} )
+}
+
+/*
+	Set mirroring of the VF on the PF; direction is in, out, all or off, and
+	target is the VF the traffic is mirrored to. The request data is built in
+	the order VFd expects: pf vf direction target.
+*/
+func (c *Client) Mirror( ctx context.Context, pf string, vf int, direction string, target string ) ( *Response, error ) {
+	data := strings.TrimSpace( fmt.Sprintf( "%s %d %s %s", pf, vf, direction, target ) )
+	return c.call( ctx, func( ek string, mk string ) ( string ) {
+		return Mirror_req( ek, mk, data )
+	} )
+}
+
+/*
+	Ping VFd through tokay.
+*/
+func (c *Client) Ping( ctx context.Context ) ( *Response, error ) {
+	return c.call( ctx, func( ek string, mk string ) ( string ) {
+		return Ping_req( ek, mk, "ping" )
+	} )
+}
@@ -0,0 +1,372 @@
+// vi: sw=4 ts=4:
+/*
+	Mnemonic:	client_test.go
+	Abstract:	Tests for the client over the in memory broker. Tokay is replaced by
+				a canned responder which reads the requests from the request
+				exchange and answers each on the response exchange, as tokay
+				would, with whatever the test's answer function returns.
+
+	Date:		18 October 2026
+*/
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/att/vfd.gaol/tokay/lib/broker"
+)
+
+/*
+	A request as the responder sees it.
+*/
+type test_req struct {
+	Action		string				`json:"action"`
+	Exch_key	string				`json:"exch_key"`
+	Msg_key		string				`json:"msg_key"`
+	Target		string				`json:"target"`
+	Req_data	json.RawMessage		`json:"req_data"`
+}
+
+/*
+	Start a client and a responder on a new in memory broker. Answer is called for
+	each request and returns the response body, or nil to leave the request
+	unanswered. Requests are passed on to the returned channel as well.
+*/
+func mk_test_client( t *testing.T, answer func( *test_req ) ( []byte ) ) ( *Client, *broker.Mem, chan *test_req ) {
+	mem := broker.Mk_mem()
+	reqs := make( chan *test_req, 1024 )
+
+	dch := mem.Subscribe( "tokay_req", "direct", "tokay_req" )
+	go func() {
+		for d := range dch {
+			req := &test_req{}
+			if err := json.Unmarshal( d.Body, req ); err != nil {
+				t.Errorf( "client sent a request which isn't json: %s: %s", err, d.Body )
+				continue
+			}
+			reqs <- req
+			if resp := answer( req ); resp != nil {
+				mem.Publish( "tokay_resp", req.Exch_key, resp, "", "" )
+			}
+		}
+	}()
+
+	c, err := Mk_client( mem, "tokay_req", "tokay_resp" )
+	if err != nil {
+		t.Fatalf( "unable to create client: %s", err )
+	}
+	t.Cleanup( c.Close )
+
+	return c, mem, reqs
+}
+
+/*
+	Build a response as tokay does: the msg_key of the request, a state and msg,
+	and (if not empty) data.
+*/
+func response( req *test_req, state string, msg interface{}, data string ) ( []byte ) {
+	jmsg, _ := json.Marshal( msg )
+	if data == "" {
+		return []byte( fmt.Sprintf( `{ "sender": "tokay-test", "state": %q, "msg": %s, "msg_key": %q }`, state, jmsg, req.Msg_key ) )
+	}
+	return []byte( fmt.Sprintf( `{ "sender": "tokay-test", "state": %q, "msg": %s, "msg_key": %q, "data": %s }`, state, jmsg, req.Msg_key, data ) )
+}
+
+/*
+	The number of callers waiting for a response.
+*/
+func npending( c *Client ) ( int ) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len( c.pending )
+}
+
+/*
+	Wait for the next request the responder saw.
+*/
+func next_req( t *testing.T, reqs chan *test_req ) ( *test_req ) {
+	select {
+		case req := <- reqs:
+			return req
+
+		case <- time.After( 2 * time.Second ):
+			t.Fatalf( "no request sent" )
+	}
+	return nil
+}
+
+func TestRoundTrips( t *testing.T ) {
+	show_lines := []string {
+		"PF/VF  ID    PCIID           Link      Speed     Duplex    RX pkts   RX bytes  RX errors RX dropped   TX pkts   TX bytes  TX errors  Spoofed",
+		"pf     0     0000:01:00.0    UP        10000     FD            0          0          0          0         0          0          0        0",
+		"vf     1     0000:01:00.0    UP        10000     FD           10        640          0          0        10        640          0        0",
+	}
+
+	c, _, reqs := mk_test_client( t, func( req *test_req ) ( []byte ) {
+		switch req.Action {
+			case "add":
+				return response( req, "OK", "vf add: " + req.Target, "" )
+
+			case "delete":
+				if req.Target == "vm9" {
+					return response( req, "ERROR", "delete failed: unknown vf: vm9", "" )
+				}
+				return response( req, "OK", "vf deleted: " + req.Target, "" )
+
+			case "show":
+				return []byte( fmt.Sprintf( `{ "state": "OK", "msg": %s, "msg_key": %q, "parsed": { "pfs": [ { "id": 0, "pciid": "0000:01:00.0" } ], "vfs": [ { "pf": "0000:01:00.0", "vfid": 1 } ] } }`,
+					func() ( string ) { b, _ := json.Marshal( show_lines ); return string( b ) }(), req.Msg_key ) )
+
+			case "mirror":
+				var data string
+				json.Unmarshal( req.Req_data, &data )
+				return response( req, "OK", "mirror: " + data, "" )
+
+			case "ping":
+				return response( req, "OK", "pong", `{ "vfd_rid": "r1" }` )
+		}
+		return response( req, "ERROR", "unknown action", "" )
+	} )
+	ctx := context.Background()
+
+	resp, err := c.Add( ctx, "vm1", []byte( "{\n\t\"pciid\": \"0000:01:00.0\",\n\t\"vfid\": 1\n}" ) )
+	if err != nil || resp.State != "OK" || strings.Join( resp.Msg, "" ) != "vf add: vm1" {
+		t.Errorf( "add: unexpected response %+v err=%v", resp, err )
+	}
+	if req := next_req( t, reqs ); req.Target != "vm1" || string( req.Req_data ) != `{"pciid":"0000:01:00.0","vfid":1}` || req.Msg_key != resp.Msg_key {
+		t.Errorf( "add: unexpected request %+v", req )
+	}
+
+	resp, err = c.Delete( ctx, "vm1" )
+	if err != nil || strings.Join( resp.Msg, "" ) != "vf deleted: vm1" {
+		t.Errorf( "delete: unexpected response %+v err=%v", resp, err )
+	}
+	if req := next_req( t, reqs ); req.Action != "delete" || req.Target != "vm1" {
+		t.Errorf( "delete: unexpected request %+v", req )
+	}
+
+	resp, err = c.Delete( ctx, "vm9" )
+	var serr *State_error
+	if ! errors.As( err, &serr ) || serr.State != "ERROR" || ! strings.Contains( serr.Msg, "unknown vf: vm9" ) || resp == nil || resp.State != "ERROR" {
+		t.Errorf( "failed delete: expected a state error with the response, got %+v err=%v", resp, err )
+	}
+	next_req( t, reqs )
+
+	resp, err = c.Show( ctx, "" )
+	if err != nil || len( resp.Msg ) != 3 || resp.Parsed == nil || len( resp.Parsed.Vfs ) != 1 || resp.Parsed.Vfs[0].Vfid != 1 {
+		t.Errorf( "show: unexpected response %+v err=%v", resp, err )
+	}
+	if req := next_req( t, reqs ); req.Action != "show" || req.Target != "all" {
+		t.Errorf( "show: expected show all, got %+v", req )
+	}
+
+	resp, err = c.Mirror( ctx, "0000:01:00.0", 1, "in", "2" )
+	if err != nil || strings.Join( resp.Msg, "" ) != "mirror: 0000:01:00.0 1 in 2" {
+		t.Errorf( "mirror: unexpected response %+v err=%v", resp, err )
+	}
+	next_req( t, reqs )
+
+	resp, err = c.Ping( ctx )
+	if err != nil || strings.Join( resp.Msg, "" ) != "pong" || string( resp.Data ) != `{ "vfd_rid": "r1" }` || resp.Sender != "tokay-test" || len( resp.Raw ) == 0 {
+		t.Errorf( "ping: unexpected response %+v err=%v", resp, err )
+	}
+	if req := next_req( t, reqs ); req.Action != "ping" {
+		t.Errorf( "ping: unexpected request %+v", req )
+	}
+
+	if n := npending( c ); n != 0 {
+		t.Errorf( "%d callers still pending after all calls returned", n )
+	}
+}
+
+/*
+	An invalid config is rejected before anything is sent.
+*/
+func TestAddInvalid( t *testing.T ) {
+	c, _, reqs := mk_test_client( t, func( req *test_req ) ( []byte ) { return response( req, "OK", "", "" ) } )
+
+	_, err := c.Add( context.Background(), "vm1", []byte( `{ "vfid": 1 }` ) )
+	var cerr *Config_error
+	if ! errors.As( err, &cerr ) || ! strings.Contains( err.Error(), "pciid" ) {
+		t.Errorf( "expected a config error naming pciid, got %v", err )
+	}
+
+	select {
+		case req := <- reqs:
+			t.Errorf( "invalid config was sent: %+v", req )
+
+		case <- time.After( 100 * time.Millisecond ):
+	}
+}
+
+/*
+	Many callers at once, answered in the reverse of the order they were sent;
+	each must get the response to its own request.
+*/
+func TestConcurrent( t *testing.T ) {
+	const ncallers = 50
+
+	var mu sync.Mutex
+	held := make( []*test_req, 0, ncallers )
+	var mem *broker.Mem
+	c, mem, _ := mk_test_client( t, func( req *test_req ) ( []byte ) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		held = append( held, req )
+		if len( held ) == ncallers {
+			for i := len( held ) - 1; i >= 0; i-- {
+				mem.Publish( "tokay_resp", held[i].Exch_key, response( held[i], "OK", "vf deleted: " + held[i].Target, "" ), "", "" )
+			}
+		}
+		return nil
+	} )
+
+	var wg sync.WaitGroup
+	errs := make( chan string, ncallers )
+	for i := 0; i < ncallers; i++ {
+		wg.Add( 1 )
+		go func( target string ) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout( context.Background(), 5 * time.Second )
+			defer cancel()
+			resp, err := c.Delete( ctx, target )
+			switch {
+				case err != nil:
+					errs <- fmt.Sprintf( "%s: %s", target, err )
+
+				case strings.Join( resp.Msg, "" ) != "vf deleted: " + target:
+					errs <- fmt.Sprintf( "%s: got the response for another request: %s", target, resp.Msg )
+			}
+		}( fmt.Sprintf( "vm%d", i ) )
+	}
+	wg.Wait()
+
+	close( errs )
+	for e := range errs {
+		t.Error( e )
+	}
+	if n := npending( c ); n != 0 {
+		t.Errorf( "%d callers still pending", n )
+	}
+}
+
+/*
+	A call whose context is cancelled, or whose deadline passes, returns the
+	context's error and forgets the request; a late response is discarded and
+	the client carries on.
+*/
+func TestContext( t *testing.T ) {
+	c, mem, reqs := mk_test_client( t, func( req *test_req ) ( []byte ) {
+		if req.Action == "ping" {
+			return response( req, "OK", "pong", "" )
+		}
+		return nil												// the rest are answered late, by the test
+	} )
+
+	ctx, cancel := context.WithCancel( context.Background() )
+	go func() {
+		time.Sleep( 100 * time.Millisecond )
+		cancel()
+	}()
+	if _, err := c.Show( ctx, "all" ); err != context.Canceled {
+		t.Errorf( "cancel: expected %v, got %v", context.Canceled, err )
+	}
+	if n := npending( c ); n != 0 {
+		t.Errorf( "cancel: %d callers still pending", n )
+	}
+	late := next_req( t, reqs )
+
+	dctx, dcancel := context.WithTimeout( context.Background(), 100 * time.Millisecond )
+	defer dcancel()
+	start := time.Now()
+	if _, err := c.Delete( dctx, "vm1" ); err != context.DeadlineExceeded {
+		t.Errorf( "deadline: expected %v, got %v", context.DeadlineExceeded, err )
+	}
+	if el := time.Since( start ); el > time.Second {
+		t.Errorf( "deadline: call took %s", el )
+	}
+	if n := npending( c ); n != 0 {
+		t.Errorf( "deadline: %d callers still pending", n )
+	}
+	next_req( t, reqs )
+
+	if _, err := c.Delete( ctx, "vm2" ); err != context.Canceled {			// already cancelled; may or may not be sent
+		t.Errorf( "cancelled before the call: expected %v, got %v", context.Canceled, err )
+	}
+	if n := npending( c ); n != 0 {
+		t.Errorf( "cancelled before the call: %d callers still pending", n )
+	}
+
+	mem.Publish( "tokay_resp", late.Exch_key, response( late, "OK", "late", "" ), "", "" )
+	if resp, err := c.Ping( context.Background() ); err != nil || strings.Join( resp.Msg, "" ) != "pong" {
+		t.Errorf( "after a late response: expected pong, got %+v err=%v", resp, err )
+	}
+}
+
+/*
+	Close fails the calls waiting for a response, and any made later.
+*/
+func TestClose( t *testing.T ) {
+	const ncallers = 5
+
+	c, _, reqs := mk_test_client( t, func( req *test_req ) ( []byte ) { return nil } )
+
+	errs := make( chan error, ncallers )
+	for i := 0; i < ncallers; i++ {
+		go func() {
+			_, err := c.Ping( context.Background() )
+			errs <- err
+		}()
+	}
+	for i := 0; i < ncallers; i++ {
+		next_req( t, reqs )										// all sent and waiting
+	}
+
+	c.Close()
+	for i := 0; i < ncallers; i++ {
+		select {
+			case err := <- errs:
+				if err != Err_closed {
+					t.Errorf( "waiting call: expected %v, got %v", Err_closed, err )
+				}
+
+			case <- time.After( 2 * time.Second ):
+				t.Fatalf( "waiting calls did not return when the client was closed" )
+		}
+	}
+	if n := npending( c ); n != 0 {
+		t.Errorf( "%d callers still pending after close", n )
+	}
+
+	if _, err := c.Ping( context.Background() ); err != Err_closed {
+		t.Errorf( "call after close: expected %v, got %v", Err_closed, err )
+	}
+	c.Close()													// a second close does nothing
+}
+
+func TestSplitExch( t *testing.T ) {
+	for _, c := range []struct {
+		exch	string
+		want	string
+	} {
+		{ "tokay_req", "tokay_req direct+!du+ad tokay_req" },
+		{ "req:topic", "req topic tokay_req" },
+		{ "req:fanout+du:vfd.east", "req fanout+du vfd.east" },
+	} {
+		name, etype, key := split_exch( c.exch, "direct+!du+ad", "tokay_req" )
+		if got := name + " " + etype + " " + key; got != c.want {
+			t.Errorf( "%s: expected %q, got %q", c.exch, c.want, got )
+		}
+	}
+}
@@ -0,0 +1,101 @@
+// vi: sw=4 ts=4:
+/*
+	Mnemonic:	request.go
+	Abstract:	Builders for the json requests that tokay accepts. Each takes the
+				exchange key (the routing key tokay uses for the response) and the
+				message key (echoed in the response so that it can be matched to
+				the request). Tokay passes the target and req_data fields on to VFd;
+				raw json (the add config) and multi token strings (mirror) go in
+				req_data.
+
+				These are used by Client and by tokay_req.
+
+	Date:		18 October 2026
+*/
+
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/att/vfd.gaol/tokay/lib/vfcfg"
+)
+
+/*
+	Build an add request for the target (the name VFd will save the config as).
+	The config is validated first; if there are errors the request is empty.
+	Problems (errors and warnings) are returned either way.
+*/
+func Add_req( exch_key string, msg_key string, target string, cfg []byte ) ( string, []vfcfg.Field_error ) {
+	problems := vfcfg.Validate( cfg )
+	if vfcfg.Errors( problems ) > 0 {
+		return "", problems
+	}
+
+	var cbuf bytes.Buffer
+	json.Compact( &cbuf, cfg )			// it parsed, so this can't fail; a file may be multi line
+	return fmt.Sprintf( `{ "action": "add", "exch_key": %q, "msg_key": %q, "target": %q, "req_data": %s }`, exch_key, msg_key, target, cbuf.Bytes() ), problems
+}
+
+/*
+	Build a delete request; the target is the name given on the add.
+*/
+func Delete_req( exch_key string, msg_key string, target string ) ( string ) {
+	return fmt.Sprintf( `{ "action": "delete", "exch_key": %q, "msg_key": %q, "target": %q }`, exch_key, msg_key, target )
+}
+
+/*
+	Build a dump request. VFd only acks; the dump goes to its log.
+*/
+func Dump_req( exch_key string, msg_key string ) ( string ) {
+	return fmt.Sprintf( `{ "action": "dump", "exch_key": %q, "msg_key": %q, "target": "" }`, exch_key, msg_key )
+}
+
+/*
+	Build a show request; what is all, pfs, extended, mirror, or a single
+	pf/vf as VFd accepts it.
+*/
+func Show_req( exch_key string, msg_key string, what string ) ( string ) {
+	if what == "" {
+		what = "all"
+	}
+	return fmt.Sprintf( `{ "action": "show", "exch_key": %q, "msg_key": %q, "target": %q }`, exch_key, msg_key, what )
+}
+
+/*
+	Build a ping request. Kind is ping (passed to VFd) or Ping (answered by tokay).
+*/
+func Ping_req( exch_key string, msg_key string, kind string ) ( string ) {
+	return fmt.Sprintf( `{ "action": %q, "exch_key": %q, "msg_key": %q, "req_data": "" }`, kind, exch_key, msg_key )
+}
+
+/*
+	Build a list request; tokay answers with the targets in its config store.
+*/
+func List_req( exch_key string, msg_key string ) ( string ) {
+	return fmt.Sprintf( `{ "action": "list", "exch_key": %q, "msg_key": %q }`, exch_key, msg_key )
+}
+
+/*
+	Build a get request; tokay answers with the config stored for the target.
+*/
+func Get_req( exch_key string, msg_key string, target string ) ( string ) {
+	return fmt.Sprintf( `{ "action": "get", "exch_key": %q, "msg_key": %q, "target": %q }`, exch_key, msg_key, target )
+}
+
+/*
+	Build a verbose request which sets VFd's log level.
+*/
+func Verbose_req( exch_key string, msg_key string, level string ) ( string ) {
+	return fmt.Sprintf( `{ "action": "verbose", "exch_key": %q, "msg_key": %q, "req_data": %q }`, exch_key, msg_key, level )
+}
+
+/*
+	Build a mirror request; data is the string VFd expects:
+		<pf> <vf> <direction> [<target>]
+*/
+func Mirror_req( exch_key string, msg_key string, data string ) ( string ) {
+	return fmt.Sprintf( `{ "action": "mirror", "exch_key": %q, "msg_key": %q, "req_data": %q }`, exch_key, msg_key, data )
+}
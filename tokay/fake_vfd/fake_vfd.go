@@ -0,0 +1,85 @@
+// vi: sw=4 ts=4:
+/*
+	Mnemonic:	fake_vfd.go
+	Abstract:	Runs the fake VFd (lib/fakevfd) so that tokay can be exercised on a host
+				without VFd, DPDK or a NIC. By default it creates and listens on the
+				same request fifo that VFd uses; -t unix or -t unixpacket listen on
+				the socket given with -s instead (match tokay's vfd_transport).
+
+				Responses can be delayed (-d), answered with an error at a given
+				rate (-e) or dropped (-D) to drive tokay's error and timeout paths.
+
+	Date:		18 October 2026
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/att/gopkgs/bleater"
+	"github.com/att/vfd.gaol/tokay/lib/fakevfd"
+)
+
+func main( ) {
+	var (
+		err		error
+	)
+
+	delay		:= flag.Int( "d", 0, "delay (ms) before each response" )
+	drop_rate	:= flag.Float64( "D", 0.0, "fraction (0.0-1.0) of requests which are not answered" )
+	err_rate	:= flag.Float64( "e", 0.0, "fraction (0.0-1.0) of requests answered with an error" )
+	pfs			:= flag.String( "p", "", "comma separated list of PF pciids to report in show output" )
+	req_fifo	:= flag.String( "r", "/var/lib/vfd/pipes/request", "request fifo to create and read" )
+	sock_path	:= flag.String( "s", "/var/lib/vfd/pipes/vfd.sock", "socket path when transport is unix or unixpacket" )
+	transport	:= flag.String( "t", "fifo", "transport: fifo, unix or unixpacket" )
+	vlevel		:= flag.Uint( "V", 0, "verbosity level n" )
+	verbose		:= flag.Bool( "v", false, "verbosity 1" )
+	flag.Parse()
+
+	if *vlevel <= 0 && *verbose {
+		*vlevel = 1
+	}
+	sheep := bleater.Mk_bleater( *vlevel, os.Stderr )
+	sheep.Set_prefix( "fake_vfd" )
+	sheep.Set_level( *vlevel )
+
+	opts := &fakevfd.Options {
+		Delay:		time.Duration( *delay ) * time.Millisecond,
+		Err_rate:	*err_rate,
+		Drop_rate:	*drop_rate,
+		Log:		func( format string, args ...interface{} ) { sheep.Baa( 1, format, args... ) },
+	}
+	if *pfs != "" {
+		opts.Pfs = strings.Split( *pfs, "," )
+	}
+	v := fakevfd.Mk_vfd( opts )
+
+	sig_ch := make( chan os.Signal, 1 )
+	signal.Notify( sig_ch, syscall.SIGINT, syscall.SIGTERM )
+	go func() {
+		<- sig_ch
+		rcvd, ans, errd, drop := v.Counts()
+		sheep.Baa( 0, "stopping: received=%d answered=%d errored=%d dropped=%d vfs=%d", rcvd, ans, errd, drop, v.Nvfs() )
+		if *transport != "fifo" {
+			os.Remove( *sock_path )
+		}
+		os.Exit( 0 )
+	}()
+
+	sheep.Baa( 0, "fake VFd started: transport=%s delay=%dms err_rate=%.2f drop_rate=%.2f", *transport, *delay, *err_rate, *drop_rate )
+	if *transport == "fifo" {
+		err = v.Serve_fifo( *req_fifo )
+	} else {
+		err = v.Serve_socket( *transport, *sock_path )
+	}
+
+	fmt.Fprintf( os.Stderr, "abort: %s\n", err )
+	os.Exit( 1 )
+}
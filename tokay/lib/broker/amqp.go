@@ -0,0 +1,399 @@
+// vi: sw=4 ts=4:
+/*
+	Mnemonic:	amqp.go
+	Abstract:	A broker which talks to RabbitMQ directly through the amqp library
+				rather than via rabbit_hole. It exists because rabbit_hole has no way
+				to connect with TLS; when a TLS config is given the connection is made
+				with amqps. Exchange type strings are the same type+opts form used
+				everywhere else (e.g. direct+!du+ad); du is durable and ad is auto
+				delete, each turned off with a leading bang. Without options an
+				exchange is not durable and is auto deleted.
+
+				The default exchange ("") can't be declared, so a writer for it
+				skips the declaration; it is used to send RPC replies. Writers
+				reconnect when a publish fails, and a writer for the default
+				exchange is created even if the broker can't be reached at the
+				time (it connects once there is something to send).
+
+				Readers bind a private, exclusive queue to the exchange with their
+				key; each reader and writer has its own connection so that closing one
+				does not affect the others.
+
+				Errors which happen after a reader or writer was created (a publish
+				that fails, for instance) have nobody to return them to, so they are
+				given to the broker's Log function; by default they are written to
+				standard error.
+
+	Date:		18 October 2026
+*/
+
+package broker
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/att/gopkgs/rabbit_hole"
+)
+
+const (
+	redial_ivl	time.Duration = 5 * time.Second		// least time between attempts to reconnect a writer
+)
+
+type Amqp struct {
+	host	string
+	port	string
+	uname	string
+	pw		string
+	tcfg	*tls.Config					// nil for a plain connection
+	Log		func( string, ...interface{} )	// reports errors from writers; may be replaced
+}
+
+/*
+	Build a TLS config. The CA file is used to verify the server (the system pool
+	if empty); cert and key are given only if the server wants a client cert.
+*/
+func Tls_config( ca_file string, cert_file string, key_file string, skip_verify bool ) ( *tls.Config, error ) {
+	tcfg := &tls.Config { InsecureSkipVerify: skip_verify }
+
+	if ca_file != "" {
+		pem, err := os.ReadFile( ca_file )
+		if err != nil {
+			return nil, fmt.Errorf( "unable to read CA file: %s", err )
+		}
+		tcfg.RootCAs = x509.NewCertPool()
+		if ! tcfg.RootCAs.AppendCertsFromPEM( pem ) {
+			return nil, fmt.Errorf( "no certificates found in CA file: %s", ca_file )
+		}
+	}
+
+	if cert_file != "" || key_file != "" {
+		cert, err := tls.LoadX509KeyPair( cert_file, key_file )
+		if err != nil {
+			return nil, fmt.Errorf( "unable to load client cert/key: %s", err )
+		}
+		tcfg.Certificates = []tls.Certificate { cert }
+	}
+
+	return tcfg, nil
+}
+
+/*
+	Create the broker; tcfg may be nil for a plain connection.
+*/
+func Mk_amqp( host string, port string, uname string, pw string, tcfg *tls.Config ) ( *Amqp ) {
+	return &Amqp {
+		host:	host,
+		port:	port,
+		uname:	uname,
+		pw:		pw,
+		tcfg:	tcfg,
+		Log:	func( format string, args ...interface{} ) { fmt.Fprintf( os.Stderr, format + "\n", args... ) },
+	}
+}
+
+/*
+	Report an error through the broker's Log function if there is one.
+*/
+func (b *Amqp) log( format string, args ...interface{} ) {
+	if b.Log != nil {
+		b.Log( format, args... )
+	}
+}
+
+func (b *Amqp) String( ) ( string ) {
+	scheme := "amqp"
+	if b.tcfg != nil {
+		scheme = "amqps"
+	}
+	return fmt.Sprintf( "%s://%s@%s:%s", scheme, b.uname, b.host, b.port )
+}
+
+func (b *Amqp) dial( ) ( *amqp.Connection, *amqp.Channel, error ) {
+	var (
+		conn	*amqp.Connection
+		err		error
+	)
+
+	u := &url.URL { Scheme: "amqp", User: url.UserPassword( b.uname, b.pw ), Host: b.host + ":" + b.port, Path: "/" }
+	if b.tcfg != nil {
+		u.Scheme = "amqps"
+		conn, err = amqp.DialTLS( u.String(), b.tcfg )
+	} else {
+		conn, err = amqp.Dial( u.String() )
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf( "unable to connect to %s: %s", b, err )
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	return conn, ch, nil
+}
+
+/*
+	Split type+opts into the type and the durable and auto delete settings.
+*/
+func parse_etype( etype string ) ( kind string, durable bool, auto_del bool ) {
+	tokens := strings.Split( etype, "+" )
+	kind = tokens[0]
+	if kind == "" {
+		kind = "direct"
+	}
+	auto_del = true
+
+	for _, t := range tokens[1:] {
+		switch t {
+			case "du":		durable = true
+			case "!du":		durable = false
+			case "ad":		auto_del = true
+			case "!ad":		auto_del = false
+		}
+	}
+
+	return kind, durable, auto_del
+}
+
+func declare( ch *amqp.Channel, exch string, etype string ) ( error ) {
+	kind, durable, auto_del := parse_etype( etype )
+	return ch.ExchangeDeclare( exch, kind, durable, auto_del, false, false, nil )
+}
+
+type amqp_reader struct {
+	conn	*amqp.Connection
+	ch		*amqp.Channel
+	queue	string
+	tag		string
+}
+
+func (b *Amqp) Mk_reader( exch string, etype string, key *string ) ( Reader, error ) {
+	conn, ch, err := b.dial()
+	if err != nil {
+		return nil, err
+	}
+
+	k := ""
+	if key != nil {
+		k = *key
+	}
+
+	r := &amqp_reader { conn: conn, ch: ch, tag: fmt.Sprintf( "reader-%p", conn ) }
+	if err = declare( ch, exch, etype ); err == nil {
+		var q amqp.Queue
+		if q, err = ch.QueueDeclare( "", false, true, true, false, nil ); err == nil {
+			r.queue = q.Name
+			err = ch.QueueBind( q.Name, k, exch, false, nil )
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf( "unable to bind to exchange %s: %s", exch, err )
+	}
+
+	return r, nil
+}
+
+/*
+	Start consuming; deliveries are pushed onto dch by a goroutine which finishes
+	when the reader is closed. An error is returned if the consume is refused.
+*/
+func (r *amqp_reader) Start_eating( dch chan amqp.Delivery ) ( error ) {
+	src, err := r.ch.Consume( r.queue, r.tag, true, true, false, false, nil )
+	if err != nil {
+		return fmt.Errorf( "unable to consume from queue %s: %s", r.queue, err )
+	}
+
+	go func() {
+		for d := range src {
+			dch <- d
+		}
+	}()
+
+	return nil
+}
+
+func (r *amqp_reader) Stop( ) {
+	r.ch.Cancel( r.tag, false )
+}
+
+func (r *amqp_reader) Close( ) {
+	r.conn.Close()
+}
+
+/*
+	A writer holds its own connection. If a publish fails the connection is
+	dropped and redialed (no more often than redial_ivl) and the message is tried
+	once more; messages which still can't be sent are dropped and counted, and the
+	count is logged when the connection is back.
+*/
+type amqp_writer struct {
+	b			*Amqp
+	mu			sync.Mutex					// held while the connection is changed
+	conn		*amqp.Connection			// nil while disconnected
+	ch			*amqp.Channel
+	exch		string
+	etype		string
+	port		chan interface{}
+	done		chan bool
+	last_dial	time.Time
+	dropped		int64						// messages dropped since the last successful publish
+}
+
+/*
+	Create a writer on the exchange. The default exchange ("") needs no
+	declaration, so a writer for it is returned even if the broker can't be
+	reached now (the failure is logged); it connects when there is something to
+	send.
+*/
+func (b *Amqp) Mk_writer( exch string, etype string, key *string ) ( Writer, error ) {
+	w := &amqp_writer { b: b, exch: exch, etype: etype, port: make( chan interface{}, 1024 ), done: make( chan bool ) }
+	if err := w.connect(); err != nil {
+		if exch != "" {
+			return nil, err
+		}
+		b.log( "unable to connect writer for the default exchange; will retry when there is something to send: %s", err )
+	}
+
+	return w, nil
+}
+
+/*
+	Drop any current connection and dial a new one, declaring the exchange.
+*/
+func (w *amqp_writer) connect( ) ( error ) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.conn != nil {
+		w.conn.Close()
+		w.conn, w.ch = nil, nil
+	}
+	w.last_dial = time.Now()
+
+	conn, ch, err := w.b.dial()
+	if err != nil {
+		return err
+	}
+	if w.exch != "" {
+		if err = declare( ch, w.exch, w.etype ); err != nil {
+			conn.Close()
+			return fmt.Errorf( "unable to declare exchange %s: %s", w.exch, err )
+		}
+	}
+
+	w.conn, w.ch = conn, ch
+	return nil
+}
+
+/*
+	Publish one message, reconnecting if the channel has failed.
+*/
+func (w *amqp_writer) publish( exch string, key string, corr_id string, data []byte ) {
+	msg := amqp.Publishing { ContentType: "application/json", CorrelationId: corr_id, Body: data }
+
+	for try := 0; try < 2; try++ {
+		if w.ch == nil {
+			if time.Since( w.last_dial ) < redial_ivl {
+				break
+			}
+			if err := w.connect(); err != nil {
+				w.b.log( "reconnect for exchange %q failed: %s", w.exch, err )
+				break
+			}
+		}
+
+		err := w.ch.Publish( exch, key, false, false, msg )
+		if err == nil {
+			if w.dropped > 0 {
+				w.b.log( "publishing to exchange %q again; %d messages were dropped", exch, w.dropped )
+				w.dropped = 0
+			}
+			return
+		}
+
+		w.b.log( "publish to exchange %q key %q failed: %s; reconnecting", exch, key, err )
+		w.mu.Lock()
+		w.ch = nil										// connect closes the old connection
+		w.mu.Unlock()
+		w.last_dial = time.Time{}						// allow an immediate redial after a failure
+	}
+
+	if w.dropped == 0 {
+		w.b.log( "not connected; dropping messages for exchange %q until the connection is back", exch )
+	}
+	w.dropped++
+}
+
+/*
+	Publish everything put on the port; key is used when the message doesn't
+	carry one. Rpc_msg replies always go to the default exchange.
+*/
+func (w *amqp_writer) Start_writer( key string ) {
+	go func() {
+		for {
+			var (
+				k		string
+				data	[]byte
+			)
+			exch := w.exch
+			corr_id := ""
+
+			select {
+				case stuff := <- w.port:
+					switch msg := stuff.(type) {
+						case *rabbit_hole.Mq_msg:
+							k = msg.Key
+							data = msg.Data
+
+						case *Rpc_msg:
+							exch = ""
+							k = msg.Reply_to
+							corr_id = msg.Corr_id
+							data = msg.Data
+
+						case []byte:
+							data = msg
+
+						case string:
+							data = []byte( msg )
+
+						default:
+							continue
+					}
+
+				case <- w.done:
+					return
+			}
+
+			if k == "" {
+				k = key
+			}
+			w.publish( exch, k, corr_id, data )
+		}
+	}()
+}
+
+func (w *amqp_writer) Port( ) ( chan interface{} ) {
+	return w.port
+}
+
+func (w *amqp_writer) Close( ) {
+	close( w.done )
+
+	w.mu.Lock()
+	if w.conn != nil {
+		w.conn.Close()
+	}
+	w.mu.Unlock()
+}
@@ -0,0 +1,407 @@
+// vi: sw=4 ts=4:
+/*
+	Mnemonic:	broker.go
+	Abstract:	The small part of the message bus that tokay uses: readers which push
+				deliveries onto a channel, and writers which publish whatever is put
+				on their port. Three brokers are provided:
+
+					Rmq	- RabbitMQ via rabbit_hole (what tokay runs with)
+					Amqp - RabbitMQ via the amqp library directly; supports TLS (amqp.go)
+					Mem	- an in process stand-in which needs no network; used by the
+						  self test harness to run the whole pipeline on one box
+
+				Exchange types for the memory broker are direct, topic (with the usual
+				* and # matching) and fanout; any +options on the type are ignored.
+
+				An Rpc_msg put on a writer's port is a reply to a request which gave
+				a reply-to queue; it is published on the default exchange with the
+				queue name as the key and carries the request's correlation id.
+				The rabbit_hole writer can't set message properties, so only the
+				Amqp and Mem writers send them.
+
+	Date:		18 October 2026
+*/
+
+package broker
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/streadway/amqp"
+	"github.com/att/gopkgs/rabbit_hole"
+)
+
+/*
+	Pushes messages received on an exchange onto a channel. Start_eating returns
+	an error if the broker refused to start delivering.
+*/
+type Reader interface {
+	Start_eating( ch chan amqp.Delivery ) ( error )
+	Stop( )
+	Close( )
+}
+
+/*
+	A reply to an AMQP RPC style request: published to the default exchange with
+	Reply_to as the key (the reply queue, possibly amq.rabbitmq.reply-to.*) and
+	Corr_id as the correlation id.
+*/
+type Rpc_msg struct {
+	Reply_to	string
+	Corr_id		string
+	Data		[]byte
+}
+
+/*
+	Publishes each message put on the port: an *rabbit_hole.Mq_msg (to set the key),
+	an *Rpc_msg, a string, or a []byte.
+*/
+type Writer interface {
+	Start_writer( key string )
+	Port( ) ( chan interface{} )
+	Close( )
+}
+
+type Broker interface {
+	Mk_reader( exch string, etype string, key *string ) ( Reader, error )
+	Mk_writer( exch string, etype string, key *string ) ( Writer, error )
+	String( ) ( string )
+}
+
+// ------------------- rabbit -----------------------------------------------------
+
+type Rmq struct {
+	host	string
+	port	string
+	Rport	string						// port readers connect to if different from port
+	uname	string
+	pw		string
+}
+
+/*
+	Wrap a rabbit_hole writer; the port is a field there.
+*/
+type rmq_writer struct {
+	w	*rabbit_hole.Mq_writer
+}
+
+func (rw *rmq_writer) Start_writer( key string ) {
+	rw.w.Start_writer( key )
+}
+
+func (rw *rmq_writer) Port( ) ( chan interface{} ) {
+	return rw.w.Port
+}
+
+func (rw *rmq_writer) Close( ) {
+	rw.w.Close()
+}
+
+/*
+	Wrap a rabbit_hole reader; it has no way to report a failure to start.
+*/
+type rmq_reader struct {
+	r	*rabbit_hole.Mq_reader
+}
+
+func (rr *rmq_reader) Start_eating( ch chan amqp.Delivery ) ( error ) {
+	rr.r.Start_eating( ch )
+	return nil
+}
+
+func (rr *rmq_reader) Stop( ) {
+	rr.r.Stop()
+}
+
+func (rr *rmq_reader) Close( ) {
+	rr.r.Close()
+}
+
+func Mk_rmq( host string, port string, uname string, pw string ) ( *Rmq ) {
+	return &Rmq {
+		host:	host,
+		port:	port,
+		Rport:	port,
+		uname:	uname,
+		pw:		pw,
+	}
+}
+
+func (b *Rmq) Mk_reader( exch string, etype string, key *string ) ( Reader, error ) {
+	r, err := rabbit_hole.Mk_mqreader( b.host, b.Rport, b.uname, b.pw, exch, etype, key )
+	if err != nil {
+		return nil, err
+	}
+	return &rmq_reader { r: r }, nil
+}
+
+func (b *Rmq) Mk_writer( exch string, etype string, key *string ) ( Writer, error ) {
+	w, err := rabbit_hole.Mk_mqwriter( b.host, b.port, b.uname, b.pw, exch, etype, key )
+	if err != nil {
+		return nil, err
+	}
+	return &rmq_writer { w: w }, nil
+}
+
+func (b *Rmq) String( ) ( string ) {
+	return fmt.Sprintf( "%s@%s:%s", b.uname, b.host, b.port )
+}
+
+// ------------------- memory -----------------------------------------------------
+
+/*
+	A binding of a channel to an exchange.
+*/
+type mem_sub struct {
+	etype	string
+	key		string
+	ch		chan amqp.Delivery
+	stopped	bool
+}
+
+type Mem struct {
+	mu		sync.Mutex
+	subs	map[string][]*mem_sub		// bindings by exchange name
+	dropped	int64						// deliveries dropped because a channel was full
+}
+
+func Mk_mem( ) ( *Mem ) {
+	return &Mem {
+		subs:	make( map[string][]*mem_sub ),
+	}
+}
+
+/*
+	Return the base type from a type+options string.
+*/
+func base_type( etype string ) ( string ) {
+	return strings.SplitN( etype, "+", 2 )[0]
+}
+
+/*
+	Topic match: words are dot separated, * matches exactly one word and # matches
+	zero or more.
+*/
+func topic_match( pat []string, key []string ) ( bool ) {
+	if len( pat ) == 0 {
+		return len( key ) == 0
+	}
+
+	switch pat[0] {
+		case "#":
+			for i := 0; i <= len( key ); i++ {
+				if topic_match( pat[1:], key[i:] ) {
+					return true
+				}
+			}
+			return false
+
+		case "*":
+			return len( key ) > 0 && topic_match( pat[1:], key[1:] )
+	}
+
+	return len( key ) > 0 && pat[0] == key[0] && topic_match( pat[1:], key[1:] )
+}
+
+func (s *mem_sub) matches( key string ) ( bool ) {
+	switch base_type( s.etype ) {
+		case "fanout":
+			return true
+
+		case "topic":
+			return topic_match( strings.Split( s.key, "." ), strings.Split( key, "." ) )
+	}
+
+	return s.key == key
+}
+
+/*
+	Bind ch to the exchange; deliveries whose key matches (per the exchange type)
+	are pushed onto it.
+*/
+func (m *Mem) bind( exch string, etype string, key string, ch chan amqp.Delivery ) ( *mem_sub ) {
+	s := &mem_sub { etype: etype, key: key, ch: ch }
+
+	m.mu.Lock()
+	m.subs[exch] = append( m.subs[exch], s )
+	m.mu.Unlock()
+
+	return s
+}
+
+func (m *Mem) unbind( exch string, s *mem_sub ) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s.stopped = true
+	list := m.subs[exch]
+	for i := range list {
+		if list[i] == s {
+			m.subs[exch] = append( list[:i], list[i+1:]... )
+			return
+		}
+	}
+}
+
+/*
+	Return a buffered channel which receives messages published to the exchange
+	with a matching key.
+*/
+func (m *Mem) Subscribe( exch string, etype string, key string ) ( chan amqp.Delivery ) {
+	ch := make( chan amqp.Delivery, 1024 )
+	m.bind( exch, etype, key, ch )
+	return ch
+}
+
+/*
+	Publish a message; the delivery carries user and corr_id as rabbit would.
+	Returns the number of bindings it was delivered to. Like a real broker, we
+	don't block: if a channel is full the delivery is dropped (and counted).
+*/
+func (m *Mem) Publish( exch string, key string, body []byte, user string, corr_id string ) ( n int ) {
+	return m.publish( amqp.Delivery {
+		Exchange:		exch,
+		RoutingKey:		key,
+		Body:			body,
+		UserId:			user,
+		CorrelationId:	corr_id,
+	} )
+}
+
+/*
+	Publish a request as an RPC client would: with the queue the reply should be
+	sent to (on the default exchange, "" here) and the correlation id.
+*/
+func (m *Mem) Publish_rpc( exch string, key string, body []byte, user string, corr_id string, reply_to string ) ( n int ) {
+	return m.publish( amqp.Delivery {
+		Exchange:		exch,
+		RoutingKey:		key,
+		Body:			body,
+		UserId:			user,
+		CorrelationId:	corr_id,
+		ReplyTo:		reply_to,
+	} )
+}
+
+func (m *Mem) publish( d amqp.Delivery ) ( n int ) {
+	exch := d.Exchange
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, s := range m.subs[exch] {
+		if s.stopped || ! s.matches( d.RoutingKey ) {
+			continue
+		}
+
+		select {
+			case s.ch <- d:
+				n++
+
+			default:
+				m.dropped++
+		}
+	}
+
+	return n
+}
+
+/*
+	Number of deliveries dropped because a reader wasn't keeping up.
+*/
+func (m *Mem) Dropped( ) ( int64 ) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.dropped
+}
+
+type mem_reader struct {
+	m		*Mem
+	exch	string
+	etype	string
+	key		string
+	sub		*mem_sub
+}
+
+func (r *mem_reader) Start_eating( ch chan amqp.Delivery ) ( error ) {
+	r.sub = r.m.bind( r.exch, r.etype, r.key, ch )
+	return nil
+}
+
+func (r *mem_reader) Stop( ) {
+	if r.sub != nil {
+		r.m.unbind( r.exch, r.sub )
+		r.sub = nil
+	}
+}
+
+func (r *mem_reader) Close( ) {
+	r.Stop()
+}
+
+type mem_writer struct {
+	m		*Mem
+	exch	string
+	port	chan interface{}
+	done	chan bool
+}
+
+/*
+	Publish everything put on the port; key is used when the message doesn't
+	carry one.
+*/
+func (w *mem_writer) Start_writer( key string ) {
+	go func() {
+		for {
+			select {
+				case stuff := <- w.port:
+					switch msg := stuff.(type) {
+						case *rabbit_hole.Mq_msg:
+							k := msg.Key
+							if k == "" {
+								k = key
+							}
+							w.m.Publish( w.exch, k, msg.Data, "", "" )
+
+						case *Rpc_msg:
+							w.m.Publish( "", msg.Reply_to, msg.Data, "", msg.Corr_id )
+
+						case []byte:
+							w.m.Publish( w.exch, key, msg, "", "" )
+
+						case string:
+							w.m.Publish( w.exch, key, []byte( msg ), "", "" )
+					}
+
+				case <- w.done:
+					return
+			}
+		}
+	}()
+}
+
+func (w *mem_writer) Port( ) ( chan interface{} ) {
+	return w.port
+}
+
+func (w *mem_writer) Close( ) {
+	close( w.done )
+}
+
+func (m *Mem) Mk_reader( exch string, etype string, key *string ) ( Reader, error ) {
+	k := ""
+	if key != nil {
+		k = *key
+	}
+	return &mem_reader { m: m, exch: exch, etype: etype, key: k }, nil
+}
+
+func (m *Mem) Mk_writer( exch string, etype string, key *string ) ( Writer, error ) {
+	return &mem_writer { m: m, exch: exch, port: make( chan interface{}, 1024 ), done: make( chan bool ) }, nil
+}
+
+func (m *Mem) String( ) ( string ) {
+	return "in-memory broker"
+}
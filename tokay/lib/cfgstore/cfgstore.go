@@ -0,0 +1,276 @@
+// vi: sw=4 ts=4:
+/*
+	Mnemonic:	cfgstore.go
+	Abstract:	An index of the VF config files that tokay has written into the config
+				directory for VFd, along with what became of each: submitted (written
+				and sent to VFd), accepted or rejected by VFd, or deleted.  A copy of
+				the config is kept in the index because VFd may move or remove the
+				file once it has been processed.
+
+				The index is saved to a file after every change so that it survives
+				a restart of tokay. Files in the config directory which are not in
+				the index when the store is created are added with a status of found.
+
+				Write_atomic() is also used by tokay to write the config files so
+				that VFd never sees a partially written file.
+
+	Date:		18 October 2026
+*/
+
+package cfgstore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ST_found		string = "found"			// file was in the directory, but we have no record of writing it
+	ST_submitted	string = "submitted"		// written and request sent to VFd
+	ST_accepted		string = "accepted"			// VFd responded OK to the add/update
+	ST_rejected		string = "rejected"			// VFd responded with an error to the add/update
+	ST_deleted		string = "deleted"			// VFd responded OK to a delete
+)
+
+/*
+	Information about one target's config.
+*/
+type Entry struct {
+	Target	string				`json:"target"`
+	Fname	string				`json:"filename"`
+	Status	string				`json:"status"`
+	Updated	int64				`json:"updated"`		// unix timestamp of the last change
+	Config	json.RawMessage		`json:"config,omitempty"`
+}
+
+/*
+	The store. Functions are safe to call on a nil store (nothing is recorded
+	and nothing is found).
+*/
+type Store struct {
+	mu		sync.Mutex
+	cdir	string						// directory the configs are written to
+	ifname	string						// file the index is saved in; empty if not saved
+	entries	map[string]*Entry			// keyed by target
+}
+
+/*
+	Write the buffer to fname such that a reader will see either the old file or the
+	complete new file, never a partial one, and the new file survives a crash once
+	we return. The data is written to a temp file in the same directory, synced and
+	then renamed into place; the directory is synced to persist the rename.  The temp
+	file name starts with a dot and does not end in .json so that it is not mistaken
+	for a config should we die before the rename.
+
+	The returned checksum is the sha256 of the buffer in the form sha256:<hex> which
+	can be passed to a reader so that it can verify what it read.
+*/
+func Write_atomic( fname string, buf []byte, mode os.FileMode ) ( csum string, err error ) {
+	dir := filepath.Dir( fname )
+	f, err := os.CreateTemp( dir, "." + filepath.Base( fname ) + ".*" )
+	if err != nil {
+		return "", err
+	}
+	tname := f.Name()
+
+	_, err = f.Write( buf )				// write returns an error on a short write, no need to loop
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = f.Chmod( mode )
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename( tname, fname )
+	}
+	if err != nil {
+		os.Remove( tname )
+		return "", err
+	}
+
+	if d, derr := os.Open( dir ); derr == nil {		// persist the rename; not all filesystems allow a directory sync so errors are ignored
+		d.Sync()
+		d.Close()
+	}
+
+	sum := sha256.Sum256( buf )
+	return "sha256:" + hex.EncodeToString( sum[:] ), nil
+}
+
+/*
+	Create a store for the config files in cdir. If ifname is not empty, the index
+	is loaded from it (if it exists) and saved to it on change.  An error is returned
+	only if the index exists and cannot be parsed; the store is still usable in
+	that case, but will start empty.
+*/
+func Mk_store( cdir string, ifname string ) ( s *Store, err error ) {
+	s = &Store {
+		cdir: cdir,
+		ifname: ifname,
+		entries: make( map[string]*Entry ),
+	}
+
+	if ifname != "" {
+		buf, rerr := os.ReadFile( ifname )
+		if rerr == nil {
+			elist := make( []*Entry, 0 )
+			if err = json.Unmarshal( buf, &elist ); err == nil {
+				for _, e := range elist {
+					s.entries[e.Target] = e
+				}
+			} else {
+				err = fmt.Errorf( "unable to parse config store index: %s: %s", ifname, err )
+			}
+		}
+	}
+
+	fnames, _ := filepath.Glob( filepath.Join( cdir, "*.json" ) )
+	for _, fname := range fnames {
+		target := strings.TrimSuffix( filepath.Base( fname ), ".json" )
+		if s.entries[target] == nil {
+			e := &Entry { Target: target, Fname: fname, Status: ST_found }
+			if fi, serr := os.Stat( fname ); serr == nil {
+				e.Updated = fi.ModTime().Unix()
+			}
+			if buf, rerr := os.ReadFile( fname ); rerr == nil && json.Valid( buf ) {
+				e.Config = json.RawMessage( buf )
+			}
+			s.entries[target] = e
+		}
+	}
+
+	return s, err
+}
+
+/*
+	Save the index. Caller must hold the lock.
+*/
+func (s *Store) save( ) ( err error ) {
+	if s.ifname == "" {
+		return nil
+	}
+
+	elist := make( []*Entry, 0, len( s.entries ) )
+	for _, e := range s.entries {
+		elist = append( elist, e )
+	}
+	buf, err := json.Marshal( elist )
+	if err != nil {
+		return err
+	}
+
+	_, err = Write_atomic( s.ifname, buf, 0644 )
+	return err
+}
+
+/*
+	Record that the config for target was written to fname and sent to VFd.
+*/
+func (s *Store) Stashed( target string, fname string, config []byte ) ( err error ) {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries[target] = &Entry {
+		Target: target,
+		Fname: fname,
+		Status: ST_submitted,
+		Updated: time.Now().Unix(),
+		Config: json.RawMessage( append( []byte( nil ), config... ) ),
+	}
+
+	return s.save()
+}
+
+/*
+	Record the outcome of a request for target. Action is the action sent to VFd
+	(add, update, delete) and ok indicates whether VFd reported success. A failed
+	delete does not change the status. Unknown targets are ignored.
+*/
+func (s *Store) Result( target string, action string, ok bool ) ( err error ) {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := s.entries[target]
+	if e == nil {
+		return nil
+	}
+
+	switch action {
+		case "add", "update":
+			if ok {
+				e.Status = ST_accepted
+			} else {
+				e.Status = ST_rejected
+			}
+
+		case "del", "delete":
+			if ! ok {
+				return nil
+			}
+			e.Status = ST_deleted
+
+		default:
+			return nil
+	}
+
+	e.Updated = time.Now().Unix()
+	return s.save()
+}
+
+/*
+	Return a copy of the entry for target.
+*/
+func (s *Store) Get( target string ) ( e Entry, ok bool ) {
+	if s == nil {
+		return e, false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ep := s.entries[target]; ep != nil {
+		return *ep, true
+	}
+
+	return e, false
+}
+
+/*
+	Return a copy of all entries sorted by target. The configs are not included.
+*/
+func (s *Store) List( ) ( elist []Entry ) {
+	elist = make( []Entry, 0 )
+	if s == nil {
+		return elist
+	}
+
+	s.mu.Lock()
+	for _, e := range s.entries {
+		ec := *e
+		ec.Config = nil
+		elist = append( elist, ec )
+	}
+	s.mu.Unlock()
+
+	sort.Slice( elist, func( i, j int ) bool { return elist[i].Target < elist[j].Target } )
+	return elist
+}
@@ -0,0 +1,275 @@
+// vi: sw=4 ts=4:
+/*
+	Mnemonic:	cfgstore_test.go
+	Abstract:	Tests for the config store: status changes as VFd responds, and
+				reloading the index from disk; and for the atomic file write.
+
+	Date:		18 October 2026
+*/
+
+package cfgstore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+/*
+	Return the status of target, or "none" if it isn't in the store.
+*/
+func status( s *Store, target string ) ( string ) {
+	if e, ok := s.Get( target ); ok {
+		return e.Status
+	}
+	return "none"
+}
+
+func TestStatus( t *testing.T ) {
+	dir := t.TempDir()
+	s, err := Mk_store( dir, filepath.Join( dir, "store.idx" ) )
+	if err != nil {
+		t.Fatalf( "unexpected error: %s", err )
+	}
+
+	steps := []struct {
+		what	string					// stash or the action given to Result
+		ok		bool
+		want	string
+	} {
+		{ "stash", true, ST_submitted },
+		{ "add", true, ST_accepted },
+		{ "delete", false, ST_accepted },			// a failed delete leaves the status alone
+		{ "delete", true, ST_deleted },
+		{ "stash", true, ST_submitted },
+		{ "add", false, ST_rejected },
+		{ "stash", true, ST_submitted },
+		{ "update", true, ST_accepted },
+		{ "show", true, ST_accepted },				// not an action which changes a VF
+		{ "del", true, ST_deleted },
+	}
+	for i, st := range steps {
+		if st.what == "stash" {
+			err = s.Stashed( "vm1", filepath.Join( dir, "vm1.json" ), []byte( `{ "vfid": 1 }` ) )
+		} else {
+			err = s.Result( "vm1", st.what, st.ok )
+		}
+		if err != nil {
+			t.Fatalf( "step %d (%s): unexpected error: %s", i, st.what, err )
+		}
+		if got := status( s, "vm1" ); got != st.want {
+			t.Errorf( "step %d (%s ok=%v): expected %s, got %s", i, st.what, st.ok, st.want, got )
+		}
+	}
+
+	if err = s.Result( "unknown", "add", true ); err != nil || status( s, "unknown" ) != "none" {
+		t.Errorf( "result for an unknown target should be ignored: err=%v status=%s", err, status( s, "unknown" ) )
+	}
+}
+
+/*
+	A new store created with the same index has what the first one recorded, and
+	picks up config files it has no record of as found.
+*/
+func TestReload( t *testing.T ) {
+	dir := t.TempDir()
+	ifname := filepath.Join( dir, "store.idx" )
+
+	s, _ := Mk_store( dir, ifname )
+	s.Stashed( "vm1", filepath.Join( dir, "vm1.json" ), []byte( `{ "vfid": 1 }` ) )
+	s.Result( "vm1", "add", true )
+	s.Stashed( "vm2", filepath.Join( dir, "vm2.json" ), []byte( `{ "vfid": 2 }` ) )
+	s.Result( "vm2", "add", false )
+	s.Stashed( "vm3", filepath.Join( dir, "vm3.json" ), []byte( `{ "vfid": 3 }` ) )
+	s.Result( "vm3", "add", true )
+	s.Result( "vm3", "delete", true )
+	s.Stashed( "vm4", filepath.Join( dir, "vm4.json" ), []byte( `{ "vfid": 4 }` ) )
+
+	os.WriteFile( filepath.Join( dir, "vm5.json" ), []byte( `{ "vfid": 5 }` ), 0644 )		// written by someone else
+	os.WriteFile( filepath.Join( dir, "vm6.json" ), []byte( `not json` ), 0644 )
+
+	r, err := Mk_store( dir, ifname )
+	if err != nil {
+		t.Fatalf( "unexpected error reloading: %s", err )
+	}
+	for target, want := range map[string]string {
+		"vm1": ST_accepted, "vm2": ST_rejected, "vm3": ST_deleted, "vm4": ST_submitted, "vm5": ST_found, "vm6": ST_found,
+	} {
+		if got := status( r, target ); got != want {
+			t.Errorf( "%s: expected %s after reload, got %s", target, want, got )
+		}
+	}
+
+	if e, _ := r.Get( "vm2" ); string( e.Config ) != `{"vfid":2}` || e.Fname != filepath.Join( dir, "vm2.json" ) || e.Updated == 0 {
+		t.Errorf( "vm2 entry not reloaded: %+v", e )
+	}
+	if e, _ := r.Get( "vm5" ); string( e.Config ) != `{ "vfid": 5 }` {
+		t.Errorf( "config of a found file not read: %s", e.Config )
+	}
+	if e, _ := r.Get( "vm6" ); e.Config != nil {
+		t.Errorf( "config of a found file which isn't json should be empty: %s", e.Config )
+	}
+
+	r.Result( "vm5", "delete", true )						// changes made by the second store are saved too
+	if q, _ := Mk_store( dir, ifname ); status( q, "vm5" ) != ST_deleted {
+		t.Errorf( "change to a found entry was not saved" )
+	}
+}
+
+func TestBadIndex( t *testing.T ) {
+	dir := t.TempDir()
+	ifname := filepath.Join( dir, "store.idx" )
+	os.WriteFile( ifname, []byte( `{ "not": "a list" }` ), 0644 )
+
+	s, err := Mk_store( dir, ifname )
+	if err == nil || ! strings.Contains( err.Error(), ifname ) {
+		t.Errorf( "expected an error naming the index, got %v", err )
+	}
+	if s == nil || len( s.List() ) != 0 {
+		t.Fatalf( "expected a usable empty store" )
+	}
+	if err = s.Stashed( "vm1", "", []byte( `{}` ) ); err != nil {
+		t.Errorf( "store with a bad index not usable: %s", err )
+	}
+}
+
+func TestListGet( t *testing.T ) {
+	s, _ := Mk_store( t.TempDir(), "" )						// no index file
+	for _, target := range []string { "vm3", "vm1", "vm2" } {
+		s.Stashed( target, target + ".json", []byte( `{ "vfid": 1 }` ) )
+	}
+
+	l := s.List()
+	if len( l ) != 3 || l[0].Target != "vm1" || l[1].Target != "vm2" || l[2].Target != "vm3" {
+		t.Fatalf( "expected vm1 vm2 vm3, got %+v", l )
+	}
+	for _, e := range l {
+		if e.Config != nil {
+			t.Errorf( "list should not include configs: %s", e.Config )
+		}
+	}
+
+	e, ok := s.Get( "vm2" )
+	if ! ok || string( e.Config ) != `{ "vfid": 1 }` {
+		t.Errorf( "get: expected the config, got %+v", e )
+	}
+	e.Status = "changed"
+	if status( s, "vm2" ) != ST_submitted {
+		t.Errorf( "get returned the entry rather than a copy" )
+	}
+	if _, ok = s.Get( "vm9" ); ok {
+		t.Errorf( "get of an unknown target succeeded" )
+	}
+
+	var ns *Store
+	if ns.Stashed( "vm1", "", nil ) != nil || ns.Result( "vm1", "add", true ) != nil || len( ns.List() ) != 0 {
+		t.Errorf( "nil store should record nothing" )
+	}
+}
+
+/*
+	Return the names of the files in dir other than those listed.
+*/
+func others( t *testing.T, dir string, known ...string ) ( []string ) {
+	ents, err := os.ReadDir( dir )
+	if err != nil {
+		t.Fatalf( "unable to read %s: %s", dir, err )
+	}
+
+	l := make( []string, 0 )
+	next:
+	for _, de := range ents {
+		for _, k := range known {
+			if de.Name() == k {
+				continue next
+			}
+		}
+		l = append( l, de.Name() )
+	}
+	return l
+}
+
+func TestWriteAtomic( t *testing.T ) {
+	dir := t.TempDir()
+	fname := filepath.Join( dir, "vm1.json" )
+	buf := []byte( `{ "pciid": "0000:07:00.1", "vfid": 1 }` )
+
+	csum, err := Write_atomic( fname, buf, 0600 )
+	if err != nil {
+		t.Fatalf( "unexpected error: %s", err )
+	}
+
+	got, _ := os.ReadFile( fname )
+	if string( got ) != string( buf ) {
+		t.Errorf( "file has %q, expected %q", got, buf )
+	}
+	sum := sha256.Sum256( got )
+	if csum != "sha256:" + hex.EncodeToString( sum[:] ) {
+		t.Errorf( "checksum %s does not match the file contents", csum )
+	}
+	if fi, _ := os.Stat( fname ); fi.Mode().Perm() != 0600 {
+		t.Errorf( "expected mode 0600, got %o", fi.Mode().Perm() )
+	}
+	if o := others( t, dir, "vm1.json" ); len( o ) != 0 {
+		t.Errorf( "files left behind: %v", o )
+	}
+}
+
+/*
+	The new file must replace the old one rather than overwrite it in place; a
+	reader which has the old one open (here a second link) still sees it whole.
+*/
+func TestWriteAtomicReplace( t *testing.T ) {
+	dir := t.TempDir()
+	fname := filepath.Join( dir, "vm1.json" )
+	old := filepath.Join( dir, "old" )
+
+	Write_atomic( fname, []byte( `{ "vfid": 1, "vlans": [ 10, 11, 12 ] }` ), 0644 )
+	if err := os.Link( fname, old ); err != nil {
+		t.Fatalf( "unable to link: %s", err )
+	}
+
+	if _, err := Write_atomic( fname, []byte( `{ "vfid": 2 }` ), 0640 ); err != nil {
+		t.Fatalf( "unexpected error: %s", err )
+	}
+	if got, _ := os.ReadFile( fname ); string( got ) != `{ "vfid": 2 }` {
+		t.Errorf( "file not replaced: %s", got )
+	}
+	if got, _ := os.ReadFile( old ); string( got ) != `{ "vfid": 1, "vlans": [ 10, 11, 12 ] }` {
+		t.Errorf( "old file was changed in place: %s", got )
+	}
+	if fi, _ := os.Stat( fname ); fi.Mode().Perm() != 0640 {
+		t.Errorf( "expected mode 0640 on the replacement, got %o", fi.Mode().Perm() )
+	}
+	if o := others( t, dir, "vm1.json", "old" ); len( o ) != 0 {
+		t.Errorf( "files left behind: %v", o )
+	}
+}
+
+/*
+	When the rename fails (the name is a directory) an error is returned and the
+	temp file is removed.
+*/
+func TestWriteAtomicFail( t *testing.T ) {
+	dir := t.TempDir()
+	fname := filepath.Join( dir, "vm1.json" )
+	if err := os.Mkdir( fname, 0755 ); err != nil {
+		t.Fatalf( "unable to make directory: %s", err )
+	}
+	os.WriteFile( filepath.Join( fname, "keep" ), []byte( "x" ), 0644 )		// not empty, so rename over it must fail
+
+	csum, err := Write_atomic( fname, []byte( `{ "vfid": 1 }` ), 0644 )
+	if err == nil || csum != "" {
+		t.Fatalf( "expected an error and no checksum, got %q %v", csum, err )
+	}
+	if o := others( t, dir, "vm1.json" ); len( o ) != 0 {
+		t.Errorf( "temp file left behind: %v", o )
+	}
+
+	if _, err = Write_atomic( filepath.Join( dir, "nodir", "vm1.json" ), []byte( `{}` ), 0644 ); err == nil {
+		t.Errorf( "expected an error writing into a missing directory" )
+	}
+}
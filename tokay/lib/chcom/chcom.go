@@ -27,9 +27,14 @@ type Request struct {
 	Exch_key string						// the key that requestor expects it's messages to have on the exchange
 	Msg_key	string						// message key that user provides allowing it to disabmiguate responses (we ignore, just pass back)
 	Source	string						// may determine the type of data put on writer channel
+	User	string						// AMQP user id from the message properties (empty if not set by the publisher)
+	Reply_to string						// AMQP reply-to queue; when set the response is sent there rather than with exch_key
+	Corr_id	string						// AMQP correlation id, returned with a reply-to response
 	Jtree	*jsontools.Jtree			// cracked json from request
 	Resp_ch	chan interface{}			// channel for a response
 	Single_use bool;					// set to true if this is a single use channel and writer should close
+	Internal bool						// set when tokay generated the request as a step of a user's request
+	Owner	string						// rid of the parent request holding the target on this step's behalf (empty if none)
 }
 
 /*
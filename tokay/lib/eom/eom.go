@@ -0,0 +1,132 @@
+// vi: sw=4 ts=4:
+/*
+	Mnemonic:	eom.go
+	Abstract:	Reader for the framing VFd uses when writing responses: a message is
+				one or more newline terminated lines followed by the end of message
+				marker (@eom@) on a line by itself.
+
+				The reader enforces a maximum message size. When a message is too
+				large, or a read error leaves a message incomplete, the partial data
+				is dropped and the reader resynchronises on the next marker; each
+				such event is counted. The underlying reader can be replaced (e.g.
+				after the fifo is reopened) without losing the counts.
+
+	Date:		18 October 2026
+*/
+
+package eom
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+)
+
+const (
+	Marker		string = "@eom@"
+	Default_max	int = 1024 * 1024		// default max message size
+)
+
+var (
+	Err_too_big	= errors.New( "message exceeded max size; discarded" )
+)
+
+/*
+	Manages the framing on a stream.
+*/
+type Reader struct {
+	br		*bufio.Reader
+	max		int
+	resyncs	int64						// number of times partial data was dropped
+	dropped	int64						// bytes dropped
+}
+
+/*
+	Create a reader on r which will accept messages of up to max bytes. If max is
+	not positive the default is used.
+*/
+func Mk_reader( r io.Reader, max int ) ( *Reader ) {
+	if max <= 0 {
+		max = Default_max
+	}
+
+	return &Reader {
+		br:		bufio.NewReader( r ),
+		max:	max,
+	}
+}
+
+/*
+	Switch to a new underlying reader. Anything buffered from the old one is lost.
+*/
+func (er *Reader) Reset( r io.Reader ) {
+	er.br.Reset( r )
+}
+
+/*
+	Return the number of resyncs, and bytes dropped because of them, since the
+	reader was created.
+*/
+func (er *Reader) Stats( ) ( resyncs int64, dropped int64 ) {
+	return er.resyncs, er.dropped
+}
+
+/*
+	Returns true if the line is the end of message marker. Trailing white space
+	(including a carriage return) is ignored.
+*/
+func is_marker( line []byte ) ( bool ) {
+	return string( bytes.TrimRight( line, " \t\r\n" ) ) == Marker
+}
+
+/*
+	Read the next message and return it without the marker. The newline at the end
+	of each line is kept.
+
+	Lines are read a buffer at a time so that a long line (or one which never
+	ends) isn't collected before the size is checked. If the message exceeds the
+	max size, the rest of it is read and discarded in chunks and Err_too_big is
+	returned; the next call returns the following message.  If the underlying
+	reader returns an error, any partial message is discarded and the error is
+	returned.
+*/
+func (er *Reader) Next( ) ( msg []byte, err error ) {
+	buf := make( []byte, 0, 4096 )
+	too_big := false
+	bol := true							// the next chunk starts a line; only then can it be the marker
+
+	for {
+		chunk, rerr := er.br.ReadSlice( '\n' )		// chunk is only good until the next read
+		if rerr != nil && rerr != bufio.ErrBufferFull {
+			if ! too_big && ( len( buf ) > 0 || len( chunk ) > 0 ) {		// message torn by the error (a big one was already counted)
+				er.resyncs++
+			}
+			er.dropped += int64( len( buf ) + len( chunk ) )
+			return nil, rerr
+		}
+
+		if bol && rerr == nil && is_marker( chunk ) {
+			if too_big {
+				return nil, Err_too_big
+			}
+			return buf, nil
+		}
+		bol = rerr == nil
+
+		if too_big {
+			er.dropped += int64( len( chunk ) )
+			continue
+		}
+
+		if len( buf ) + len( chunk ) > er.max {
+			too_big = true
+			er.resyncs++
+			er.dropped += int64( len( buf ) + len( chunk ) )
+			buf = buf[:0]
+			continue
+		}
+
+		buf = append( buf, chunk... )
+	}
+}
@@ -0,0 +1,102 @@
+// vi: sw=4 ts=4:
+/*
+	Mnemonic:	eom_test.go
+	Abstract:	Tests for the eom framing reader: normal messages, messages over
+				the max size (including a single line longer than the read buffer),
+				resynchronising afterwards, and messages torn by the end of input.
+
+	Date:		18 October 2026
+*/
+
+package eom
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func expect_msg( t *testing.T, er *Reader, want string ) {
+	t.Helper()
+
+	msg, err := er.Next()
+	if err != nil {
+		t.Fatalf( "expected %q, got error %s", want, err )
+	}
+	if string( msg ) != want {
+		t.Fatalf( "expected %q, got %q", want, msg )
+	}
+}
+
+func TestMessages( t *testing.T ) {
+	er := Mk_reader( strings.NewReader( "one\n@eom@\ntwo\nlines\n@eom@ \r\n@eom@\n" ), 0 )
+
+	expect_msg( t, er, "one\n" )
+	expect_msg( t, er, "two\nlines\n" )
+	expect_msg( t, er, "" )
+	if _, err := er.Next(); err != io.EOF {
+		t.Fatalf( "expected EOF, got %v", err )
+	}
+	if r, d := er.Stats(); r != 0 || d != 0 {
+		t.Errorf( "expected no resyncs, got %d resyncs and %d bytes dropped", r, d )
+	}
+}
+
+/*
+	A message made of many lines which together are too big.
+*/
+func TestOversizeLines( t *testing.T ) {
+	big := strings.Repeat( "0123456789\n", 20 )			// 220 bytes
+	er := Mk_reader( strings.NewReader( "small\n@eom@\n" + big + "@eom@\nafter\n@eom@\n" ), 100 )
+
+	expect_msg( t, er, "small\n" )
+	if _, err := er.Next(); err != Err_too_big {
+		t.Fatalf( "expected Err_too_big, got %v", err )
+	}
+	expect_msg( t, er, "after\n" )
+
+	if r, d := er.Stats(); r != 1 || d != int64( len( big ) ) {
+		t.Errorf( "expected 1 resync and %d bytes dropped, got %d and %d", len( big ), r, d )
+	}
+}
+
+/*
+	A single line much longer than both the max and the bufio buffer must be
+	discarded without being collected, and a marker which is not at the start of
+	a line (here it lands at a buffer boundary) must not end the message.
+*/
+func TestOversizeLine( t *testing.T ) {
+	long := strings.Repeat( "y", 100000 ) + "\n" + strings.Repeat( "x", 4096 ) + Marker + "\n"
+	er := Mk_reader( strings.NewReader( long + "@eom@\nafter\n@eom@\n" ), 1024 )
+
+	if _, err := er.Next(); err != Err_too_big {
+		t.Fatalf( "expected Err_too_big, got %v", err )
+	}
+	expect_msg( t, er, "after\n" )
+
+	if r, d := er.Stats(); r != 1 || d != int64( len( long ) ) {
+		t.Errorf( "expected 1 resync and %d bytes dropped, got %d and %d", len( long ), r, d )
+	}
+}
+
+/*
+	A message cut off by the end of input is dropped and counted; after a reset
+	the reader carries on with the new input and keeps the counts.
+*/
+func TestTorn( t *testing.T ) {
+	er := Mk_reader( strings.NewReader( "ok\n@eom@\npartial\nno end" ), 0 )
+
+	expect_msg( t, er, "ok\n" )
+	if _, err := er.Next(); err != io.EOF {
+		t.Fatalf( "expected EOF, got %v", err )
+	}
+	if r, d := er.Stats(); r != 1 || d != int64( len( "partial\nno end" ) ) {
+		t.Errorf( "expected 1 resync and 14 bytes dropped, got %d and %d", r, d )
+	}
+
+	er.Reset( strings.NewReader( "next\n@eom@\n" ) )
+	expect_msg( t, er, "next\n" )
+	if r, _ := er.Stats(); r != 1 {
+		t.Errorf( "resync count lost on reset: %d", r )
+	}
+}
@@ -0,0 +1,622 @@
+// vi: sw=4 ts=4:
+/*
+	Mnemonic:	fakevfd.go
+	Abstract:	A stand-in for VFd which allows tokay to be exercised without a NIC,
+				DPDK, or VFd itself. It speaks the same protocol as VFd does to tokay:
+				requests arrive on the request fifo as json, each terminated by a
+				blank line, and responses are written to the fifo named by r_fifo
+				in the request followed by the @eom@ marker.  The socket transport
+				(vfdlink) is supported as well, and its connections can be dropped
+				to drive tokay's reconnect.
+
+				A simple model of the VFs is kept in memory: add reads the config
+				file named in the request (and verifies the checksum if given),
+				delete removes it, and show lists PFs and VFs in the format that
+				VFd uses (and vfdshow parses).
+
+				Options allow responses to be delayed, answered with an error, or
+				dropped altogether so that tokay's timeout and unmatched response
+				handling can be driven. A fate function can pick out particular
+				requests to fail, drop, or act on without answering.
+
+	Date:		18 October 2026
+*/
+
+package fakevfd
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/att/vfd.gaol/tokay/lib/eom"
+	"github.com/att/vfd.gaol/tokay/lib/vfdlink"
+)
+
+/*
+	Behaviour knobs.
+*/
+type Options struct {
+	Delay		time.Duration				// wait this long before responding
+	Err_rate	float64						// fraction (0.0-1.0) of requests answered with an error
+	Drop_rate	float64						// fraction of requests never answered
+	Seed		int64						// random seed for error/drop selection; 0 uses the time
+	Pfs			[]string					// pciids of the PFs we claim to have
+	Log			func( string, ...interface{} )	// if not nil, called to report what we are doing
+}
+
+/*
+	What happens to a request; see Set_fate.
+*/
+type Fate int
+
+const (
+	Fate_normal		Fate = iota			// handled as the options say
+	Fate_error							// answered with an error; nothing is done
+	Fate_drop							// never answered; nothing is done
+	Fate_silent							// acted on but never answered, as if the response was lost
+)
+
+/*
+	A configured VF.
+*/
+type Vf struct {
+	Name	string						// config file base name without .json (tokay's target)
+	Pciid	string						`json:"pciid"`
+	Vfid	int							`json:"vfid"`
+	Vlans	[]int						`json:"vlans"`
+	Macs	[]string					`json:"macs"`
+	Config	json.RawMessage
+	pkts	int64						// fake counter; bumped on each show
+}
+
+/*
+	A request as VFd receives it.
+*/
+type Request struct {
+	Action	string		`json:"action"`
+	Params	struct {
+		Filename	string	`json:"filename"`
+		Checksum	string	`json:"checksum"`
+		Resource	string	`json:"resource"`
+		R_fifo		string	`json:"r_fifo"`
+		Vfd_rid		string	`json:"vfd_rid"`
+	}	`json:"params"`
+}
+
+/*
+	The fake daemon.
+*/
+type Vfd struct {
+	mu		sync.Mutex
+	opts	Options
+	rnd		*rand.Rand
+	vfs		map[string]*Vf				// keyed by name
+	fifos	map[string]*os.File			// response fifos we've opened, by name
+	conns	map[net.Conn]bool			// socket connections being served
+	reqs	[]Request					// every request received, in order
+	fate	func( *Request ) ( Fate )	// if set, decides what happens to each request
+
+	received	int64					// counts of what we've done
+	answered	int64
+	errored		int64
+	dropped		int64
+}
+
+/*
+	Create a fake VFd. Opts may be nil.
+*/
+func Mk_vfd( opts *Options ) ( *Vfd ) {
+	v := &Vfd {
+		vfs:	make( map[string]*Vf ),
+		fifos:	make( map[string]*os.File ),
+		conns:	make( map[net.Conn]bool ),
+	}
+
+	if opts != nil {
+		v.opts = *opts
+	}
+	seed := v.opts.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	v.rnd = rand.New( rand.NewSource( seed ) )
+
+	return v
+}
+
+func (v *Vfd) log( format string, args ...interface{} ) {
+	if v.opts.Log != nil {
+		v.opts.Log( format, args... )
+	}
+}
+
+/*
+	Change the drop and error rates while running.
+*/
+func (v *Vfd) Set_drop_rate( rate float64 ) {
+	v.mu.Lock()
+	v.opts.Drop_rate = rate
+	v.mu.Unlock()
+}
+
+func (v *Vfd) Set_err_rate( rate float64 ) {
+	v.mu.Lock()
+	v.opts.Err_rate = rate
+	v.mu.Unlock()
+}
+
+/*
+	Set a function which decides the fate of each request, so that particular
+	requests (e.g. the add for one target) can be made to fail. Requests for
+	which it returns Fate_normal, or all requests when f is nil, are subject to
+	the error and drop rates as usual.
+*/
+func (v *Vfd) Set_fate( f func( *Request ) ( Fate ) ) {
+	v.mu.Lock()
+	v.fate = f
+	v.mu.Unlock()
+}
+
+/*
+	Change the response delay while running.
+*/
+func (v *Vfd) Set_delay( d time.Duration ) {
+	v.mu.Lock()
+	v.opts.Delay = d
+	v.mu.Unlock()
+}
+
+/*
+	Return a copy of the VF configured with name; ok is false if not there.
+*/
+func (v *Vfd) Get_vf( name string ) ( vf Vf, ok bool ) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if vp := v.vfs[name]; vp != nil {
+		return *vp, true
+	}
+	return vf, false
+}
+
+/*
+	Return the number of requests received, answered, failed deliberately and dropped
+	deliberately.
+*/
+func (v *Vfd) Counts( ) ( received int64, answered int64, errored int64, dropped int64 ) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	return v.received, v.answered, v.errored, v.dropped
+}
+
+/*
+	Return a copy of the requests received so far, in the order they arrived.
+*/
+func (v *Vfd) Requests( ) ( []Request ) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	return append( []Request( nil ), v.reqs... )
+}
+
+/*
+	Return the number of configured VFs.
+*/
+func (v *Vfd) Nvfs( ) ( int ) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	return len( v.vfs )
+}
+
+/*
+	Remove the named VF without a request, as if it was deleted behind tokay's
+	back. Returns false if it wasn't configured.
+*/
+func (v *Vfd) Remove_vf( name string ) ( bool ) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	_, there := v.vfs[name]
+	delete( v.vfs, name )
+	return there
+}
+
+/*
+	Build a response json string. Msg may be a string or a list of lines.
+*/
+func mk_response( state string, rid string, msg interface{} ) ( []byte ) {
+	jmsg, _ := json.Marshal( msg )
+	return []byte( fmt.Sprintf( `{ "action": "response", "state": %q, "vfd_rid": %q, "msg": %s }`, state, rid, jmsg ) )
+}
+
+/*
+	Add, or with replace set update, the VF in the named config file.
+*/
+func (v *Vfd) add( fname string, csum string, replace bool ) ( string, error ) {
+	buf, err := os.ReadFile( fname )
+	if err != nil {
+		return "", err
+	}
+
+	if csum != "" {
+		sum := sha256.Sum256( buf )
+		if csum != "sha256:" + hex.EncodeToString( sum[:] ) {
+			return "", fmt.Errorf( "checksum mismatch on config file: %s", fname )
+		}
+	}
+
+	vf := &Vf { Name: strings.TrimSuffix( filepath.Base( fname ), ".json" ), Config: json.RawMessage( buf ) }
+	if err = json.Unmarshal( buf, vf ); err != nil {
+		return "", fmt.Errorf( "config is not valid json: %s", err )
+	}
+	if vf.Pciid == "" {
+		return "", fmt.Errorf( "config has no pciid" )
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if _, there := v.vfs[vf.Name]; there && ! replace {
+		return "", fmt.Errorf( "vf already configured: %s", vf.Name )
+	}
+	if ! replace {
+		for _, o := range v.vfs {
+			if o.Vfid == vf.Vfid && o.Pciid == vf.Pciid {
+				return "", fmt.Errorf( "pf %s vf %d is in use by %s", vf.Pciid, vf.Vfid, o.Name )
+			}
+		}
+	}
+
+	v.vfs[vf.Name] = vf
+	return vf.Name, nil
+}
+
+/*
+	Generate show output. What is all, pfs, or the name of a configured VF.
+*/
+func (v *Vfd) show( what string ) ( lines []string, err error ) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	pfs := make( map[string]bool )
+	for _, p := range v.opts.Pfs {
+		pfs[p] = true
+	}
+	vlist := make( []*Vf, 0, len( v.vfs ) )
+	for _, vf := range v.vfs {
+		pfs[vf.Pciid] = true
+		vlist = append( vlist, vf )
+	}
+	plist := make( []string, 0, len( pfs ) )
+	for p := range pfs {
+		plist = append( plist, p )
+	}
+	sort.Strings( plist )
+	sort.Slice( vlist, func( i, j int ) bool {
+		if vlist[i].Pciid != vlist[j].Pciid {
+			return vlist[i].Pciid < vlist[j].Pciid
+		}
+		return vlist[i].Vfid < vlist[j].Vfid
+	} )
+
+	lines = append( lines, "PF/VF  ID    PCIID           Link      Speed     Duplex    RX pkts   RX bytes  RX errors RX dropped   TX pkts   TX bytes  TX errors  Spoofed" )
+	vf_line := func( vf *Vf ) {
+		vf.pkts += 10
+		lines = append( lines, fmt.Sprintf( "vf     %-4d  %-14s  UP        10000     FD     %8d %10d %10d %10d %8d %10d %10d %8d", vf.Vfid, vf.Pciid, vf.pkts, vf.pkts * 64, 0, 0, vf.pkts, vf.pkts * 64, 0, 0 ) )
+		lines = append( lines, fmt.Sprintf( "vlans: %s", strings.Trim( fmt.Sprint( vf.Vlans ), "[]" ) ) )
+		lines = append( lines, fmt.Sprintf( "macs: %s", strings.Join( vf.Macs, " " ) ) )
+	}
+
+	switch what {
+		case "", "all", "pfs":
+			for i, p := range plist {
+				lines = append( lines, fmt.Sprintf( "pf     %-4d  %-14s  UP        10000     FD     %8d %10d %10d %10d %8d %10d %10d %8d", i, p, 0, 0, 0, 0, 0, 0, 0, 0 ) )
+				if what == "pfs" {
+					continue
+				}
+				for _, vf := range vlist {
+					if vf.Pciid == p {
+						vf_line( vf )
+					}
+				}
+			}
+
+		default:
+			vf := v.vfs[what]
+			if vf == nil {
+				return nil, fmt.Errorf( "unknown vf: %s", what )
+			}
+			vf_line( vf )
+	}
+
+	return lines, nil
+}
+
+/*
+	Process one request and return the response. If the request is to be dropped
+	(drop rate or fate) nil is returned. The delay option is applied here.
+*/
+func (v *Vfd) Handle( req *Request ) ( resp []byte ) {
+	v.mu.Lock()
+	v.received++
+	v.reqs = append( v.reqs, *req )
+	delay := v.opts.Delay
+	fate := Fate_normal
+	if v.fate != nil {
+		fate = v.fate( req )
+	}
+	drop := fate == Fate_drop || ( fate == Fate_normal && v.opts.Drop_rate > 0 && v.rnd.Float64() < v.opts.Drop_rate )
+	fail := fate == Fate_error || ( fate == Fate_normal && v.opts.Err_rate > 0 && v.rnd.Float64() < v.opts.Err_rate )
+	if drop {
+		v.dropped++
+	}
+	v.mu.Unlock()
+
+	if drop {
+		v.log( "dropping request: action=%s rid=%s", req.Action, req.Params.Vfd_rid )
+		return nil
+	}
+
+	if delay > 0 {
+		time.Sleep( delay )
+	}
+
+	rid := req.Params.Vfd_rid
+	if fail {
+		v.mu.Lock()
+		v.errored++
+		v.mu.Unlock()
+		v.log( "failing request: action=%s rid=%s", req.Action, rid )
+		return mk_response( "ERROR", rid, "simulated failure" )
+	}
+
+	v.log( "request: action=%s rid=%s", req.Action, rid )
+	resp = v.act( req )
+	if fate == Fate_silent {
+		v.mu.Lock()
+		v.dropped++
+		v.mu.Unlock()
+		v.log( "response not sent: action=%s rid=%s", req.Action, rid )
+		return nil
+	}
+
+	return resp
+}
+
+/*
+	Carry out the request and return the response.
+*/
+func (v *Vfd) act( req *Request ) ( []byte ) {
+	rid := req.Params.Vfd_rid
+	switch req.Action {
+		case "add", "update":
+			name, err := v.add( req.Params.Filename, req.Params.Checksum, req.Action == "update" )
+			if err != nil {
+				return mk_response( "ERROR", rid, fmt.Sprintf( "%s failed: %s", req.Action, err ) )
+			}
+			return mk_response( "OK", rid, fmt.Sprintf( "vf %s: %s", req.Action, name ) )
+
+		case "delete":
+			name := strings.TrimSuffix( filepath.Base( req.Params.Filename ), ".json" )
+			v.mu.Lock()
+			_, there := v.vfs[name]
+			delete( v.vfs, name )
+			v.mu.Unlock()
+			if ! there {
+				return mk_response( "ERROR", rid, "delete failed: unknown vf: " + name )
+			}
+			return mk_response( "OK", rid, "vf deleted: " + name )
+
+		case "show":
+			lines, err := v.show( req.Params.Resource )
+			if err != nil {
+				return mk_response( "ERROR", rid, err.Error() )
+			}
+			return mk_response( "OK", rid, lines )
+
+		case "ping":
+			return mk_response( "OK", rid, "pong: fake VFd" )
+
+		case "dump", "verbose", "mirror":
+			return mk_response( "OK", rid, req.Action + " accepted" )
+	}
+
+	return mk_response( "ERROR", rid, "unrecognised action: " + req.Action )
+}
+
+// ------------------- fifo transport ---------------------------------------------
+
+/*
+	Write a response to the named fifo, followed by the end of message marker.
+	Fifos are opened read/write (so we don't block if tokay isn't there yet) and
+	kept open.
+*/
+func (v *Vfd) respond_fifo( fname string, resp []byte ) ( err error ) {
+	v.mu.Lock()
+	f := v.fifos[fname]
+	if f == nil {
+		if f, err = vfdlink.Mk_fifo( fname ); err != nil {
+			v.mu.Unlock()
+			return err
+		}
+		v.fifos[fname] = f
+	}
+	v.mu.Unlock()
+
+	_, err = f.Write( append( append( resp, '\n' ), []byte( eom.Marker + "\n" )... ) )
+	return err
+}
+
+/*
+	Read requests from r. Each is json terminated by a blank line. Returns when
+	r reports an error (io.EOF if it was closed).
+*/
+func (v *Vfd) Serve_reader( r io.Reader ) ( error ) {
+	br := bufio.NewReader( r )
+	buf := ""
+
+	for {
+		line, err := br.ReadString( '\n' )
+		if err != nil {
+			return err
+		}
+
+		if strings.TrimSpace( line ) != "" {
+			buf += line
+			continue
+		}
+		if buf == "" {
+			continue
+		}
+
+		req := &Request{}
+		jerr := json.Unmarshal( []byte( buf ), req )
+		buf = ""
+		if jerr != nil {
+			v.log( "unparsable request dropped: %s", jerr )
+			continue
+		}
+
+		go func() {												// concurrent so that a delay doesn't hold up the next request
+			if resp := v.Handle( req ); resp != nil {
+				if err := v.respond_fifo( req.Params.R_fifo, resp ); err != nil {
+					v.log( "unable to write response to %s: %s", req.Params.R_fifo, err )
+					return
+				}
+				v.mu.Lock()
+				v.answered++
+				v.mu.Unlock()
+			}
+		}()
+	}
+}
+
+/*
+	Create the request fifo (if needed) and serve requests from it. Blocks until
+	the fifo is closed or a read fails.
+*/
+func (v *Vfd) Serve_fifo( req_fifo string ) ( error ) {
+	f, err := os.OpenFile( req_fifo, syscall.O_RDWR, 0664 )
+	if err != nil {
+		if f, err = vfdlink.Mk_fifo( req_fifo ); err != nil {
+			return err
+		}
+	}
+	defer f.Close()
+
+	v.log( "listening on request fifo: %s", req_fifo )
+	return v.Serve_reader( f )
+}
+
+// ------------------- socket transport -------------------------------------------
+
+/*
+	Serve requests on an established socket link; responses go back on the same
+	link and r_fifo is ignored. Returns when the link fails.
+*/
+func (v *Vfd) Serve_link( l *vfdlink.Sock_link ) ( error ) {
+	var wmu sync.Mutex
+
+	for {
+		msg, err := l.Recv()
+		if err != nil {
+			if err == eom.Err_too_big {
+				continue
+			}
+			return err
+		}
+
+		req := &Request{}
+		if err = json.Unmarshal( msg, req ); err != nil {
+			v.log( "unparsable request dropped: %s", err )
+			continue
+		}
+
+		go func() {
+			if resp := v.Handle( req ); resp != nil {
+				wmu.Lock()
+				err := l.Send( resp )
+				wmu.Unlock()
+				if err != nil {
+					v.log( "unable to send response: %s", err )
+					return
+				}
+				v.mu.Lock()
+				v.answered++
+				v.mu.Unlock()
+			}
+		}()
+	}
+}
+
+/*
+	Listen on the socket path and serve each connection. Blocks until the listener
+	fails.
+*/
+func (v *Vfd) Serve_socket( transport string, path string ) ( error ) {
+	ln, err := vfdlink.Listen( transport, path )
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+
+	v.log( "listening on %s socket: %s", transport, path )
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+
+		v.mu.Lock()
+		v.conns[conn] = true
+		v.mu.Unlock()
+		go func() {
+			v.Serve_link( vfdlink.Mk_conn_link( conn, 0 ) )
+			conn.Close()
+			v.mu.Lock()
+			delete( v.conns, conn )
+			v.mu.Unlock()
+		}()
+	}
+}
+
+/*
+	Return the number of socket connections being served.
+*/
+func (v *Vfd) Nconns( ) ( int ) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	return len( v.conns )
+}
+
+/*
+	Close every socket connection, as VFd would if it was restarted; the listener
+	stays up so that tokay can reconnect. Returns the number closed.
+*/
+func (v *Vfd) Drop_conns( ) ( int ) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	n := len( v.conns )
+	for conn := range v.conns {
+		conn.Close()
+		delete( v.conns, conn )
+	}
+	return n
+}
@@ -0,0 +1,1146 @@
+// vi: sw=4 ts=4:
+/*
+	Mnemonic:	harness.go
+	Abstract:	Drives a running tokay pipeline end to end through the in-memory
+				broker: each case publishes a request on the request exchange, as a
+				user would, and waits for the response (matched on msg_key) on the
+				response exchange. The pipeline is expected to be wired to a fake
+				VFd (lib/fakevfd) so that nothing but this process is needed.
+
+				Std_cases is the standard set: round trips for each of the basic
+				actions, requests for a busy target (queued or rejected), rate
+				limiting (when the pipeline has a sender limit), batches,
+				transactions which must be rolled back, updates, the config
+				store, targets which try to leave the config directory,
+				reconciliation (reporting and converging), a VFd timeout, and
+				malformed json (which should be ignored without upsetting what
+				follows).
+
+				Reconnect_cases are for a pipeline connected to the fake over a
+				socket: the connection is dropped and tokay must fail what it can't
+				send and reconnect.
+
+				Cases marked Rpc are published as an AMQP RPC client would, with a
+				reply-to queue and correlation id; the response must come back on
+				the default exchange to that queue with the same correlation id.
+
+	Date:		18 October 2026
+*/
+
+package harness
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/streadway/amqp"
+
+	"github.com/att/vfd.gaol/tokay/lib/broker"
+	"github.com/att/vfd.gaol/tokay/lib/fakevfd"
+)
+
+const (
+	Default_wait	time.Duration = 5 * time.Second
+	exch_key		string = "tokay_harness"		// key we ask tokay to respond with
+	reply_to		string = "tokay_harness_reply"	// queue rpc cases ask tokay to reply to
+)
+
+/*
+	A test case. Req is the request json; msg_key and exch_key are added unless Raw
+	is set, in which case it is published as is. State is the state expected in the
+	response; if empty, no response is expected within Wait.
+*/
+type Case struct {
+	Name	string
+	Req		string
+	Raw		bool
+	Rpc		bool									// publish with reply-to and correlation id
+	State	string
+	Msg_has	string									// if set, the msg field must contain this
+	Check	func( resp map[string]interface{} ) ( error )		// additional checks on the response
+	Wait	time.Duration							// how long to wait (Default_wait if 0)
+	Before	func( )									// run before/after the request (e.g. to change the fake's behaviour)
+	After	func( )
+	Also	[]Case									// published straight after Req without waiting; each response is checked as for Req
+	In_order	bool								// responses to Req and Also must arrive in the order published
+}
+
+/*
+	What the standard cases need to know about the pipeline under test. Fake is the
+	fake VFd tokay is connected to, Conf_dir is tokay's config directory, and Timeout
+	is the time tokay waits for VFd. The remaining fields are the settings tokay was
+	started with; the cases expect the behaviour each selects.
+*/
+type Env struct {
+	Fake		*fakevfd.Vfd
+	Conf_dir	string
+	Timeout		time.Duration
+	Reject_conflicts	bool					// conflict_mode is reject rather than queue
+	Sender_burst		int						// burst allowed by the sender rate limit; 0 if not limited
+	Vfd_update			bool					// update_mode is vfd (VFd update) rather than readd
+}
+
+type Result struct {
+	Name	string
+	Ok		bool
+	Why		string									// reason for failure
+	Elapsed	time.Duration
+}
+
+/*
+	The exchanges and key that tokay is using.
+*/
+type Harness struct {
+	b			*broker.Mem
+	req_exch	string
+	req_key		string
+	resp_ch		chan amqp.Delivery
+	count		int
+}
+
+/*
+	Create a harness which publishes requests to req_exch with req_key and listens
+	for responses on resp_exch.
+*/
+func Mk_harness( b *broker.Mem, req_exch string, req_key string, resp_exch string ) ( *Harness ) {
+	h := &Harness {
+		b:			b,
+		req_exch:	req_exch,
+		req_key:	req_key,
+		resp_ch:	make( chan amqp.Delivery, 128 ),
+	}
+
+	for _, sub := range []struct {
+		exch	string
+		key		string
+	} {
+		{ resp_exch, exch_key },
+		{ "", reply_to },										// the default exchange, where rpc replies go
+	} {
+		dch := b.Subscribe( sub.exch, "direct", sub.key )
+		go func() {
+			for d := range dch {
+				h.resp_ch <- d
+			}
+		}()
+	}
+
+	return h
+}
+
+/*
+	Return the msg field as a string; VFd may send a list of strings.
+*/
+func msg_string( resp map[string]interface{} ) ( string ) {
+	switch m := resp["msg"].(type) {
+		case string:
+			return m
+
+		case []interface{}:
+			s := make( []string, 0, len( m ) )
+			for _, v := range m {
+				s = append( s, fmt.Sprintf( "%v", v ) )
+			}
+			return strings.Join( s, "\n" )
+	}
+
+	return ""
+}
+
+/*
+	Check a response against the case; returns the reason it doesn't match, or the
+	empty string if it does.
+*/
+func check( c *Case, d amqp.Delivery, resp map[string]interface{}, corr_id string ) ( string ) {
+	if c.State == "" {
+		return fmt.Sprintf( "expected no response, got: %s", d.Body )
+	}
+	if c.Rpc && ( d.Exchange != "" || d.RoutingKey != reply_to || d.CorrelationId != corr_id ) {
+		return fmt.Sprintf( "expected reply on the default exchange to %s with correlation id %s, got exchange %q key %s correlation id %q",
+			reply_to, corr_id, d.Exchange, d.RoutingKey, d.CorrelationId )
+	}
+	if ! c.Rpc && d.Exchange == "" {
+		return fmt.Sprintf( "response sent to reply queue %s for a request without reply-to", d.RoutingKey )
+	}
+	if resp["state"] != c.State {
+		return fmt.Sprintf( "expected state %s, got %v: %s", c.State, resp["state"], d.Body )
+	}
+	if c.Msg_has != "" && ! strings.Contains( msg_string( resp ), c.Msg_has ) {
+		return fmt.Sprintf( "msg does not contain %q: %s", c.Msg_has, d.Body )
+	}
+	if c.Check != nil {
+		if err := c.Check( resp ); err != nil {
+			return err.Error()
+		}
+	}
+
+	return ""
+}
+
+/*
+	Publish the request for a case. Returns the msg_key and correlation id used, or
+	an error if it couldn't be sent.
+*/
+func (h *Harness) publish( c *Case ) ( msg_key string, corr_id string, err error ) {
+	h.count++
+	msg_key = fmt.Sprintf( "harness-%d", h.count )
+	body := []byte( c.Req )
+	if ! c.Raw {
+		req := make( map[string]interface{} )
+		if err := json.Unmarshal( body, &req ); err != nil {
+			return "", "", fmt.Errorf( "bad request json in case: %s", err )
+		}
+		req["msg_key"] = msg_key
+		req["exch_key"] = exch_key
+		if _, given := req["sender"]; ! given {
+			req["sender"] = msg_key						// own sender so that a sender rate limit only touches cases which test it
+		}
+		body, _ = json.Marshal( req )
+	}
+
+	sent := 0
+	if c.Rpc {
+		corr_id = "corr-" + msg_key
+		sent = h.b.Publish_rpc( h.req_exch, h.req_key, body, "harness", corr_id, reply_to )
+	} else {
+		sent = h.b.Publish( h.req_exch, h.req_key, body, "harness", "" )
+	}
+	if sent == 0 {
+		return "", "", fmt.Errorf( "request not delivered: tokay isn't listening on %s", h.req_exch )
+	}
+
+	return msg_key, corr_id, nil
+}
+
+/*
+	Run one case: the request and any in Also are published, and then we wait for
+	their responses.
+*/
+func (h *Harness) run( c *Case ) ( r Result ) {
+	r.Name = c.Name
+	start := time.Now()
+	defer func() { r.Elapsed = time.Since( start ) }()
+
+	wait := c.Wait
+	if wait <= 0 {
+		wait = Default_wait
+	}
+
+	if c.Before != nil {
+		c.Before()
+	}
+	if c.After != nil {
+		defer c.After()
+	}
+
+	all := []*Case { c }
+	for i := range c.Also {
+		all = append( all, &c.Also[i] )
+	}
+
+	type pending struct {
+		c		*Case
+		idx		int
+		corr_id	string
+	}
+	waiting := make( map[string]*pending, len( all ) )
+	expected := 0												// number of responses we expect
+	for i, ac := range all {
+		msg_key, corr_id, err := h.publish( ac )
+		if err != nil {
+			r.Why = err.Error()
+			return r
+		}
+		waiting[msg_key] = &pending { ac, i, corr_id }
+		if ac.State != "" {
+			expected++
+		}
+	}
+
+	timer := time.NewTimer( wait )
+	defer timer.Stop()
+	last := -1													// index of the last response received
+	for expected > 0 || len( waiting ) > 0 {
+		select {
+			case d := <- h.resp_ch:
+				resp := make( map[string]interface{} )
+				if err := json.Unmarshal( d.Body, &resp ); err != nil {
+					r.Why = fmt.Sprintf( "response is not valid json: %s: %s", err, d.Body )
+					return r
+				}
+				msg_key, _ := resp["msg_key"].( string )
+				p := waiting[msg_key]
+				if p == nil {
+					continue							// left over from an earlier case
+				}
+				delete( waiting, msg_key )
+
+				why := check( p.c, d, resp, p.corr_id )
+				if why == "" && c.In_order && p.idx < last {
+					why = "response arrived out of order"
+				}
+				if why != "" {
+					if p.idx > 0 {
+						why = fmt.Sprintf( "request %d: %s", p.idx, why )
+					}
+					r.Why = why
+					return r
+				}
+				last = p.idx
+				expected--
+
+			case <- timer.C:
+				if expected > 0 {
+					r.Why = fmt.Sprintf( "no response within %s", wait )
+					return r
+				}
+				r.Ok = true
+				return r
+		}
+	}
+
+	r.Ok = true
+	return r
+}
+
+/*
+	Run the cases in order and return the results.
+*/
+func (h *Harness) Run( cases []Case ) ( results []Result ) {
+	for i := range cases {
+		results = append( results, h.run( &cases[i] ) )
+	}
+
+	return results
+}
+
+/*
+	Returns a check which ensures the parsed show output lists the VF.
+*/
+func has_vf( pciid string, vfid int ) ( func( map[string]interface{} ) error ) {
+	return func( resp map[string]interface{} ) ( error ) {
+		var parsed struct {
+			Vfs	[]struct {
+				Pf		string	`json:"pf"`
+				Vfid	int		`json:"vfid"`
+			}	`json:"vfs"`
+		}
+
+		jp, _ := json.Marshal( resp["parsed"] )
+		if json.Unmarshal( jp, &parsed ) != nil {
+			return fmt.Errorf( "response has no usable parsed field" )
+		}
+		for _, v := range parsed.Vfs {
+			if v.Pf == pciid && v.Vfid == vfid {
+				return nil
+			}
+		}
+		return fmt.Errorf( "vf %s/%d not in parsed show output: %s", pciid, vfid, jp )
+	}
+}
+
+/*
+	Record the number of requests the fake has received so that a check made by
+	received can ignore those which came before.
+*/
+func mark( fake *fakevfd.Vfd, m *int ) ( func( ) ) {
+	return func( ) {
+		*m = len( fake.Requests() )
+	}
+}
+
+/*
+	Returns a check which ensures that the requests the fake received for the
+	targets named in want, since the mark, are exactly those in want and in the
+	same order. Each is "<action> <target>".
+*/
+func received( fake *fakevfd.Vfd, m *int, want ...string ) ( func( map[string]interface{} ) error ) {
+	return func( resp map[string]interface{} ) ( error ) {
+		targets := make( map[string]bool )
+		for _, w := range want {
+			if f := strings.Fields( w ); len( f ) > 1 {
+				targets[f[1]] = true
+			}
+		}
+
+		got := make( []string, 0, len( want ) )
+		for _, req := range fake.Requests()[*m:] {
+			target := strings.TrimSuffix( filepath.Base( req.Params.Filename ), ".json" )
+			if req.Params.Filename != "" && targets[target] {
+				got = append( got, req.Action + " " + target )
+			}
+		}
+
+		if strings.Join( got, ", " ) != strings.Join( want, ", " ) {
+			return fmt.Errorf( "expected VFd to receive [%s], got [%s]", strings.Join( want, ", " ), strings.Join( got, ", " ) )
+		}
+		return nil
+	}
+}
+
+/*
+	Returns a check which ensures that each add or update the fake received for
+	target since the mark carried the checksum of the config file tokay wrote.
+*/
+func checksum_sent( env *Env, m *int, target string ) ( func( map[string]interface{} ) error ) {
+	return func( resp map[string]interface{} ) ( error ) {
+		buf, err := os.ReadFile( filepath.Join( env.Conf_dir, target + ".json" ) )
+		if err != nil {
+			return fmt.Errorf( "config file not in the config directory: %s", err )
+		}
+		sum := sha256.Sum256( buf )
+		want := "sha256:" + hex.EncodeToString( sum[:] )
+
+		n := 0
+		for _, req := range env.Fake.Requests()[*m:] {
+			if ( req.Action == "add" || req.Action == "update" ) && filepath.Base( req.Params.Filename ) == target + ".json" {
+				if req.Params.Checksum != want {
+					return fmt.Errorf( "%s request had checksum %q, expected %s", req.Action, req.Params.Checksum, want )
+				}
+				n++
+			}
+		}
+		if n == 0 {
+			return fmt.Errorf( "VFd received no add or update for %s", target )
+		}
+		return nil
+	}
+}
+
+/*
+	Slow the fake down so that a request is still in flight when the next arrives.
+*/
+func slow( env *Env, m *int ) ( func( ) ) {
+	return func( ) {
+		mark( env.Fake, m )()
+		env.Fake.Set_delay( 500 * time.Millisecond )
+	}
+}
+
+/*
+	Cases which send an add and a delete for the same target back to back. When
+	conflicts are queued the delete waits for the add; when they are rejected the
+	delete gets a CONFLICT response straight away.
+*/
+func conflict_cases( env *Env ) ( []Case ) {
+	var m int
+	add := `{ "action": "add", "target": "harness_q1", "req_data": { "pciid": "0000:01:00.0", "vfid": 5 } }`
+	del := `{ "action": "delete", "target": "harness_q1" }`
+	fast := func( ) { env.Fake.Set_delay( 0 ) }
+
+	if ! env.Reject_conflicts {
+		return []Case {
+			{ Name: "add and delete for a busy target are queued", Req: add, State: "OK", Before: slow( env, &m ), After: fast, In_order: true,
+				Also: []Case { { Req: del, State: "OK", Check: received( env.Fake, &m, "add harness_q1", "delete harness_q1" ) } } },
+		}
+	}
+
+	return []Case {
+		{ Name: "delete for a busy target is rejected", Req: add, State: "OK", Before: slow( env, &m ), After: fast,
+			Check: received( env.Fake, &m, "add harness_q1" ),
+			Also: []Case { { Req: del, State: "CONFLICT", Msg_has: "harness_q1" } } },
+		{ Name: "delete after conflict", Req: del, State: "OK" },
+		{ Name: "transaction with a busy target is rejected", Req: add, State: "OK", Before: slow( env, &m ), After: fast,
+			Check: all( received( env.Fake, &m, "add harness_q1" ), no_vfs( env.Fake, "harness_q0" ) ),
+			Also: []Case { { Req: `{ "action": "transaction", "req_data": [ { "target": "harness_q0", "req_data": { "pciid": "0000:01:00.0", "vfid": 9 } },
+				{ "target": "harness_q1", "req_data": { "pciid": "0000:01:00.0", "vfid": 5 } } ] }`, State: "CONFLICT", Msg_has: "harness_q1" } } },
+		{ Name: "delete after transaction conflict", Req: del, State: "OK" },
+	}
+}
+
+/*
+	When a sender limit is set, a burst of pings from one sender is sent together
+	with a ping from another. The one over the limit is throttled straight away
+	(while the fake holds the others), and the other sender is unaffected.
+*/
+func throttle_cases( env *Env ) ( []Case ) {
+	if env.Sender_burst <= 0 {
+		return nil
+	}
+
+	var start time.Time
+	ping := func( sender string, state string ) ( Case ) {
+		return Case { Req: fmt.Sprintf( `{ "action": "ping", "sender": %q }`, sender ), State: state }
+	}
+	c := ping( "harness_flood", "OK" )
+	c.Name = "sender over its rate limit is throttled"
+	c.Before = func( ) {
+		start = time.Now()
+		env.Fake.Set_delay( time.Second )
+	}
+	c.After = func( ) { env.Fake.Set_delay( 0 ) }
+	for i := 1; i < env.Sender_burst; i++ {
+		c.Also = append( c.Also, ping( "harness_flood", "OK" ) )
+	}
+	over := ping( "harness_flood", "THROTTLED" )
+	over.Msg_has = "sender harness_flood"
+	over.Check = func( map[string]interface{} ) ( error ) {
+		if e := time.Since( start ); e >= time.Second {
+			return fmt.Errorf( "throttled response took %s; it should not wait for VFd", e )
+		}
+		return nil
+	}
+	c.Also = append( c.Also, over, ping( "harness_other", "OK" ) )
+
+	return []Case { c }
+}
+
+/*
+	Returns a check which ensures data.results in a batch response has an entry for
+	each of want, in order. Each is a state, optionally followed by text which must
+	be in the item's response msg.
+*/
+func batch_results( want ...string ) ( func( map[string]interface{} ) error ) {
+	return func( resp map[string]interface{} ) ( error ) {
+		var data struct {
+			Results	[]struct {
+				Index		int						`json:"index"`
+				State		string					`json:"state"`
+				Response	map[string]interface{}	`json:"response"`
+			}	`json:"results"`
+		}
+
+		jd, _ := json.Marshal( resp["data"] )
+		if json.Unmarshal( jd, &data ) != nil {
+			return fmt.Errorf( "response has no usable results: %s", jd )
+		}
+		if len( data.Results ) != len( want ) {
+			return fmt.Errorf( "expected %d results, got %d: %s", len( want ), len( data.Results ), jd )
+		}
+		for i, w := range want {
+			r := data.Results[i]
+			state, text := w, ""
+			if f := strings.SplitN( w, " ", 2 ); len( f ) > 1 {
+				state, text = f[0], f[1]
+			}
+			if r.Index != i || r.State != state || ! strings.Contains( msg_string( r.Response ), text ) {
+				return fmt.Errorf( "result %d: expected index %d state %s msg with %q, got: %s", i, i, state, text, jd )
+			}
+		}
+		return nil
+	}
+}
+
+/*
+	Batch requests: a mix of actions, a failure with and without stop_on_error,
+	and items which are not usable.
+*/
+func batch_cases( env *Env ) ( []Case ) {
+	var m int
+
+	return []Case {
+		{ Name: "batch add, show and delete", State: "OK", Msg_has: "3 of 3", Before: mark( env.Fake, &m ),
+			Req: `{ "action": "batch", "req_data": [
+				{ "action": "add", "target": "harness_b1", "req_data": { "pciid": "0000:01:00.0", "vfid": 6 } },
+				{ "action": "show", "target": "harness_b1" },
+				{ "action": "delete", "target": "harness_b1" } ] }`,
+			Check: all( batch_results( "OK", "OK", "OK" ), received( env.Fake, &m, "add harness_b1", "delete harness_b1" ) ) },
+		{ Name: "batch continues after an error", State: "ERROR", Msg_has: "2 of 3",
+			Req: `{ "action": "batch", "req_data": [
+				{ "action": "delete", "target": "harness_b9" },
+				{ "action": "add", "target": "harness_b2", "req_data": { "pciid": "0000:01:00.0", "vfid": 7 } },
+				{ "action": "delete", "target": "harness_b2" } ] }`,
+			Check: batch_results( "ERROR unknown vf", "OK", "OK" ) },
+		{ Name: "batch stops at the first error", State: "ERROR", Msg_has: "0 of 2", Before: mark( env.Fake, &m ),
+			Req: `{ "action": "batch", "stop_on_error": true, "req_data": [
+				{ "action": "delete", "target": "harness_b9" },
+				{ "action": "add", "target": "harness_b3", "req_data": { "pciid": "0000:01:00.0", "vfid": 8 } } ] }`,
+			Check: all( batch_results( "ERROR" ), received( env.Fake, &m, "delete harness_b9" ) ) },
+		{ Name: "batch with unusable items", State: "ERROR", Msg_has: "1 of 4",
+			Req: `{ "action": "batch", "req_data": [ "not a request", { "target": "harness_b4" }, { "action": "mirror", "req_data": "0000:01:00.0 1 in 2" }, { "action": "show", "target": "all" } ] }`,
+			Check: batch_results( "ERROR not valid json", "ERROR no action", "ERROR not allowed in a batch", "OK" ) },
+		{ Name: "batch without a list", Req: `{ "action": "batch", "req_data": { "action": "show" } }`, State: "ERROR", Msg_has: "not an array" },
+	}
+}
+
+/*
+	Unpack the data field of a response into v.
+*/
+func get_data( resp map[string]interface{}, v interface{} ) ( error ) {
+	jd, _ := json.Marshal( resp["data"] )
+	if err := json.Unmarshal( jd, v ); err != nil {
+		return fmt.Errorf( "response data is not usable: %s: %s", err, jd )
+	}
+	return nil
+}
+
+/*
+	Returns a check of a transaction response: the targets added, the target and
+	state of the add which failed, and each rollback as "<target> <state>" in the
+	order they were done.
+*/
+func transaction_result( added []string, failed string, fstate string, rolled ...string ) ( func( map[string]interface{} ) error ) {
+	return func( resp map[string]interface{} ) ( error ) {
+		var data struct {
+			Added	[]string	`json:"added"`
+			Failed	*struct {
+				Target	string	`json:"target"`
+				State	string	`json:"state"`
+			}	`json:"failed"`
+			Rolled_back	[]struct {
+				Target	string	`json:"target"`
+				State	string	`json:"state"`
+			}	`json:"rolled_back"`
+		}
+		if err := get_data( resp, &data ); err != nil {
+			return err
+		}
+
+		if strings.Join( data.Added, " " ) != strings.Join( added, " " ) {
+			return fmt.Errorf( "expected added %v, got %v", added, data.Added )
+		}
+		if data.Failed == nil || data.Failed.Target != failed || data.Failed.State != fstate {
+			return fmt.Errorf( "expected failed to be %s with state %s, got %+v", failed, fstate, data.Failed )
+		}
+		got := make( []string, 0, len( data.Rolled_back ) )
+		for _, r := range data.Rolled_back {
+			got = append( got, r.Target + " " + r.State )
+		}
+		if strings.Join( got, ", " ) != strings.Join( rolled, ", " ) {
+			return fmt.Errorf( "expected rolled_back [%s], got [%s]", strings.Join( rolled, ", " ), strings.Join( got, ", " ) )
+		}
+		return nil
+	}
+}
+
+/*
+	Returns a check which ensures the fake has none of the named VFs.
+*/
+func no_vfs( fake *fakevfd.Vfd, names ...string ) ( func( map[string]interface{} ) error ) {
+	return func( resp map[string]interface{} ) ( error ) {
+		for _, n := range names {
+			if _, there := fake.Get_vf( n ); there {
+				return fmt.Errorf( "vf %s is still configured in VFd", n )
+			}
+		}
+		return nil
+	}
+}
+
+/*
+	Returns a fate function for the fake which gives the add for target the fate f.
+*/
+func add_fate( target string, f fakevfd.Fate ) ( func( *fakevfd.Request ) ( fakevfd.Fate ) ) {
+	return func( req *fakevfd.Request ) ( fakevfd.Fate ) {
+		if req.Action == "add" && filepath.Base( req.Params.Filename ) == target + ".json" {
+			return f
+		}
+		return fakevfd.Fate_normal
+	}
+}
+
+/*
+	Transactions which fail part way: the adds already made must be deleted, most
+	recent first, including one which timed out (VFd may have applied it).
+*/
+func transaction_cases( env *Env ) ( []Case ) {
+	var m int
+	vf := func( target string, vfid int ) ( string ) {
+		return fmt.Sprintf( `{ "target": %q, "req_data": { "pciid": "0000:01:00.0", "vfid": %d } }`, target, vfid )
+	}
+	unfate := func( ) { env.Fake.Set_fate( nil ) }
+
+	return []Case {
+		{ Name: "transaction rolled back when an add fails", State: "ERROR", Msg_has: "2 rolled back",
+			Req: fmt.Sprintf( `{ "action": "transaction", "req_data": [ %s, %s, %s, %s ] }`, vf( "harness_t1", 11 ), vf( "harness_t2", 12 ), vf( "harness_t3", 13 ), vf( "harness_t4", 14 ) ),
+			Before: func( ) { mark( env.Fake, &m )(); env.Fake.Set_fate( add_fate( "harness_t3", fakevfd.Fate_error ) ) }, After: unfate,
+			Check: all(
+				transaction_result( []string { "harness_t1", "harness_t2" }, "harness_t3", "ERROR", "harness_t2 OK", "harness_t1 OK" ),
+				received( env.Fake, &m, "add harness_t1", "add harness_t2", "add harness_t3", "delete harness_t2", "delete harness_t1" ),
+				no_vfs( env.Fake, "harness_t1", "harness_t2", "harness_t3", "harness_t4" ) ) },
+		{ Name: "transaction rolls back an add which timed out", State: "ERROR", Msg_has: "2 rolled back", Wait: 2 * env.Timeout + Default_wait,
+			Req: fmt.Sprintf( `{ "action": "transaction", "req_data": [ %s, %s ] }`, vf( "harness_t5", 15 ), vf( "harness_t6", 16 ) ),
+			Before: func( ) { mark( env.Fake, &m )(); env.Fake.Set_fate( add_fate( "harness_t6", fakevfd.Fate_silent ) ) }, After: unfate,
+			Check: all(
+				transaction_result( []string { "harness_t5" }, "harness_t6", "TIMEOUT", "harness_t6 OK", "harness_t5 OK" ),
+				received( env.Fake, &m, "add harness_t5", "add harness_t6", "delete harness_t6", "delete harness_t5" ),
+				no_vfs( env.Fake, "harness_t5", "harness_t6" ) ) },
+	}
+}
+
+/*
+	Returns a check of an update response: the mode, the fields listed as changed,
+	the before config's vlans (nil if there should be no before), and the number of
+	steps sent to VFd.
+*/
+func update_result( mode string, fields []string, before_vlans []int, nsteps int ) ( func( map[string]interface{} ) error ) {
+	return func( resp map[string]interface{} ) ( error ) {
+		var data struct {
+			Mode	string				`json:"mode"`
+			Before	*struct {
+				Vlans	[]int	`json:"vlans"`
+			}	`json:"before"`
+			After	map[string]interface{}	`json:"after"`
+			Changes	[]struct {
+				Field	string	`json:"field"`
+			}	`json:"changes"`
+			Steps	[]map[string]interface{}	`json:"steps"`
+		}
+		if err := get_data( resp, &data ); err != nil {
+			return err
+		}
+
+		got := make( []string, 0, len( data.Changes ) )
+		for _, c := range data.Changes {
+			got = append( got, c.Field )
+		}
+		switch {
+			case data.Mode != mode:
+				return fmt.Errorf( "expected mode %s, got %s", mode, data.Mode )
+
+			case strings.Join( got, " " ) != strings.Join( fields, " " ):
+				return fmt.Errorf( "expected changed fields %v, got %v", fields, got )
+
+			case ( data.Before == nil ) != ( before_vlans == nil ):
+				return fmt.Errorf( "expected before to be set: %v, got %+v", before_vlans != nil, data.Before )
+
+			case data.Before != nil && fmt.Sprint( data.Before.Vlans ) != fmt.Sprint( before_vlans ):
+				return fmt.Errorf( "expected before vlans %v, got %v", before_vlans, data.Before.Vlans )
+
+			case data.After == nil:
+				return fmt.Errorf( "no after config in the response" )
+
+			case len( data.Steps ) != nsteps:
+				return fmt.Errorf( "expected %d steps, got %d", nsteps, len( data.Steps ) )
+		}
+		return nil
+	}
+}
+
+/*
+	Returns a check which ensures the fake has the VF configured with the vlans.
+*/
+func vf_vlans( fake *fakevfd.Vfd, name string, vlans ...int ) ( func( map[string]interface{} ) error ) {
+	return func( resp map[string]interface{} ) ( error ) {
+		vf, there := fake.Get_vf( name )
+		if ! there {
+			return fmt.Errorf( "vf %s is not configured in VFd", name )
+		}
+		if fmt.Sprint( vf.Vlans ) != fmt.Sprint( vlans ) {
+			return fmt.Errorf( "expected vf %s to have vlans %v, got %v", name, vlans, vf.Vlans )
+		}
+		return nil
+	}
+}
+
+/*
+	Returns a fate function which fails only the first request with the action for
+	the target.
+*/
+func fail_first( action string, target string ) ( func( *fakevfd.Request ) ( fakevfd.Fate ) ) {
+	n := 0													// the fake calls us under its lock
+	return func( req *fakevfd.Request ) ( fakevfd.Fate ) {
+		if req.Action == action && filepath.Base( req.Params.Filename ) == target + ".json" {
+			if n++; n == 1 {
+				return fakevfd.Fate_error
+			}
+		}
+		return fakevfd.Fate_normal
+	}
+}
+
+/*
+	Updates. With VFd update support a single update request is sent; without it
+	the update is a delete and add, and if the add fails the previous config is
+	added back.
+*/
+func update_cases( env *Env ) ( []Case ) {
+	var m int
+	unfate := func( ) { env.Fake.Set_fate( nil ) }
+	update := `{ "action": "update", "target": "harness_u1", "req_data": { "pciid": "0000:01:00.0", "vfid": 20, "vlans": [ 10, 20 ], "strip_stag": true } }`
+	update2 := `{ "action": "update", "target": "harness_u1", "req_data": { "pciid": "0000:01:00.0", "vfid": 20, "vlans": [ 30 ] } }`
+	add := Case { Name: "add for update", Req: `{ "action": "add", "target": "harness_u1", "req_data": { "pciid": "0000:01:00.0", "vfid": 20, "vlans": [ 10 ] } }`, State: "OK" }
+	cleanup := Case { Name: "delete after update", Req: `{ "action": "delete", "target": "harness_u1" }`, State: "OK" }
+
+	if env.Vfd_update {
+		return []Case {
+			add,
+			{ Name: "update (VFd update)", Req: update, State: "OK", Msg_has: "update OK", Before: mark( env.Fake, &m ),
+				Check: all(
+					update_result( "update", []string { "strip_stag", "vlans" }, []int { 10 }, 1 ),
+					received( env.Fake, &m, "update harness_u1" ),
+					checksum_sent( env, &m, "harness_u1" ),
+					vf_vlans( env.Fake, "harness_u1", 10, 20 ) ) },
+			{ Name: "failed VFd update leaves the config", Req: update2, State: "ERROR", Msg_has: "update ERROR",
+				Before: func( ) { mark( env.Fake, &m )(); env.Fake.Set_fate( fail_first( "update", "harness_u1" ) ) }, After: unfate,
+				Check: all(
+					update_result( "update", []string { "strip_stag", "vlans" }, []int { 10, 20 }, 1 ),
+					received( env.Fake, &m, "update harness_u1" ),
+					vf_vlans( env.Fake, "harness_u1", 10, 20 ) ) },
+			cleanup,
+		}
+	}
+
+	return []Case {
+		add,
+		{ Name: "update (delete and add)", Req: update, State: "OK", Msg_has: "update (delete+add) OK", Before: mark( env.Fake, &m ),
+			Check: all(
+				update_result( "readd", []string { "strip_stag", "vlans" }, []int { 10 }, 2 ),
+				received( env.Fake, &m, "delete harness_u1", "add harness_u1" ),
+				vf_vlans( env.Fake, "harness_u1", 10, 20 ) ) },
+		{ Name: "update restores the old config when the add fails", Req: update2, State: "ERROR", Msg_has: "previous config restore OK",
+			Before: func( ) { mark( env.Fake, &m )(); env.Fake.Set_fate( fail_first( "add", "harness_u1" ) ) }, After: unfate,
+			Check: all(
+				update_result( "readd", []string { "strip_stag", "vlans" }, []int { 10, 20 }, 3 ),
+				received( env.Fake, &m, "delete harness_u1", "add harness_u1", "add harness_u1" ),
+				vf_vlans( env.Fake, "harness_u1", 10, 20 ) ) },
+		cleanup,
+		{ Name: "update of an unknown target", Req: strings.Replace( update, "harness_u1", "harness_u9", 1 ), State: "ERROR", Msg_has: "update aborted",
+			Before: mark( env.Fake, &m ),
+			Check: all(
+				update_result( "readd", []string { "pciid", "strip_stag", "vfid", "vlans" }, nil, 1 ),
+				received( env.Fake, &m, "delete harness_u9" ),
+				no_vfs( env.Fake, "harness_u9" ) ) },
+	}
+}
+
+/*
+	Returns a check of a list response: each of want ("<target> <status>") must be
+	in the list, and the list must be sorted by target.
+*/
+func listed( want ...string ) ( func( map[string]interface{} ) error ) {
+	return func( resp map[string]interface{} ) ( error ) {
+		var data struct {
+			Configs	[]struct {
+				Target	string			`json:"target"`
+				Status	string			`json:"status"`
+				Config	interface{}		`json:"config"`
+			}	`json:"configs"`
+		}
+		if err := get_data( resp, &data ); err != nil {
+			return err
+		}
+
+		have := make( map[string]bool )
+		for i, c := range data.Configs {
+			if i > 0 && c.Target < data.Configs[i-1].Target {
+				return fmt.Errorf( "list is not sorted by target: %s follows %s", c.Target, data.Configs[i-1].Target )
+			}
+			if c.Config != nil {
+				return fmt.Errorf( "list includes the config for %s", c.Target )
+			}
+			have[c.Target + " " + c.Status] = true
+		}
+		for _, w := range want {
+			if ! have[w] {
+				return fmt.Errorf( "%s not in the list: %+v", w, data.Configs )
+			}
+		}
+		return nil
+	}
+}
+
+/*
+	Returns a check of a get response: the target, its status, and the vfid in its
+	config.
+*/
+func got_entry( target string, status string, vfid int ) ( func( map[string]interface{} ) error ) {
+	return func( resp map[string]interface{} ) ( error ) {
+		var e struct {
+			Target	string		`json:"target"`
+			Status	string		`json:"status"`
+			Config	*struct {
+				Vfid	int		`json:"vfid"`
+			}	`json:"config"`
+		}
+		if err := get_data( resp, &e ); err != nil {
+			return err
+		}
+		if e.Target != target || e.Status != status || e.Config == nil || e.Config.Vfid != vfid {
+			return fmt.Errorf( "expected %s with status %s and vfid %d, got %+v", target, status, vfid, e )
+		}
+		return nil
+	}
+}
+
+/*
+	The config store: list and get, for configs in each state the earlier cases
+	left them.
+*/
+func store_cases( ) ( []Case ) {
+	return []Case {
+		{ Name: "add for store", Req: `{ "action": "add", "target": "harness_s1", "req_data": { "pciid": "0000:01:00.0", "vfid": 21 } }`, State: "OK" },
+		{ Name: "list", Req: `{ "action": "list" }`, State: "OK",
+			Check: listed( "harness_s1 accepted", "harness_vf1 deleted", "harness_vf2 rejected" ) },
+		{ Name: "get", Req: `{ "action": "get", "target": "harness_s1" }`, State: "OK", Check: got_entry( "harness_s1", "accepted", 21 ) },
+		{ Name: "get unknown", Req: `{ "action": "get", "target": "harness_s9" }`, State: "ERROR", Msg_has: "no config stored for target: harness_s9" },
+		{ Name: "get without a target", Req: `{ "action": "get" }`, State: "ERROR", Msg_has: "no target" },
+		{ Name: "delete for store", Req: `{ "action": "delete", "target": "harness_s1" }`, State: "OK" },
+		{ Name: "get after delete", Req: `{ "action": "get", "target": "harness_s1" }`, State: "OK", Check: got_entry( "harness_s1", "deleted", 21 ) },
+	}
+}
+
+/*
+	Returns a check of a reconcile response: where the desired list came from, the
+	report (targets for matched and missing, "<target>:<fields>" for drifted and
+	"<pf>/<vfid>" for extra; a nil list isn't checked), and each converge request
+	as "<action> <target> <state>" in the order they were sent.
+*/
+func reconciled( source string, matched []string, missing []string, drifted []string, extra []string, actions ...string ) ( func( map[string]interface{} ) error ) {
+	type vf_ref struct {
+		Target	string		`json:"target"`
+		Pf		string		`json:"pf"`
+		Vfid	int			`json:"vfid"`
+		Fields	[]string	`json:"fields"`
+	}
+	names := func( l []vf_ref, extra bool ) ( []string ) {
+		n := make( []string, 0, len( l ) )
+		for _, r := range l {
+			switch {
+				case extra:
+					n = append( n, fmt.Sprintf( "%s/%d", r.Pf, r.Vfid ) )
+				case r.Fields != nil:
+					n = append( n, r.Target + ":" + strings.Join( r.Fields, "+" ) )
+				default:
+					n = append( n, r.Target )
+			}
+		}
+		return n
+	}
+
+	return func( resp map[string]interface{} ) ( error ) {
+		var data struct {
+			Source	string		`json:"desired_source"`
+			Report	struct {
+				Matched	[]vf_ref	`json:"matched"`
+				Missing	[]vf_ref	`json:"missing"`
+				Drifted	[]vf_ref	`json:"drifted"`
+				Extra	[]vf_ref	`json:"extra"`
+			}	`json:"report"`
+			Actions	[]struct {
+				Action	string	`json:"action"`
+				Target	string	`json:"target"`
+				State	string	`json:"state"`
+			}	`json:"actions"`
+		}
+		if err := get_data( resp, &data ); err != nil {
+			return err
+		}
+
+		if data.Source != source {
+			return fmt.Errorf( "expected the desired list from the %s, got %q", source, data.Source )
+		}
+		for _, l := range []struct { what string; want []string; got []string } {
+			{ "matched", matched, names( data.Report.Matched, false ) },
+			{ "missing", missing, names( data.Report.Missing, false ) },
+			{ "drifted", drifted, names( data.Report.Drifted, false ) },
+			{ "extra", extra, names( data.Report.Extra, true ) },
+		} {
+			if l.want != nil && strings.Join( l.want, " " ) != strings.Join( l.got, " " ) {
+				return fmt.Errorf( "expected %s %v, got %v", l.what, l.want, l.got )
+			}
+		}
+
+		got := make( []string, 0, len( data.Actions ) )
+		for _, a := range data.Actions {
+			got = append( got, a.Action + " " + a.Target + " " + a.State )
+		}
+		if strings.Join( got, ", " ) != strings.Join( actions, ", " ) {
+			return fmt.Errorf( "expected actions [%s], got [%s]", strings.Join( actions, ", " ), strings.Join( got, ", " ) )
+		}
+		return nil
+	}
+}
+
+/*
+	Returns a check which ensures the fake received only show requests since the
+	mark, and at least one.
+*/
+func only_shows( fake *fakevfd.Vfd, m *int ) ( func( map[string]interface{} ) error ) {
+	return func( resp map[string]interface{} ) ( error ) {
+		reqs := fake.Requests()[*m:]
+		if len( reqs ) == 0 {
+			return fmt.Errorf( "VFd was not asked to show anything" )
+		}
+		for _, req := range reqs {
+			if req.Action != "show" {
+				return fmt.Errorf( "VFd received %s %s when only a show was expected", req.Action, req.Params.Filename )
+			}
+		}
+		return nil
+	}
+}
+
+/*
+	Reconciliation, reporting only and converging, with the desired list from the
+	config store and from the request. A VF is removed from the fake behind tokay's
+	back so that there is something for the store's list to put right.
+*/
+func reconcile_cases( env *Env ) ( []Case ) {
+	var m int
+	r1 := `{ "pciid": "0000:02:00.0", "vfid": 1, "vlans": [ 10 ] }`
+	r1_drifted := `{ "pciid": "0000:02:00.0", "vfid": 1, "vlans": [ 10, 99 ] }`
+	r3 := `{ "pciid": "0000:02:00.0", "vfid": 3 }`
+	desired := fmt.Sprintf( `[ { "target": "harness_r1", "config": %s }, { "target": "harness_r3", "config": %s } ]`, r1_drifted, r3 )
+	remove := func( ) { mark( env.Fake, &m )(); env.Fake.Remove_vf( "harness_r2" ) }
+
+	return []Case {
+		{ Name: "add for reconcile", Req: `{ "action": "add", "target": "harness_r1", "req_data": ` + r1 + ` }`, State: "OK" },
+		{ Name: "add for reconcile 2", Req: `{ "action": "add", "target": "harness_r2", "req_data": { "pciid": "0000:02:00.0", "vfid": 2 } }`, State: "OK" },
+		{ Name: "reconcile with the store", Req: `{ "action": "reconcile" }`, State: "OK", Before: mark( env.Fake, &m ),
+			Check: all(
+				reconciled( "store", []string { "harness_r1", "harness_r2" }, []string { }, []string { }, []string { } ),
+				only_shows( env.Fake, &m ) ) },
+		{ Name: "reconcile a given list (report only)", Req: `{ "action": "reconcile", "req_data": { "desired": ` + desired + ` } }`, State: "OK",
+			Msg_has: "0 matched, 1 missing, 1 extra, 1 drifted", Before: mark( env.Fake, &m ),
+			Check: all(
+				reconciled( "request", []string { }, []string { "harness_r3" }, []string { "harness_r1:vlans" }, []string { "0000:02:00.0/2" } ),
+				only_shows( env.Fake, &m ),
+				vf_vlans( env.Fake, "harness_r1", 10 ),
+				no_vfs( env.Fake, "harness_r3" ) ) },
+		{ Name: "reconcile with the store re-adds a missing VF", Req: `{ "action": "reconcile", "req_data": { "converge": true } }`, State: "OK",
+			Msg_has: "1 converge requests sent", Before: remove,
+			Check: all(
+				reconciled( "store", []string { "harness_r1" }, []string { "harness_r2" }, []string { }, []string { }, "add harness_r2 OK" ),
+				received( env.Fake, &m, "add harness_r2" ) ) },
+		{ Name: "converge a given list", Req: `{ "action": "reconcile", "req_data": { "converge": true, "desired": ` + desired + ` } }`, State: "OK",
+			Msg_has: "3 converge requests sent", Before: mark( env.Fake, &m ),
+			Check: all(
+				reconciled( "request", []string { }, []string { "harness_r3" }, []string { "harness_r1:vlans" }, []string { "0000:02:00.0/2" },
+					"add harness_r3 OK", "update harness_r1 OK", "delete harness_r2 OK" ),
+				vf_vlans( env.Fake, "harness_r1", 10, 99 ),
+				no_vfs( env.Fake, "harness_r2" ) ) },
+		{ Name: "reconcile after converging", Req: `{ "action": "reconcile", "req_data": { "desired": ` + desired + ` } }`, State: "OK",
+			Check: reconciled( "request", []string { "harness_r1", "harness_r3" }, []string { }, []string { }, []string { } ) },
+		{ Name: "delete after reconcile", Req: `{ "action": "delete", "target": "harness_r1" }`, State: "OK" },
+		{ Name: "delete after reconcile 2", Req: `{ "action": "delete", "target": "harness_r3" }`, State: "OK" },
+	}
+}
+
+/*
+	Returns a check which ensures the fake received nothing since the mark, and
+	that no file was written at any of the paths (relative to the config directory).
+*/
+func nothing_done( env *Env, m *int, paths ...string ) ( func( map[string]interface{} ) error ) {
+	return func( resp map[string]interface{} ) ( error ) {
+		if reqs := env.Fake.Requests()[*m:]; len( reqs ) != 0 {
+			return fmt.Errorf( "VFd received %d requests: %+v", len( reqs ), reqs )
+		}
+		for _, p := range paths {
+			if _, err := os.Lstat( filepath.Join( env.Conf_dir, p ) ); err == nil {
+				return fmt.Errorf( "file was written outside of the config directory: %s", filepath.Join( env.Conf_dir, p ) )
+			}
+		}
+		return nil
+	}
+}
+
+/*
+	Targets which would take the config file out of the config directory must be
+	rejected before anything is written or sent to VFd.
+*/
+func traversal_cases( env *Env ) ( []Case ) {
+	var m int
+	escaped := []string { "../harness_escape.json", "../../harness_escape.json" }
+
+	return []Case {
+		{ Name: "add with a target outside the config directory", State: "INVALID", Msg_has: "invalid target", Before: mark( env.Fake, &m ),
+			Req: `{ "action": "add", "target": "../harness_escape", "req_data": { "pciid": "0000:01:00.0", "vfid": 30 } }`,
+			Check: nothing_done( env, &m, escaped... ) },
+		{ Name: "add with a target with a slash", State: "INVALID", Msg_has: "invalid target", Before: mark( env.Fake, &m ),
+			Req: `{ "action": "add", "target": "harness/escape", "req_data": { "pciid": "0000:01:00.0", "vfid": 30 } }`,
+			Check: nothing_done( env, &m, "harness" ) },
+		{ Name: "delete with a target outside the config directory", State: "INVALID", Msg_has: "invalid target", Before: mark( env.Fake, &m ),
+			Req: `{ "action": "delete", "target": "../../etc/vfd/vfd" }`, Check: nothing_done( env, &m ) },
+		{ Name: "get with a target outside the config directory", State: "INVALID", Msg_has: "invalid target",
+			Req: `{ "action": "get", "target": "../tokay_store" }` },
+		{ Name: "add with a hidden target", State: "INVALID", Msg_has: "invalid target", Before: mark( env.Fake, &m ),
+			Req: `{ "action": "add", "target": ".harness", "req_data": { "pciid": "0000:01:00.0", "vfid": 30 } }`,
+			Check: nothing_done( env, &m, ".harness.json" ) },
+	}
+}
+
+/*
+	Cases for a socket link to VFd which is dropped: a request waiting for VFd when
+	the connection goes must time out, one sent before tokay reconnects must fail
+	at once rather than wait, and requests must work again once tokay has
+	reconnected (which it tries a second after the read fails).
+*/
+func Reconnect_cases( env *Env ) ( []Case ) {
+	reconnected := func( ) {
+		for i := 0; i < 50 && env.Fake.Nconns() == 0; i++ {
+			time.Sleep( 100 * time.Millisecond )
+		}
+	}
+	drop_later := func( ) {
+		env.Fake.Set_drop_rate( 1.0 )
+		go func() {
+			time.Sleep( 250 * time.Millisecond )
+			env.Fake.Drop_conns()
+		}()
+	}
+	undrop := func( ) { env.Fake.Set_drop_rate( 0.0 ); reconnected() }
+
+	return []Case {
+		{ Name: "ping before disconnect", Req: `{ "action": "ping", "req_data": "" }`, State: "OK" },
+		{ Name: "sent while disconnected", Req: `{ "action": "ping", "req_data": "" }`, State: "ERROR", Msg_has: "unable to send req",
+			Wait: time.Second, Before: func( ) { env.Fake.Drop_conns() } },
+		{ Name: "ping after reconnect", Req: `{ "action": "ping", "req_data": "" }`, State: "OK", Before: reconnected },
+		{ Name: "disconnect while waiting for VFd", Req: `{ "action": "ping", "req_data": "" }`, State: "TIMEOUT", Msg_has: "timeout",
+			Wait: 2 * env.Timeout + Default_wait, Before: drop_later, After: undrop },
+		{ Name: "ping after second reconnect", Req: `{ "action": "ping", "req_data": "" }`, State: "OK" },
+	}
+}
+
+/*
+	Returns a check which passes only if all of the checks do.
+*/
+func all( checks ...func( map[string]interface{} ) error ) ( func( map[string]interface{} ) error ) {
+	return func( resp map[string]interface{} ) ( error ) {
+		for _, c := range checks {
+			if err := c( resp ); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+/*
+	The standard cases. The fake is made to stop responding for the timeout cases,
+	which wait a bit longer than the env's timeout. Cases which depend on how tokay
+	was configured expect what the env says.
+*/
+func Std_cases( env *Env ) ( []Case ) {
+	var m int
+	drop := func( ) { env.Fake.Set_drop_rate( 1.0 ) }
+	undrop := func( ) { env.Fake.Set_drop_rate( 0.0 ) }
+
+	cases := []Case {
+		{ Name: "Ping (tokay only)", Req: `{ "action": "Ping" }`, State: "OK", Msg_has: "Pong" },
+		{ Name: "ping VFd", Req: `{ "action": "ping", "req_data": "" }`, State: "OK" },
+		{ Name: "Ping with reply-to", Req: `{ "action": "Ping" }`, Rpc: true, State: "OK", Msg_has: "Pong" },
+		{ Name: "ping VFd with reply-to", Req: `{ "action": "ping", "req_data": "" }`, Rpc: true, State: "OK" },
+		{ Name: "add", Req: `{ "action": "add", "target": "harness_vf1", "req_data": { "pciid": "0000:01:00.0", "vfid": 1, "vlans": [ 10, 11 ], "macs": [ "fa:ce:00:00:00:01" ] } }`, State: "OK",
+			Before: mark( env.Fake, &m ), Check: checksum_sent( env, &m, "harness_vf1" ) },
+		{ Name: "add duplicate", Req: `{ "action": "add", "target": "harness_vf2", "req_data": { "pciid": "0000:01:00.0", "vfid": 1 } }`, State: "ERROR" },
+		{ Name: "show all", Req: `{ "action": "show", "target": "all" }`, State: "OK", Check: has_vf( "0000:01:00.0", 1 ) },
+		{ Name: "mirror", Req: `{ "action": "mirror", "req_data": "0000:01:00.0 1 in 2" }`, State: "OK" },
+		{ Name: "delete", Req: `{ "action": "delete", "target": "harness_vf1" }`, State: "OK" },
+		{ Name: "delete unknown", Req: `{ "action": "delete", "target": "harness_vf1" }`, State: "ERROR" },
+	}
+	cases = append( cases, conflict_cases( env )... )
+	cases = append( cases, throttle_cases( env )... )
+	cases = append( cases, batch_cases( env )... )
+	cases = append( cases, transaction_cases( env )... )
+	cases = append( cases, update_cases( env )... )
+	cases = append( cases, store_cases()... )
+	cases = append( cases, traversal_cases( env )... )
+	cases = append( cases, reconcile_cases( env )... )
+
+	return append( cases, []Case {
+		{ Name: "malformed json ignored", Req: `{ "action": "ping", `, Raw: true, Wait: time.Second },
+		{ Name: "unknown action", Req: `{ "action": "no_such_action" }`, State: "ERROR" },
+		{ Name: "VFd timeout", Req: `{ "action": "ping", "req_data": "" }`, State: "TIMEOUT", Msg_has: "timeout",
+			Wait: 2 * env.Timeout + Default_wait, Before: drop, After: undrop },
+		{ Name: "ping after timeout", Req: `{ "action": "ping", "req_data": "" }`, State: "OK" },
+		{ Name: "timeout with reply-to", Req: `{ "action": "ping", "req_data": "" }`, Rpc: true, State: "TIMEOUT", Msg_has: "timeout",
+			Wait: 2 * env.Timeout + Default_wait, Before: drop, After: undrop },
+	}... )
+}
@@ -0,0 +1,130 @@
+// vi: sw=4 ts=4:
+/*
+	Mnemonic:	inflight.go
+	Abstract:	Tracks the request that is currently in flight to VFd for each target
+				(the VF's config name/uuid) so that add/delete requests for the same
+				target are not interleaved. Requests which arrive while their target
+				is busy can be held here and are released, one at a time and in the
+				order received, as each in-flight request completes.
+
+				The serialiser claims a target before sending a request, and the
+				responder releases it when the response is returned to the user. If
+				the request times out the target stays claimed until VFd's late
+				response arrives, or a grace period passes, since VFd may still be
+				acting on it. Both run as separate goroutines, so all access is under
+				the tracker's lock.
+
+	Date:		18 October 2026
+*/
+
+package inflight
+
+import (
+	"sync"
+
+	"github.com/att/vfd.gaol/tokay/lib/chcom"
+)
+
+/*
+	Manages the per target state.
+*/
+type Tracker struct {
+	mu		sync.Mutex
+	owner	map[string]string					// target -> rid of the request in flight (or reserved for the next held request)
+	held	map[string][]*chcom.Request			// requests waiting on the target, in arrival order
+}
+
+/*
+	Create a tracker.
+*/
+func Mk_tracker( ) ( *Tracker ) {
+	return &Tracker {
+		owner:	make( map[string]string ),
+		held:	make( map[string][]*chcom.Request ),
+	}
+}
+
+/*
+	Claim the target for the request with the given rid. Returns true if the target
+	was idle, or if it was reserved for this rid when the request was released from
+	the hold queue. False is returned if some other request owns the target; the
+	caller must then either hold, or reject, the request.
+*/
+func (t *Tracker) Claim( target string, rid string ) ( bool ) {
+	if t == nil {
+		return true
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	owner, busy := t.owner[target]
+	if busy && owner != rid {
+		return false
+	}
+
+	t.owner[target] = rid
+	return true
+}
+
+/*
+	Queue the request behind the in-flight request for the target.
+*/
+func (t *Tracker) Hold( target string, req *chcom.Request ) {
+	if t == nil || req == nil {
+		return
+	}
+
+	t.mu.Lock()
+	t.held[target] = append( t.held[target], req )
+	t.mu.Unlock()
+}
+
+/*
+	Release the target if it is owned by rid; a release by a non-owner is ignored.
+	If requests are held for the target, the target is reserved for the first one
+	and that request is returned so the caller can resubmit it. Nil is returned
+	when nothing is waiting.
+*/
+func (t *Tracker) Release( target string, rid string ) ( next *chcom.Request ) {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if owner, busy := t.owner[target]; !busy || owner != rid {
+		return nil
+	}
+
+	q := t.held[target]
+	if len( q ) == 0 {
+		delete( t.owner, target )
+		return nil
+	}
+
+	next = q[0]
+	if len( q ) > 1 {
+		t.held[target] = q[1:]
+	} else {
+		delete( t.held, target )
+	}
+	t.owner[target] = next.Rid				// reserve so that new arrivals queue behind it
+
+	return next
+}
+
+/*
+	Return the number of requests held for the target.
+*/
+func (t *Tracker) Held( target string ) ( int ) {
+	if t == nil {
+		return 0
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return len( t.held[target] )
+}
@@ -0,0 +1,117 @@
+// vi: sw=4 ts=4:
+/*
+	Mnemonic:	inflight_test.go
+	Abstract:	Tests for the per target claim and hold queue.
+
+	Date:		18 October 2026
+*/
+
+package inflight
+
+import (
+	"testing"
+
+	"github.com/att/vfd.gaol/tokay/lib/chcom"
+)
+
+func TestClaim( t *testing.T ) {
+	tr := Mk_tracker()
+
+	if ! tr.Claim( "vm1", "r1" ) {
+		t.Fatalf( "claim of an idle target failed" )
+	}
+	if ! tr.Claim( "vm1", "r1" ) {
+		t.Errorf( "owner could not claim the target again" )
+	}
+	if tr.Claim( "vm1", "r2" ) {
+		t.Errorf( "claim of a busy target by another request succeeded" )
+	}
+	if ! tr.Claim( "vm2", "r2" ) {
+		t.Errorf( "claim of a different target failed" )
+	}
+
+	tr.Release( "vm1", "r1" )
+	if ! tr.Claim( "vm1", "r2" ) {
+		t.Errorf( "claim after release failed" )
+	}
+}
+
+/*
+	Held requests come back one per release, in the order they were held, and
+	each reserves the target for itself.
+*/
+func TestHoldOrder( t *testing.T ) {
+	tr := Mk_tracker()
+
+	tr.Claim( "vm1", "r1" )
+	for _, rid := range []string { "r2", "r3", "r4" } {
+		tr.Hold( "vm1", &chcom.Request { Rid: rid } )
+	}
+	if n := tr.Held( "vm1" ); n != 3 {
+		t.Fatalf( "expected 3 held requests, got %d", n )
+	}
+
+	owner := "r1"
+	for _, want := range []string { "r2", "r3", "r4" } {
+		next := tr.Release( "vm1", owner )
+		if next == nil || next.Rid != want {
+			t.Fatalf( "release by %s: expected %s next, got %+v", owner, want, next )
+		}
+		if tr.Claim( "vm1", "r9" ) {
+			t.Errorf( "target was not reserved for %s", want )
+		}
+		if ! tr.Claim( "vm1", want ) {
+			t.Errorf( "released request %s could not claim its reserved target", want )
+		}
+		owner = want
+	}
+
+	if next := tr.Release( "vm1", owner ); next != nil {
+		t.Errorf( "nothing is held, but release returned %s", next.Rid )
+	}
+	if n := tr.Held( "vm1" ); n != 0 {
+		t.Errorf( "expected nothing held, got %d", n )
+	}
+	if ! tr.Claim( "vm1", "r9" ) {
+		t.Errorf( "target still busy after the last release" )
+	}
+}
+
+/*
+	A release by a request that doesn't own the target changes nothing.
+*/
+func TestReleaseWrongRid( t *testing.T ) {
+	tr := Mk_tracker()
+
+	tr.Claim( "vm1", "r1" )
+	tr.Hold( "vm1", &chcom.Request { Rid: "r2" } )
+
+	if next := tr.Release( "vm1", "r2" ); next != nil {
+		t.Errorf( "release by a non-owner returned %s", next.Rid )
+	}
+	if next := tr.Release( "vm2", "r1" ); next != nil {
+		t.Errorf( "release of an idle target returned %s", next.Rid )
+	}
+	if tr.Claim( "vm1", "r3" ) {
+		t.Errorf( "release by a non-owner freed the target" )
+	}
+	if n := tr.Held( "vm1" ); n != 1 {
+		t.Errorf( "release by a non-owner changed the hold queue: %d held", n )
+	}
+
+	if next := tr.Release( "vm1", "r1" ); next == nil || next.Rid != "r2" {
+		t.Errorf( "release by the owner did not return the held request: %+v", next )
+	}
+}
+
+func TestNil( t *testing.T ) {
+	var tr *Tracker
+
+	if ! tr.Claim( "vm1", "r1" ) || ! tr.Claim( "vm1", "r2" ) {
+		t.Errorf( "a nil tracker should allow every claim" )
+	}
+	tr.Hold( "vm1", &chcom.Request { Rid: "r3" } )
+	if tr.Release( "vm1", "r1" ) != nil || tr.Held( "vm1" ) != 0 {
+		t.Errorf( "a nil tracker should hold nothing" )
+	}
+}
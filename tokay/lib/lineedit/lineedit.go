@@ -0,0 +1,375 @@
+// vi: sw=4 ts=4:
+/*
+	Mnemonic:	lineedit.go
+	Abstract:	A small line editor for interactive tools (the tokay_req shell).
+				When standard input is a terminal it is put into raw mode while a
+				line is read so that editing keys, history and completion work:
+
+					left/right, ^B/^F	- move the cursor
+					^A/home, ^E/end		- start/end of line
+					backspace, ^D/del	- delete before/under the cursor
+					^U, ^K, ^W			- kill to start, to end, previous word
+					up/down, ^P/^N		- previous/next history entry
+					tab					- complete the word under construction
+					^L					- clear the screen
+					^C					- abandon the line (Err_interrupt)
+					^D on an empty line	- end of input (io.EOF)
+
+				The terminal is restored before Read_line returns so that output
+				written between lines is cooked as usual.  If standard input isn't
+				a terminal, lines are read as is without a prompt.  Raw mode uses the
+				Linux termios ioctls.
+
+	Date:		18 October 2026
+*/
+
+package lineedit
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+var Err_interrupt = errors.New( "interrupted" )
+
+/*
+	Given the words before the one being typed, and what has been typed of it,
+	return the possible completions of the word.
+*/
+type Completer func( before []string, partial string ) ( []string )
+
+type Editor struct {
+	in			*os.File
+	out			io.Writer
+	tty			bool
+	br			*bufio.Reader
+	history		[]string
+	Max_hist	int
+	Complete	Completer
+}
+
+func ioctl( fd uintptr, req uintptr, t *syscall.Termios ) ( error ) {
+	if _, _, errno := syscall.Syscall( syscall.SYS_IOCTL, fd, req, uintptr( unsafe.Pointer( t ) ) ); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+/*
+	Create an editor reading from in and echoing to out.
+*/
+func Mk_editor( in *os.File, out io.Writer ) ( *Editor ) {
+	var t syscall.Termios
+
+	return &Editor {
+		in:			in,
+		out:		out,
+		tty:		ioctl( in.Fd(), syscall.TCGETS, &t ) == nil,
+		br:			bufio.NewReader( in ),
+		Max_hist:	500,
+	}
+}
+
+/*
+	Returns true if input is a terminal.
+*/
+func (e *Editor) Is_tty( ) ( bool ) {
+	return e.tty
+}
+
+/*
+	Add a line to the history unless it's empty or repeats the last entry.
+*/
+func (e *Editor) Add_history( line string ) {
+	line = strings.TrimSpace( line )
+	if line == "" || ( len( e.history ) > 0 && e.history[len( e.history ) - 1] == line ) {
+		return
+	}
+
+	e.history = append( e.history, line )
+	if e.Max_hist > 0 && len( e.history ) > e.Max_hist {
+		e.history = e.history[len( e.history ) - e.Max_hist:]
+	}
+}
+
+func (e *Editor) History( ) ( []string ) {
+	return e.history
+}
+
+/*
+	Load history from a file, one line per entry. A missing file is not an error.
+*/
+func (e *Editor) Load_history( fname string ) ( error ) {
+	f, err := os.Open( fname )
+	if err != nil {
+		if os.IsNotExist( err ) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner( f )
+	for s.Scan() {
+		e.Add_history( s.Text() )
+	}
+	return s.Err()
+}
+
+/*
+	Write the history to a file which only the user may read; it may contain
+	configs.
+*/
+func (e *Editor) Save_history( fname string ) ( error ) {
+	return os.WriteFile( fname, []byte( strings.Join( e.history, "\n" ) + "\n" ), 0600 )
+}
+
+/*
+	Read a line. Returns io.EOF at the end of input and Err_interrupt if the line
+	was abandoned with ^C.
+*/
+func (e *Editor) Read_line( prompt string ) ( string, error ) {
+	if ! e.tty {
+		line, err := e.br.ReadString( '\n' )
+		if err != nil && ( err != io.EOF || line == "" ) {
+			return "", err
+		}
+		return strings.TrimRight( line, "\r\n" ), nil
+	}
+
+	var orig syscall.Termios
+	if err := ioctl( e.in.Fd(), syscall.TCGETS, &orig ); err != nil {
+		return "", err
+	}
+	raw := orig
+	raw.Iflag &^= syscall.BRKINT | syscall.ICRNL | syscall.INPCK | syscall.ISTRIP | syscall.IXON
+	raw.Lflag &^= syscall.ECHO | syscall.ICANON | syscall.IEXTEN | syscall.ISIG
+	raw.Cflag |= syscall.CS8
+	raw.Cc[syscall.VMIN] = 1
+	raw.Cc[syscall.VTIME] = 0
+	if err := ioctl( e.in.Fd(), syscall.TCSETS, &raw ); err != nil {
+		return "", err
+	}
+	defer ioctl( e.in.Fd(), syscall.TCSETS, &orig )
+
+	return e.edit( prompt )
+}
+
+/*
+	The editing loop; the terminal is in raw mode.
+*/
+func (e *Editor) edit( prompt string ) ( string, error ) {
+	var (
+		buf		[]rune
+		pos		int						// cursor position in buf
+	)
+	hidx := len( e.history )			// history entry shown; len is the line being edited
+	saved := ""							// the line being edited while browsing history
+
+	redraw := func() {
+		fmt.Fprintf( e.out, "\r%s%s\x1b[K\r", prompt, string( buf ) )
+		if n := len( []rune( prompt ) ) + pos; n > 0 {
+			fmt.Fprintf( e.out, "\x1b[%dC", n )
+		}
+	}
+	set_line := func( s string ) {
+		buf = []rune( s )
+		pos = len( buf )
+	}
+	recall := func( to int ) {
+		if to < 0 || to > len( e.history ) {
+			return
+		}
+		if hidx == len( e.history ) {
+			saved = string( buf )
+		}
+		hidx = to
+		if hidx == len( e.history ) {
+			set_line( saved )
+		} else {
+			set_line( e.history[hidx] )
+		}
+	}
+
+	redraw()
+	for {
+		r, _, err := e.br.ReadRune()
+		if err != nil {
+			return "", err
+		}
+
+		switch r {
+			case '\r', '\n':
+				fmt.Fprintf( e.out, "\r\n" )
+				return string( buf ), nil
+
+			case 1:											// ^A
+				pos = 0
+
+			case 2:											// ^B
+				if pos > 0 {
+					pos--
+				}
+
+			case 3:											// ^C
+				fmt.Fprintf( e.out, "^C\r\n" )
+				return "", Err_interrupt
+
+			case 4:											// ^D
+				if len( buf ) == 0 {
+					fmt.Fprintf( e.out, "\r\n" )
+					return "", io.EOF
+				}
+				if pos < len( buf ) {
+					buf = append( buf[:pos], buf[pos+1:]... )
+				}
+
+			case 5:											// ^E
+				pos = len( buf )
+
+			case 6:											// ^F
+				if pos < len( buf ) {
+					pos++
+				}
+
+			case 8, 127:									// backspace
+				if pos > 0 {
+					buf = append( buf[:pos-1], buf[pos:]... )
+					pos--
+				}
+
+			case '\t':
+				e.complete( prompt, &buf, &pos )
+
+			case 11:										// ^K
+				buf = buf[:pos]
+
+			case 12:										// ^L
+				fmt.Fprintf( e.out, "\x1b[H\x1b[2J" )
+
+			case 14:										// ^N
+				recall( hidx + 1 )
+
+			case 16:										// ^P
+				recall( hidx - 1 )
+
+			case 21:										// ^U
+				buf = buf[pos:]
+				pos = 0
+
+			case 23:										// ^W
+				start := pos
+				for start > 0 && buf[start-1] == ' ' {
+					start--
+				}
+				for start > 0 && buf[start-1] != ' ' {
+					start--
+				}
+				buf = append( buf[:start], buf[pos:]... )
+				pos = start
+
+			case 27:										// escape sequence
+				seq := e.escape()
+				switch seq {
+					case "[A", "OA":	recall( hidx - 1 )
+					case "[B", "OB":	recall( hidx + 1 )
+					case "[C", "OC":
+						if pos < len( buf ) {
+							pos++
+						}
+					case "[D", "OD":
+						if pos > 0 {
+							pos--
+						}
+					case "[H", "OH", "[1~":	pos = 0
+					case "[F", "OF", "[4~":	pos = len( buf )
+					case "[3~":
+						if pos < len( buf ) {
+							buf = append( buf[:pos], buf[pos+1:]... )
+						}
+				}
+
+			default:
+				if r >= ' ' {
+					buf = append( buf[:pos], append( []rune { r }, buf[pos:]... )... )
+					pos++
+				}
+		}
+
+		redraw()
+	}
+}
+
+/*
+	Read the rest of an escape sequence: [ or O, then parameters up to the final
+	letter or ~.
+*/
+func (e *Editor) escape( ) ( string ) {
+	r, _, err := e.br.ReadRune()
+	if err != nil || ( r != '[' && r != 'O' ) {
+		return ""
+	}
+
+	seq := []rune { r }
+	for len( seq ) < 8 {
+		r, _, err = e.br.ReadRune()
+		if err != nil {
+			break
+		}
+		seq = append( seq, r )
+		if ( r >= 'A' && r <= 'Z' ) || r == '~' {
+			break
+		}
+	}
+	return string( seq )
+}
+
+/*
+	Complete the word before the cursor. A single match is completed with a
+	trailing space; several are completed as far as they agree and, if that adds
+	nothing, listed.
+*/
+func (e *Editor) complete( prompt string, buf *[]rune, pos *int ) {
+	if e.Complete == nil {
+		return
+	}
+
+	head := string( (*buf)[:*pos] )
+	start := strings.LastIndex( head, " " ) + 1
+	partial := head[start:]
+	matches := make( []string, 0 )
+	for _, c := range e.Complete( strings.Fields( head[:start] ), partial ) {
+		if strings.HasPrefix( c, partial ) {
+			matches = append( matches, c )
+		}
+	}
+	if len( matches ) == 0 {
+		return
+	}
+
+	add := matches[0]
+	if len( matches ) == 1 {
+		add += " "
+	} else {
+		for _, m := range matches[1:] {
+			for ! strings.HasPrefix( m, add ) {
+				add = add[:len( add ) - 1]
+			}
+		}
+		if add == partial {
+			fmt.Fprintf( e.out, "\r\n%s\r\n", strings.Join( matches, "  " ) )
+			return
+		}
+	}
+
+	ins := []rune( add[len( partial ):] )
+	tail := append( ins, (*buf)[*pos:]... )
+	*buf = append( (*buf)[:*pos], tail... )
+	*pos += len( ins )
+}
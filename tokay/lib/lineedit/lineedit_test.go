@@ -0,0 +1,280 @@
+// vi: sw=4 ts=4:
+/*
+	Mnemonic:	lineedit_test.go
+	Abstract:	Tests for the line editor. The editing loop is fed keys from a
+				script rather than a terminal; the echo is collected but only
+				checked where completion lists the candidates.
+
+	Date:		18 October 2026
+*/
+
+package lineedit
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	up		string = "\x1b[A"
+	down	string = "\x1b[B"
+	right	string = "\x1b[C"
+	left	string = "\x1b[D"
+	del		string = "\x1b[3~"
+)
+
+/*
+	Create an editor which reads keys from script as if from a terminal.
+*/
+func mk_test_editor( script string ) ( *Editor, *bytes.Buffer ) {
+	out := &bytes.Buffer{}
+	return &Editor {
+		out:		out,
+		tty:		true,
+		br:			bufio.NewReader( strings.NewReader( script ) ),
+		Max_hist:	500,
+	}, out
+}
+
+func TestEditing( t *testing.T ) {
+	for _, c := range []struct {
+		name	string
+		keys	string
+		want	string
+	} {
+		{ "plain", "show all\r", "show all" },
+		{ "newline", "show all\n", "show all" },
+		{ "insert after moving left", "abc\x02\x02X\r", "aXbc" },
+		{ "arrows", "abc" + left + left + right + "X\r", "abXc" },
+		{ "start and end", "bc\x01a\x05d\r", "abcd" },
+		{ "home and end keys", "bc\x1b[Ha\x1b[Fd\r", "abcd" },
+		{ "backspace", "abcd\x7f\x08x\r", "abx" },
+		{ "backspace at the start", "ab\x01\x7f\r", "ab" },
+		{ "delete under the cursor", "abcd\x01\x04" + del + "\r", "cd" },
+		{ "kill to start", "show vm1\x02\x02\x02\x15\r", "vm1" },
+		{ "kill to end", "show vm1\x01\x06\x06\x06\x06\x0b\r", "show" },
+		{ "kill word", "show all  \x17\r", "show " },
+		{ "kill word in the middle", "add vm1 x\x02\x02\x17\r", "add  x" },
+		{ "control characters ignored", "ab\x07\x00c\r", "abc" },
+		{ "unknown escape ignored", "ab\x1b[Zc\r", "abc" },
+		{ "utf8", "vmé\x02x\r", "vmxé" },
+	} {
+		e, _ := mk_test_editor( c.keys )
+		got, err := e.edit( "> " )
+		if err != nil || got != c.want {
+			t.Errorf( "%s: expected %q, got %q (err=%v)", c.name, c.want, got, err )
+		}
+	}
+}
+
+func TestEnds( t *testing.T ) {
+	e, _ := mk_test_editor( "abc\x03" )
+	if _, err := e.edit( "> " ); err != Err_interrupt {
+		t.Errorf( "^C: expected interrupt, got %v", err )
+	}
+
+	e, _ = mk_test_editor( "\x04" )
+	if _, err := e.edit( "> " ); err != io.EOF {
+		t.Errorf( "^D on an empty line: expected eof, got %v", err )
+	}
+
+	e, _ = mk_test_editor( "abc" )
+	if _, err := e.edit( "> " ); err != io.EOF {
+		t.Errorf( "end of input part way through a line: expected eof, got %v", err )
+	}
+}
+
+func TestHistoryRecall( t *testing.T ) {
+	for _, c := range []struct {
+		name	string
+		keys	string
+		want	string
+	} {
+		{ "previous", up + "\r", "show vm3" },
+		{ "two back", up + up + "\r", "show vm2" },
+		{ "control keys", "\x10\x10\x10\x0e\r", "show vm2" },
+		{ "stops at the oldest", up + up + up + up + up + "\r", "ping" },
+		{ "back to the line being typed", "sh" + up + up + down + down + "ow\r", "show" },
+		{ "down past the end does nothing", "ping" + down + "\r", "ping" },
+		{ "recalled line can be edited", up + "\x7f9\r", "show vm9" },
+		{ "application mode keys", "\x1bOA\x1bOA\x1bOB\r", "show vm3" },
+	} {
+		e, _ := mk_test_editor( c.keys )
+		for _, h := range []string { "ping", "show vm2", "show vm3" } {
+			e.Add_history( h )
+		}
+
+		got, err := e.edit( "> " )
+		if err != nil || got != c.want {
+			t.Errorf( "%s: expected %q, got %q (err=%v)", c.name, c.want, got, err )
+		}
+		if h := strings.Join( e.History(), "|" ); h != "ping|show vm2|show vm3" {
+			t.Errorf( "%s: editing changed the history: %s", c.name, h )
+		}
+	}
+}
+
+/*
+	Lines read are recalled once they are added, as the shell does.
+*/
+func TestHistoryAcrossLines( t *testing.T ) {
+	e, _ := mk_test_editor( "show all\r" + up + " \x17pfs\r" + up + up + "\r" )
+
+	var lines []string
+	for {
+		line, err := e.edit( "> " )
+		if err != nil {
+			break
+		}
+		e.Add_history( line )
+		lines = append( lines, line )
+	}
+	if got := strings.Join( lines, "|" ); got != "show all|show pfs|show all" {
+		t.Errorf( "expected show all|show pfs|show all, got %s", got )
+	}
+}
+
+func TestAddHistory( t *testing.T ) {
+	e, _ := mk_test_editor( "" )
+	e.Max_hist = 3
+
+	for _, h := range []string { "a", "", "  ", "b", "b", " b ", "c", "b", "d" } {
+		e.Add_history( h )
+	}
+	if got := strings.Join( e.History(), "|" ); got != "c|b|d" {
+		t.Errorf( "expected c|b|d, got %s", got )
+	}
+}
+
+func TestSaveLoadHistory( t *testing.T ) {
+	fname := filepath.Join( t.TempDir(), "history" )
+
+	e, _ := mk_test_editor( "" )
+	if err := e.Load_history( fname ); err != nil {
+		t.Errorf( "missing history file should not be an error: %s", err )
+	}
+	for _, h := range []string { "ping", `add vm1 '{ "vfid": 1 }'` } {
+		e.Add_history( h )
+	}
+	if err := e.Save_history( fname ); err != nil {
+		t.Fatalf( "unable to save: %s", err )
+	}
+	if fi, _ := os.Stat( fname ); fi.Mode().Perm() != 0600 {
+		t.Errorf( "history should only be readable by the user: %o", fi.Mode().Perm() )
+	}
+
+	l, _ := mk_test_editor( up + up + "\r" )
+	if err := l.Load_history( fname ); err != nil {
+		t.Fatalf( "unable to load: %s", err )
+	}
+	if got, _ := l.edit( "> " ); got != "ping" {
+		t.Errorf( "expected ping recalled from the loaded history, got %q", got )
+	}
+}
+
+/*
+	A completer like the shell's: actions for the first word, then targets and
+	(for show) show types.
+*/
+func test_completer( calls *[]string ) ( Completer ) {
+	return func( before []string, partial string ) ( []string ) {
+		*calls = append( *calls, strings.Join( before, " " ) + "/" + partial )
+		switch {
+			case len( before ) == 0:
+				return []string { "add", "delete", "dump", "ping", "Ping", "show" }
+
+			case len( before ) == 1 && before[0] == "show":
+				return []string { "all", "extended", "pfs", "vm_east1", "vm_east2", "vm_west" }
+
+			case len( before ) == 1:
+				return []string { "vm_east1", "vm_east2", "vm_west" }
+		}
+		return nil
+	}
+}
+
+func TestComplete( t *testing.T ) {
+	for _, c := range []struct {
+		name	string
+		keys	string
+		want	string
+		call	string						// what the completer was given on the first tab
+		listed	string						// candidates listed, if any
+	} {
+		{ "single action", "sh\t\r", "show ", "/sh", "" },
+		{ "case matters", "P\t\r", "Ping ", "/P", "" },
+		{ "ambiguous lists the candidates", "d\t\r", "d", "/d", "delete  dump" },
+		{ "then typing more completes", "d\te\t\r", "delete ", "/d", "delete  dump" },
+		{ "show type", "show a\t\r", "show all ", "show/a", "" },
+		{ "common prefix", "show vm_e\t\r", "show vm_east", "show/vm_e", "" },
+		{ "common prefix then list", "show vm_e\t\t\r", "show vm_east", "show/vm_e", "vm_east1  vm_east2" },
+		{ "target", "delete vm_w\t\r", "delete vm_west ", "delete/vm_w", "" },
+		{ "target in steps", "get v\te\t2\t\r", "get vm_east2 ", "get/v", "" },
+		{ "nothing matches", "show zz\t\r", "show zz", "show/zz", "" },
+		{ "nothing for the third word", "show all v\t\r", "show all v", "show all/v", "" },
+		{ "empty word", "delete \t\r", "delete vm_", "delete/", "" },
+		{ "in the middle of a line", "show  all\x01\x06\x06\x06\x06\x06vm_we\t\r", "show vm_west  all", "show/vm_we", "" },
+	} {
+		var calls []string
+		e, out := mk_test_editor( c.keys )
+		e.Complete = test_completer( &calls )
+
+		got, err := e.edit( "> " )
+		if err != nil || got != c.want {
+			t.Errorf( "%s: expected %q, got %q (err=%v)", c.name, c.want, got, err )
+		}
+		if len( calls ) == 0 || calls[0] != c.call {
+			t.Errorf( "%s: expected the completer to be given %q, got %v", c.name, c.call, calls )
+		}
+		if c.listed != "" && ! strings.Contains( out.String(), "\r\n" + c.listed ) {
+			t.Errorf( "%s: candidates not listed: %q", c.name, out.String() )
+		}
+	}
+
+	e, _ := mk_test_editor( "sh\t\r" )					// no completer; tab does nothing
+	if got, _ := e.edit( "> " ); got != "sh" {
+		t.Errorf( "tab without a completer: expected sh, got %q", got )
+	}
+}
+
+/*
+	Input which isn't a terminal is read a line at a time without editing.
+*/
+func TestNotTty( t *testing.T ) {
+	fname := filepath.Join( t.TempDir(), "input" )
+	os.WriteFile( fname, []byte( "ping\r\nshow\tall\x1b[A\nlast" ), 0644 )
+	f, err := os.Open( fname )
+	if err != nil {
+		t.Fatalf( "unable to open input: %s", err )
+	}
+	defer f.Close()
+
+	out := &bytes.Buffer{}
+	e := Mk_editor( f, out )
+	if e.Is_tty() {
+		t.Fatalf( "a plain file was taken to be a terminal" )
+	}
+
+	var lines []string
+	for {
+		line, err := e.Read_line( "> " )
+		if err != nil {
+			if err != io.EOF {
+				t.Errorf( "unexpected error: %s", err )
+			}
+			break
+		}
+		lines = append( lines, line )
+	}
+	if got := strings.Join( lines, "|" ); got != "ping|show\tall\x1b[A|last" {
+		t.Errorf( "expected the lines as is, got %q", got )
+	}
+	if out.Len() != 0 {
+		t.Errorf( "nothing should be written when input isn't a terminal: %q", out.String() )
+	}
+}
@@ -0,0 +1,173 @@
+// vi: sw=4 ts=4:
+/*
+	Mnemonic:	profile.go
+	Abstract:	Profiles for tools which talk to tokay (tokay_req and friends) so that
+				the host, port, exchanges and credentials for an environment don't
+				have to be typed on every command. The profile file (~/.tokay_req by
+				default) is json with one object per named environment:
+
+					{
+						"default": "lab",
+						"envs": {
+							"lab": {
+								"host":			"rabbit.lab.example.com",
+								"port":			"5671",
+								"req_exch":		"tokay_req",
+								"resp_exch":	"tokay_resp",
+								"events_exch":	"tokay_events:topic+!du+ad",
+								"stats_exch":	"tokay_stats:topic+!du+ad",
+								"credentials":	"~/.tokay_lab_creds",
+								"tls": {
+									"ca":			"/etc/ssl/lab-ca.pem",
+									"cert":			"",
+									"key":			"",
+									"skip_verify":	false
+								}
+							}
+						}
+					}
+
+				Default names the environment used when none is given. The
+				credentials file is json: { "uname": "...", "pw": "..." }; because it
+				holds a password it must not be readable by group or other. A leading
+				~/ in any file name is replaced with the user's home directory.
+
+	Date:		18 October 2026
+*/
+
+package profile
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type Tls struct {
+	Ca			string	`json:"ca"`
+	Cert		string	`json:"cert"`
+	Key			string	`json:"key"`
+	Skip_verify	bool	`json:"skip_verify"`
+}
+
+/*
+	One environment. Empty fields mean 'not set' so that the caller's defaults
+	(or command line) apply.
+*/
+type Env struct {
+	Name		string	`json:"-"`
+	Host		string	`json:"host"`
+	Port		string	`json:"port"`
+	Req_exch	string	`json:"req_exch"`
+	Resp_exch	string	`json:"resp_exch"`
+	Events_exch	string	`json:"events_exch"`
+	Stats_exch	string	`json:"stats_exch"`
+	Credentials	string	`json:"credentials"`
+	Tls			*Tls	`json:"tls"`
+}
+
+type Profile struct {
+	Default	string			`json:"default"`
+	Envs	map[string]*Env	`json:"envs"`
+}
+
+/*
+	Return the default profile file name: ~/.tokay_req.
+*/
+func Default_file( ) ( string ) {
+	return Expand( "~/.tokay_req" )
+}
+
+/*
+	Replace a leading ~/ with the home directory.
+*/
+func Expand( fname string ) ( string ) {
+	if strings.HasPrefix( fname, "~/" ) {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join( home, fname[2:] )
+		}
+	}
+	return fname
+}
+
+/*
+	Load the profile file. A missing file is not an error if must_exist is false
+	(an empty profile is returned).
+*/
+func Load( fname string, must_exist bool ) ( *Profile, error ) {
+	p := &Profile { Envs: make( map[string]*Env ) }
+
+	buf, err := os.ReadFile( Expand( fname ) )
+	if err != nil {
+		if os.IsNotExist( err ) && ! must_exist {
+			return p, nil
+		}
+		return nil, fmt.Errorf( "unable to read profile: %s", err )
+	}
+
+	if err = json.Unmarshal( buf, p ); err != nil {
+		return nil, fmt.Errorf( "profile is not valid json: %s: %s", fname, err )
+	}
+	for name, e := range p.Envs {
+		if e == nil {
+			return nil, fmt.Errorf( "profile environment is empty: %s", name )
+		}
+		e.Name = name
+	}
+
+	return p, nil
+}
+
+/*
+	Return the named environment, or the default environment if name is empty. If
+	name is empty and there is no default, nil is returned (not an error).
+*/
+func (p *Profile) Env( name string ) ( *Env, error ) {
+	if name == "" {
+		name = p.Default
+		if name == "" {
+			return nil, nil
+		}
+	}
+
+	if e := p.Envs[name]; e != nil {
+		return e, nil
+	}
+	return nil, fmt.Errorf( "environment not defined in profile: %s", name )
+}
+
+/*
+	Read the user name and password from the environment's credentials file. Empty
+	strings are returned if there is no credentials file.
+*/
+func (e *Env) Creds( ) ( uname string, pw string, err error ) {
+	if e == nil || e.Credentials == "" {
+		return "", "", nil
+	}
+
+	fname := Expand( e.Credentials )
+	info, err := os.Stat( fname )
+	if err != nil {
+		return "", "", fmt.Errorf( "unable to access credentials file: %s", err )
+	}
+	if info.Mode().Perm() & 0077 != 0 {
+		return "", "", fmt.Errorf( "credentials file may be read by others; chmod 600 %s", fname )
+	}
+
+	buf, err := os.ReadFile( fname )
+	if err != nil {
+		return "", "", fmt.Errorf( "unable to read credentials file: %s", err )
+	}
+
+	var c struct {
+		Uname	string	`json:"uname"`
+		Pw		string	`json:"pw"`
+	}
+	if err = json.Unmarshal( buf, &c ); err != nil {
+		return "", "", fmt.Errorf( "credentials file is not valid json: %s: %s", fname, err )
+	}
+
+	return c.Uname, c.Pw, nil
+}
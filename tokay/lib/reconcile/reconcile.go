@@ -0,0 +1,182 @@
+// vi: sw=4 ts=4:
+/*
+	Mnemonic:	reconcile.go
+	Abstract:	Compare the VF configs that are supposed to be in place (desired)
+				with what VFd reports (live) and report the differences:
+					missing - desired, but VFd doesn't have the VF
+					extra	- VFd has the VF, but it isn't desired
+					drifted - both have it, but settings differ
+
+				VFs are matched on the PF PCI address and the VF id (the pciid
+				and vfid fields in the config). Settings can only be compared when
+				VFd lists them in its output; today that is the vlans and macs.
+
+	Date:		18 October 2026
+*/
+
+package reconcile
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/att/vfd.gaol/tokay/lib/vfdshow"
+)
+
+/*
+	A desired VF; the config is the json that would be sent on an add.
+*/
+type Desired struct {
+	Target	string			`json:"target"`
+	Config	json.RawMessage	`json:"config"`
+}
+
+/*
+	Reference to a VF in the report. Target is empty for extra VFs as VFd does
+	not tell us the name used to add them.
+*/
+type Vf_ref struct {
+	Target	string		`json:"target,omitempty"`
+	Pf		string		`json:"pf"`
+	Vfid	int			`json:"vfid"`
+}
+
+/*
+	A VF whose live settings don't match the desired config.
+*/
+type Drift struct {
+	Vf_ref
+	Fields	[]string	`json:"fields"`			// names of the settings which differ
+}
+
+type Report struct {
+	Matched	[]Vf_ref	`json:"matched"`
+	Missing	[]Vf_ref	`json:"missing"`
+	Extra	[]Vf_ref	`json:"extra"`
+	Drifted	[]Drift		`json:"drifted"`
+	Invalid	[]string	`json:"invalid"`		// desired targets whose config has no usable pciid/vfid
+}
+
+/*
+	The parts of a config that we use.
+*/
+type vf_cfg struct {
+	Pciid	string		`json:"pciid"`
+	Vfid	*int		`json:"vfid"`
+	Vlans	[]int		`json:"vlans"`
+	Macs	[]string	`json:"macs"`
+}
+
+/*
+	Return the PF pciid and VF id from a config. Ok is false if the config can't be
+	parsed or either is missing.
+*/
+func Vf_key( config []byte ) ( pciid string, vfid int, ok bool ) {
+	var vc vf_cfg
+
+	if json.Unmarshal( config, &vc ) != nil || vc.Pciid == "" || vc.Vfid == nil {
+		return "", 0, false
+	}
+
+	return vc.Pciid, *vc.Vfid, true
+}
+
+/*
+	Return true if the two lists have the same values in any order; case is ignored.
+*/
+func same_set( a []string, b []string ) ( bool ) {
+	if len( a ) != len( b ) {
+		return false
+	}
+
+	ac := make( []string, len( a ) )
+	bc := make( []string, len( b ) )
+	for i := range a {
+		ac[i] = strings.ToLower( a[i] )
+		bc[i] = strings.ToLower( b[i] )
+	}
+	sort.Strings( ac )
+	sort.Strings( bc )
+
+	for i := range ac {
+		if ac[i] != bc[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+/*
+	Convert a list of ints to strings for comparison.
+*/
+func itoa_list( l []int ) ( sl []string ) {
+	sl = make( []string, len( l ) )
+	for i, v := range l {
+		sl[i] = fmt.Sprintf( "%d", v )
+	}
+
+	return sl
+}
+
+/*
+	Compare the desired configs with the live state.
+*/
+func Compare( desired []Desired, live *vfdshow.Show ) ( r *Report ) {
+	r = &Report {
+		Matched:	make( []Vf_ref, 0 ),
+		Missing:	make( []Vf_ref, 0 ),
+		Extra:		make( []Vf_ref, 0 ),
+		Drifted:	make( []Drift, 0 ),
+		Invalid:	make( []string, 0 ),
+	}
+
+	seen := make( map[*vfdshow.Vf]bool )
+	for _, d := range desired {
+		var vc vf_cfg
+
+		if json.Unmarshal( d.Config, &vc ) != nil || vc.Pciid == "" || vc.Vfid == nil {
+			r.Invalid = append( r.Invalid, d.Target )
+			continue
+		}
+
+		ref := Vf_ref { Target: d.Target, Pf: vc.Pciid, Vfid: *vc.Vfid }
+		lvf := live.Find_vf( vc.Pciid, *vc.Vfid )
+		if lvf == nil {
+			r.Missing = append( r.Missing, ref )
+			continue
+		}
+		seen[lvf] = true
+
+		fields := make( []string, 0 )
+		if lvf.Vlans != nil && ! same_set( itoa_list( vc.Vlans ), itoa_list( lvf.Vlans ) ) {
+			fields = append( fields, "vlans" )
+		}
+		if lvf.Macs != nil && ! same_set( vc.Macs, lvf.Macs ) {
+			fields = append( fields, "macs" )
+		}
+
+		if len( fields ) > 0 {
+			r.Drifted = append( r.Drifted, Drift { Vf_ref: ref, Fields: fields } )
+		} else {
+			r.Matched = append( r.Matched, ref )
+		}
+	}
+
+	for _, lvf := range live.Vfs {
+		if ! seen[lvf] {
+			r.Extra = append( r.Extra, Vf_ref { Pf: lvf.Pf, Vfid: lvf.Vfid } )
+		}
+	}
+
+	return r
+}
+
+/*
+	Returns true if there are no differences.
+*/
+func (r *Report) Clean( ) ( bool ) {
+	return len( r.Missing ) == 0 && len( r.Extra ) == 0 && len( r.Drifted ) == 0
+}
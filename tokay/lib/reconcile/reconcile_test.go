@@ -0,0 +1,118 @@
+// vi: sw=4 ts=4:
+/*
+	Mnemonic:	reconcile_test.go
+	Abstract:	Tests for the comparison of desired configs with VFd's show output.
+				The live state is parsed from show output laid out as in the
+				vfdshow tests (hand-written, in the iplex show layout).
+
+	Date:		18 October 2026
+*/
+
+package reconcile
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/att/vfd.gaol/tokay/lib/vfdshow"
+)
+
+const show_all = `[
+	"      PF/VF  ID    PCIID           Link      Speed     Duplex    RX pkts   RX bytes  RX errors RX dropped   TX pkts   TX bytes  TX errors  Spoofed",
+	"      pf     0     0000:08:00.0    UP        10000     FD        1289733   93542117          0          0    104230    8893120          0        0",
+	"      vf     0     0000:08:00.0    UP        10000     FD          43177    3012090          0          0     41830    2879220          0        0\n      vlans: 10,11\n      macs: fa:16:3e:3c:1f:0a",
+	"      vf     1     0000:08:00.0    DOWN      10000     FD              0          0          0          0         0          0          0        3",
+	"",
+	"      pf     1     0000:08:00.1    UP        10000     FD         802119   61004339          2          0     99871    7200131          0        0",
+	"      vf     0     0000:08:00.1    UP        10000     FD          11002     704128          0          0     10987     703168          0        0\n      vlans: 10 11 12\n      macs: fa:16:3e:3c:1f:0b, fa:16:3e:3c:1f:0c",
+	""
+]`
+
+/*
+	Summarise the report as lists of targets (pf/vfid for extra VFs), with the
+	fields which differ for drifted VFs.
+*/
+func summary( r *Report ) ( string ) {
+	refs := func( l []Vf_ref ) ( string ) {
+		s := make( []string, 0, len( l ) )
+		for _, v := range l {
+			if v.Target != "" {
+				s = append( s, v.Target )
+			} else {
+				s = append( s, fmt.Sprintf( "%s/%d", v.Pf, v.Vfid ) )
+			}
+		}
+		return strings.Join( s, "," )
+	}
+
+	drifted := make( []string, 0, len( r.Drifted ) )
+	for _, d := range r.Drifted {
+		drifted = append( drifted, d.Target + ":" + strings.Join( d.Fields, "+" ) )
+	}
+
+	return fmt.Sprintf( "matched=%s missing=%s extra=%s drifted=%s invalid=%s",
+		refs( r.Matched ), refs( r.Missing ), refs( r.Extra ), strings.Join( drifted, "," ), strings.Join( r.Invalid, "," ) )
+}
+
+func TestCompare( t *testing.T ) {
+	live := vfdshow.Parse( vfdshow.Lines( json.RawMessage( show_all ) ) )
+
+	vm0 := `{ "pciid": "0000:08:00.0", "vfid": 0, "vlans": [ 11, 10 ], "macs": [ "FA:16:3E:3C:1F:0A" ] }`	// order and case don't matter
+	vm1 := `{ "pciid": "0000:08:00.0", "vfid": 1, "vlans": [ 99 ], "macs": [ "fa:16:3e:00:00:99" ] }`		// VFd lists no vlans/macs; can't drift
+	vm2 := `{ "pciid": "0000:08:00.1", "vfid": 0, "vlans": [ 10, 11, 12 ], "macs": [ "fa:16:3e:3c:1f:0b", "fa:16:3e:3c:1f:0c" ] }`
+
+	cases := []struct {
+		name	string
+		desired	map[string]string				// target -> config
+		want	string
+	} {
+		{ "all match", map[string]string { "vm0": vm0, "vm1": vm1, "vm2": vm2 },
+			"matched=vm0,vm1,vm2 missing= extra= drifted= invalid=" },
+		{ "nothing desired", map[string]string { },
+			"matched= missing= extra=0000:08:00.0/0,0000:08:00.0/1,0000:08:00.1/0 drifted= invalid=" },
+		{ "missing", map[string]string { "vm0": vm0, "vm1": vm1, "vm2": vm2, "vm3": `{ "pciid": "0000:08:00.1", "vfid": 3 }` },
+			"matched=vm0,vm1,vm2 missing=vm3 extra= drifted= invalid=" },
+		{ "missing on an unknown pf", map[string]string { "vm0": vm0, "vm1": vm1, "vm2": vm2, "vm4": `{ "pciid": "0000:09:00.0", "vfid": 0 }` },
+			"matched=vm0,vm1,vm2 missing=vm4 extra= drifted= invalid=" },
+		{ "extra", map[string]string { "vm0": vm0 },
+			"matched=vm0 missing= extra=0000:08:00.0/1,0000:08:00.1/0 drifted= invalid=" },
+		{ "vlans drifted", map[string]string { "vm0": `{ "pciid": "0000:08:00.0", "vfid": 0, "vlans": [ 10 ], "macs": [ "fa:16:3e:3c:1f:0a" ] }`, "vm1": vm1, "vm2": vm2 },
+			"matched=vm1,vm2 missing= extra= drifted=vm0:vlans invalid=" },
+		{ "vlans and macs drifted", map[string]string { "vm0": vm0, "vm1": vm1, "vm2": `{ "pciid": "0000:08:00.1", "vfid": 0, "vlans": [ 10, 11 ], "macs": [ "fa:16:3e:3c:1f:0b" ] }` },
+			"matched=vm0,vm1 missing= extra= drifted=vm2:vlans+macs invalid=" },
+		{ "unusable configs", map[string]string { "vm0": vm0, "vm1": vm1, "vm2": vm2, "bad1": `{ "pciid": "0000:08:00.0" }`, "bad2": `{ "vfid": 2 }`, "bad3": `[ 1 ]` },
+			"matched=vm0,vm1,vm2 missing= extra= drifted= invalid=bad1,bad2,bad3" },
+		{ "everything", map[string]string { "vm2": `{ "pciid": "0000:08:00.1", "vfid": 0, "vlans": [ 12, 11, 10 ], "macs": [] }`, "vm3": `{ "pciid": "0000:08:00.1", "vfid": 3 }` },
+			"matched= missing=vm3 extra=0000:08:00.0/0,0000:08:00.0/1 drifted=vm2:macs invalid=" },
+	}
+
+	for _, c := range cases {
+		desired := make( []Desired, 0, len( c.desired ) )
+		for _, target := range []string { "bad1", "bad2", "bad3", "vm0", "vm1", "vm2", "vm3", "vm4" } {		// fixed order; the report follows it
+			if cfg, ok := c.desired[target]; ok {
+				desired = append( desired, Desired { Target: target, Config: json.RawMessage( cfg ) } )
+			}
+		}
+
+		r := Compare( desired, live )
+		if got := summary( r ); got != c.want {
+			t.Errorf( "%s:\n\texpected %s\n\tgot      %s", c.name, c.want, got )
+		}
+		if clean := strings.Contains( c.want, " missing= extra= drifted= " ); r.Clean() != clean {		// invalid configs can't be converged, so don't count
+			t.Errorf( "%s: expected clean to be %v", c.name, clean )
+		}
+	}
+}
+
+func TestVfKey( t *testing.T ) {
+	if pciid, vfid, ok := Vf_key( []byte( `{ "pciid": "0000:08:00.1", "vfid": 0 }` ) ); ! ok || pciid != "0000:08:00.1" || vfid != 0 {
+		t.Errorf( "expected 0000:08:00.1/0, got %s/%d ok=%v", pciid, vfid, ok )
+	}
+	for _, bad := range []string { `{ "pciid": "0000:08:00.1" }`, `{ "vfid": 1 }`, `not json`, `` } {
+		if _, _, ok := Vf_key( []byte( bad ) ); ok {
+			t.Errorf( "expected no key for %q", bad )
+		}
+	}
+}
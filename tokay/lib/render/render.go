@@ -0,0 +1,363 @@
+// vi: sw=4 ts=4:
+/*
+	Mnemonic:	render.go
+	Abstract:	Formats a tokay response for people or for other programs:
+
+					table	- aligned columns; show responses (those with a parsed
+							  field) list PF, VF, link, speed, vlans and macs, others
+							  list the sender, state and message lines
+					csv		- the same rows as the table
+					json	- the response on one line with keys sorted, so output
+							  is stable from run to run
+					yaml	- the response as yaml (keys sorted)
+
+				Messages streamed from the events and stats exchanges (watch) are
+				written one per line with Write_stream; table is fixed width since
+				rows can't be aligned until the stream ends.
+
+	Date:		18 October 2026
+*/
+
+package render
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/att/vfd.gaol/tokay/lib/vfdshow"
+)
+
+var (
+	Formats = []string { "table", "csv", "json", "yaml" }
+	plain_key = regexp.MustCompile( `^[A-Za-z_][A-Za-z0-9_-]*$` )
+)
+
+/*
+	Returns true if the format is one we know.
+*/
+func Valid( format string ) ( bool ) {
+	for _, f := range Formats {
+		if f == format {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+	Decode json keeping numbers as they were written.
+*/
+func decode( buf []byte ) ( interface{}, error ) {
+	var v interface{}
+
+	dec := json.NewDecoder( bytes.NewReader( buf ) )
+	dec.UseNumber()
+	err := dec.Decode( &v )
+	return v, err
+}
+
+/*
+	Write the response in the format.
+*/
+func Write( w io.Writer, format string, resp []byte ) ( error ) {
+	switch format {
+		case "json":
+			v, err := decode( resp )
+			if err != nil {
+				return err
+			}
+			out, err := json.Marshal( v )				// maps are marshalled with sorted keys
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintf( w, "%s\n", out )
+			return err
+
+		case "yaml":
+			v, err := decode( resp )
+			if err != nil {
+				return err
+			}
+			var buf bytes.Buffer
+			buf.WriteString( "---\n" )
+			yaml_value( &buf, v, 0, false )
+			_, err = w.Write( buf.Bytes() )
+			return err
+
+		case "table", "csv":
+			rows, err := Rows( resp )
+			if err != nil {
+				return err
+			}
+			if format == "csv" {
+				cw := csv.NewWriter( w )
+				cw.WriteAll( rows )
+				return cw.Error()
+			}
+
+			tw := tabwriter.NewWriter( w, 0, 4, 2, ' ', 0 )
+			for _, r := range rows {
+				fmt.Fprintf( tw, "%s\n", strings.Join( r, "\t" ) )
+			}
+			return tw.Flush()
+	}
+
+	return fmt.Errorf( "unknown output format: %s (expected one of: %s)", format, strings.Join( Formats, ", " ) )
+}
+
+/*
+	Return the msg field as lines; VFd may send a list.
+*/
+func msg_lines( msg json.RawMessage ) ( []string ) {
+	if len( msg ) == 0 {
+		return nil
+	}
+	return vfdshow.Lines( msg )
+}
+
+func join_ints( l []int ) ( string ) {
+	s := make( []string, len( l ) )
+	for i, v := range l {
+		s[i] = strconv.Itoa( v )
+	}
+	return strings.Join( s, "," )
+}
+
+/*
+	Build the table rows (first row is the heading) for a response.
+*/
+func Rows( resp []byte ) ( [][]string, error ) {
+	var r struct {
+		Sender	string				`json:"sender"`
+		State	string				`json:"state"`
+		Msg		json.RawMessage		`json:"msg"`
+		Parsed	*vfdshow.Show		`json:"parsed"`
+	}
+
+	if err := json.Unmarshal( resp, &r ); err != nil {
+		return nil, fmt.Errorf( "response is not valid json: %s", err )
+	}
+
+	if r.Parsed == nil {
+		rows := [][]string { { "SENDER", "STATE", "MSG" } }
+		lines := msg_lines( r.Msg )
+		if len( lines ) == 0 {
+			lines = []string { "" }
+		}
+		for i, l := range lines {
+			if i == 0 {
+				rows = append( rows, []string { r.Sender, r.State, l } )
+			} else {
+				rows = append( rows, []string { "", "", l } )
+			}
+		}
+		return rows, nil
+	}
+
+	rows := [][]string { { "PF", "VF", "LINK", "SPEED", "VLANS", "MACS" } }
+	done := make( map[*vfdshow.Vf]bool )
+	vf_row := func( v *vfdshow.Vf ) {
+		rows = append( rows, []string { v.Pf, strconv.Itoa( v.Vfid ), v.Link, v.Speed, join_ints( v.Vlans ), strings.Join( v.Macs, "," ) } )
+		done[v] = true
+	}
+
+	for _, p := range r.Parsed.Pfs {
+		rows = append( rows, []string { p.Pciid, "-", p.Link, p.Speed, "", "" } )
+		for _, v := range r.Parsed.Vfs {
+			if strings.EqualFold( v.Pf, p.Pciid ) {
+				vf_row( v )
+			}
+		}
+	}
+	for _, v := range r.Parsed.Vfs {							// vfs whose pf wasn't listed (e.g. show of one vf)
+		if ! done[v] {
+			vf_row( v )
+		}
+	}
+
+	return rows, nil
+}
+
+// ------------------- streams ----------------------------------------------------
+
+var Stream_heading = []string { "TIME", "KEY", "SENDER", "WHAT", "DETAIL" }
+
+/*
+	Build the row for one event or stats message received with the routing key.
+	Messages we don't recognise are given with the body as the detail.
+*/
+func Stream_row( key string, body []byte ) ( []string ) {
+	var m struct {
+		Sender		string				`json:"sender"`
+		Type		string				`json:"type"`
+		Timestamp	int64				`json:"timestamp"`
+		Event		string				`json:"event"`
+		Target		string				`json:"target"`
+		State		string				`json:"state"`
+		Msg			string				`json:"msg"`
+		Kind		string				`json:"kind"`
+		Pf			string				`json:"pf"`
+		Vfid		*int				`json:"vfid"`
+		Link		string				`json:"link"`
+		Counters	json.RawMessage		`json:"counters"`
+	}
+
+	ts := time.Now().Format( "15:04:05" )
+	if err := json.Unmarshal( body, &m ); err != nil {
+		return []string { ts, key, "", "", strings.TrimSpace( string( body ) ) }
+	}
+	if m.Timestamp > 0 {
+		ts = time.Unix( m.Timestamp, 0 ).Format( "15:04:05" )
+	}
+
+	switch m.Type {
+		case "event":
+			return []string { ts, key, m.Sender, m.Event, strings.TrimSpace( fmt.Sprintf( "%s %s %s", m.Target, m.State, m.Msg ) ) }
+
+		case "stats":
+			what := m.Pf
+			if m.Vfid != nil {
+				what = fmt.Sprintf( "%s/%d", m.Pf, *m.Vfid )
+			}
+			counters := string( m.Counters )
+			var cbuf bytes.Buffer
+			if json.Compact( &cbuf, m.Counters ) == nil {
+				counters = cbuf.String()
+			}
+			return []string { ts, key, m.Sender, "stats." + m.Kind, fmt.Sprintf( "%s link=%s %s", what, m.Link, counters ) }
+	}
+
+	return []string { ts, key, m.Sender, m.Type, strings.TrimSpace( string( body ) ) }
+}
+
+/*
+	Write one streamed message in the format. The heading for table and csv is
+	written when first is true; json and yaml write the body as Write does.
+*/
+func Write_stream( w io.Writer, format string, key string, body []byte, first bool ) ( error ) {
+	switch format {
+		case "table":
+			if first {
+				fmt.Fprintf( w, "%-8s  %-28s  %-20s  %-10s  %s\n", "TIME", "KEY", "SENDER", "WHAT", "DETAIL" )
+			}
+			r := Stream_row( key, body )
+			_, err := fmt.Fprintf( w, "%-8s  %-28s  %-20s  %-10s  %s\n", r[0], r[1], r[2], r[3], r[4] )
+			return err
+
+		case "csv":
+			cw := csv.NewWriter( w )
+			if first {
+				cw.Write( Stream_heading )
+			}
+			cw.Write( Stream_row( key, body ) )
+			cw.Flush()
+			return cw.Error()
+	}
+
+	return Write( w, format, body )
+}
+
+// ------------------- yaml -------------------------------------------------------
+
+/*
+	Keys are written plain unless they need quoting; words that a yaml reader
+	would take as a bool or null are quoted too.
+*/
+func yaml_key( k string ) ( string ) {
+	switch strings.ToLower( k ) {
+		case "true", "false", "yes", "no", "on", "off", "y", "n", "null", "~":
+			return strconv.Quote( k )
+	}
+	if plain_key.MatchString( k ) {
+		return k
+	}
+	return strconv.Quote( k )
+}
+
+func yaml_scalar( v interface{} ) ( string ) {
+	switch t := v.(type) {
+		case nil:
+			return "null"
+
+		case bool:
+			return strconv.FormatBool( t )
+
+		case json.Number:
+			return t.String()
+
+		case string:
+			return strconv.Quote( t )						// double quoted yaml allows the same escapes
+	}
+
+	return strconv.Quote( fmt.Sprintf( "%v", v ) )
+}
+
+/*
+	Write a value at the indent level. In_list is set when the value follows a list
+	dash, in which case the first line is not indented.
+*/
+func yaml_value( buf *bytes.Buffer, v interface{}, indent int, in_list bool ) {
+	pad := strings.Repeat( "  ", indent )
+	first := func() ( string ) {
+		if in_list {
+			in_list = false
+			return ""
+		}
+		return pad
+	}
+
+	switch t := v.(type) {
+		case map[string]interface{}:
+			if len( t ) == 0 {
+				buf.WriteString( first() + "{}\n" )
+				return
+			}
+			keys := make( []string, 0, len( t ) )
+			for k := range t {
+				keys = append( keys, k )
+			}
+			sort.Strings( keys )
+			for _, k := range keys {
+				switch c := t[k].(type) {
+					case map[string]interface{}:
+						if len( c ) > 0 {
+							buf.WriteString( first() + yaml_key( k ) + ":\n" )
+							yaml_value( buf, c, indent + 1, false )
+							continue
+						}
+
+					case []interface{}:
+						if len( c ) > 0 {
+							buf.WriteString( first() + yaml_key( k ) + ":\n" )
+							yaml_value( buf, c, indent, false )
+							continue
+						}
+				}
+				buf.WriteString( first() + yaml_key( k ) + ": " )
+				yaml_value( buf, t[k], indent + 1, true )
+			}
+
+		case []interface{}:
+			if len( t ) == 0 {
+				buf.WriteString( first() + "[]\n" )
+				return
+			}
+			for _, e := range t {
+				buf.WriteString( first() + "- " )
+				yaml_value( buf, e, indent + 1, true )
+			}
+
+		default:
+			buf.WriteString( first() + yaml_scalar( v ) + "\n" )
+	}
+}
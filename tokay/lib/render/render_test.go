@@ -0,0 +1,156 @@
+// vi: sw=4 ts=4:
+/*
+	Mnemonic:	render_test.go
+	Abstract:	Tests for the output formats: the yaml emitter (nesting, empty
+				containers, quoting), and the table and csv rows for show and
+				other responses.
+
+	Date:		18 October 2026
+*/
+
+package render
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func render( t *testing.T, format string, resp string ) ( string ) {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := Write( &buf, format, []byte( resp ) ); err != nil {
+		t.Fatalf( "%s: unexpected error: %s", format, err )
+	}
+	return buf.String()
+}
+
+func expect( t *testing.T, what string, got string, want string ) {
+	t.Helper()
+
+	if got != want {
+		t.Errorf( "%s: expected:\n%s\ngot:\n%s", what, want, got )
+	}
+}
+
+func TestYamlNesting( t *testing.T ) {
+	got := render( t, "yaml", `{ "b": { "x": [ 1, { "y": 2, "z": [ 3 ] }, [ 4, 5 ] ] }, "a": [ { "k": 1, "j": { "i": 2.50 } } ] }` )
+	expect( t, "nesting", got, `---
+a:
+- j:
+    i: 2.50
+  k: 1
+b:
+  x:
+  - 1
+  - "y": 2
+    z:
+    - 3
+  - - 4
+    - 5
+` )
+}
+
+func TestYamlEmpty( t *testing.T ) {
+	got := render( t, "yaml", `{ "m": {}, "l": [], "nested": { "m": {}, "l": [ [], {} ] } }` )
+	expect( t, "empty containers", got, `---
+l: []
+m: {}
+nested:
+  l:
+  - []
+  - {}
+  m: {}
+` )
+
+	expect( t, "empty top level map", render( t, "yaml", `{}` ), "---\n{}\n" )
+	expect( t, "empty top level list", render( t, "yaml", `[]` ), "---\n[]\n" )
+}
+
+func TestYamlQuoting( t *testing.T ) {
+	got := render( t, "yaml", `{ "plain_key-1": "yes", "with space": "a \"b\"\nc", "true": false, "0lead": null, "Null": 7 }` )
+	expect( t, "quoting", got, `---
+"0lead": null
+"Null": 7
+plain_key-1: "yes"
+"true": false
+"with space": "a \"b\"\nc"
+` )
+}
+
+func TestJsonSorted( t *testing.T ) {
+	expect( t, "json", render( t, "json", `{ "b": 1, "a": { "d": 1.10, "c": [ true ] } }` ), `{"a":{"c":[true],"d":1.10},"b":1}` + "\n" )
+}
+
+func TestRowsMsg( t *testing.T ) {
+	rows, err := Rows( []byte( `{ "sender": "tokay1", "state": "ERROR", "msg": [ "first", "second\nthird" ] }` ) )
+	if err != nil {
+		t.Fatalf( "unexpected error: %s", err )
+	}
+
+	want := [][]string {
+		{ "SENDER", "STATE", "MSG" },
+		{ "tokay1", "ERROR", "first" },
+		{ "", "", "second" },
+		{ "", "", "third" },
+	}
+	if len( rows ) != len( want ) {
+		t.Fatalf( "expected %d rows, got %v", len( want ), rows )
+	}
+	for i := range want {
+		if strings.Join( rows[i], "|" ) != strings.Join( want[i], "|" ) {
+			t.Errorf( "row %d: expected %v, got %v", i, want[i], rows[i] )
+		}
+	}
+
+	rows, _ = Rows( []byte( `{ "sender": "tokay1", "state": "OK" }` ) )
+	if len( rows ) != 2 || strings.Join( rows[1], "|" ) != "tokay1|OK|" {
+		t.Errorf( "no msg: expected a single row with an empty msg, got %v", rows )
+	}
+
+	if _, err := Rows( []byte( `not json` ) ); err == nil {
+		t.Errorf( "expected an error for a response which isn't json" )
+	}
+}
+
+const show_resp = `{ "sender": "tokay1", "state": "OK", "msg": "",
+	"parsed": {
+		"pfs": [ { "id": 0, "pciid": "0000:08:00.0", "link": "UP", "speed": "10000" } ],
+		"vfs": [
+			{ "pf": "0000:08:00.0", "vfid": 1, "link": "UP", "speed": "10000", "vlans": [ 10, 11 ], "macs": [ "fa:16:3e:00:00:01", "fa:16:3e:00:00:02" ] },
+			{ "pf": "0000:09:00.0", "vfid": 4, "link": "DOWN" }
+		]
+	}
+}`
+
+func TestShowTable( t *testing.T ) {
+	lines := strings.Split( render( t, "table", show_resp ), "\n" )
+	for i := range lines {
+		lines[i] = strings.TrimRight( lines[i], " " )			// empty trailing cells are padded
+	}
+	got := strings.Join( lines, "\n" )
+	expect( t, "table", got, `PF            VF  LINK  SPEED  VLANS  MACS
+0000:08:00.0  -   UP    10000
+0000:08:00.0  1   UP    10000  10,11  fa:16:3e:00:00:01,fa:16:3e:00:00:02
+0000:09:00.0  4   DOWN
+` )
+}
+
+func TestShowCsv( t *testing.T ) {
+	got := render( t, "csv", show_resp )
+	expect( t, "csv", got, `PF,VF,LINK,SPEED,VLANS,MACS
+0000:08:00.0,-,UP,10000,,
+0000:08:00.0,1,UP,10000,"10,11","fa:16:3e:00:00:01,fa:16:3e:00:00:02"
+0000:09:00.0,4,DOWN,,,
+` )
+
+	got = render( t, "csv", `{ "sender": "t", "state": "ERROR", "msg": "bad \"thing\", really" }` )
+	expect( t, "csv quoting", got, "SENDER,STATE,MSG\nt,ERROR,\"bad \"\"thing\"\", really\"\n" )
+}
+
+func TestUnknownFormat( t *testing.T ) {
+	if err := Write( &bytes.Buffer{}, "xml", []byte( `{}` ) ); err == nil {
+		t.Errorf( "expected an error for an unknown format" )
+	}
+}
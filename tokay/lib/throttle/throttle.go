@@ -0,0 +1,142 @@
+// vi: sw=4 ts=4:
+/*
+	Mnemonic:	throttle.go
+	Abstract:	Simple token bucket rate limiting. A limiter manages a bucket for
+				each key (sender, user, exchange name, etc.); each bucket holds at
+				most burst tokens and is refilled at rate tokens per second.  A
+				request is allowed if a token can be taken from its bucket.
+
+				All functions are safe to call on a nil limiter, which allows
+				everything, so the caller need not check to see whether limiting
+				was configured.
+
+	Date:		18 October 2026
+*/
+
+package throttle
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	max_idle	int = 4096				// number of buckets we'll let accumulate before pruning full ones
+)
+
+type bucket struct {
+	tokens	float64
+	last	time.Time					// last time tokens were added
+}
+
+/*
+	Manages buckets for a set of keys.
+*/
+type Limiter struct {
+	mu		sync.Mutex
+	rate	float64						// tokens added per second
+	burst	float64						// max tokens a bucket holds
+	buckets	map[string]*bucket
+	now		func( ) ( time.Time )		// the clock; time.Now except when testing
+}
+
+/*
+	Create a limiter which allows rate requests per second, per key, with bursts up
+	to burst. If rate is not positive, nil is returned (no limiting).  If burst is
+	less than 1 it is set to the rate.
+*/
+func Mk_limiter( rate int, burst int ) ( *Limiter ) {
+	if rate <= 0 {
+		return nil
+	}
+
+	if burst < 1 {
+		burst = rate
+	}
+
+	return &Limiter {
+		rate:	float64( rate ),
+		burst:	float64( burst ),
+		buckets: make( map[string]*bucket ),
+		now:	time.Now,
+	}
+}
+
+/*
+	Returns true if a request for key is allowed and consumes a token from the key's
+	bucket. False is returned if the bucket is empty.
+*/
+func (l *Limiter) Allow( key string ) ( bool ) {
+	if l == nil {
+		return true
+	}
+
+	now := l.now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b := l.buckets[key]
+	if b == nil {
+		if len( l.buckets ) >= max_idle {
+			l.prune( now )
+		}
+
+		b = &bucket { tokens: l.burst, last: now }
+		l.buckets[key] = b
+	} else {
+		l.fill( b, now )
+	}
+
+	if b.tokens < 1.0 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+/*
+	Give back a token taken by Allow; used when a request which passed this limit
+	is rejected by another so that it doesn't count against the key.
+*/
+func (l *Limiter) Refund( key string ) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if b := l.buckets[key]; b != nil {
+		b.tokens++
+		if b.tokens > l.burst {
+			b.tokens = l.burst
+		}
+	}
+}
+
+/*
+	Add tokens to the bucket based on the time since it was last filled.
+*/
+func (l *Limiter) fill( b *bucket, now time.Time ) {
+	b.tokens += now.Sub( b.last ).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+}
+
+/*
+	Drop buckets which have refilled; they are no different than a new bucket and
+	keys that were used once (e.g. per sender) would otherwise accumulate forever.
+	Caller must hold the lock.
+*/
+func (l *Limiter) prune( now time.Time ) {
+	for k, b := range l.buckets {
+		l.fill( b, now )
+		if b.tokens >= l.burst {
+			delete( l.buckets, k )
+		}
+	}
+}
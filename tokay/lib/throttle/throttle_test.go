@@ -0,0 +1,160 @@
+// vi: sw=4 ts=4:
+/*
+	Mnemonic:	throttle_test.go
+	Abstract:	Tests for the token bucket limiter. The limiter's clock is replaced
+				so that refill can be tested without waiting.
+
+	Date:		18 October 2026
+*/
+
+package throttle
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+/*
+	Create a limiter whose clock only moves when the returned function is called.
+*/
+func mk_test_limiter( rate int, burst int ) ( *Limiter, func( time.Duration ) ) {
+	now := time.Unix( 1000000, 0 )
+
+	l := Mk_limiter( rate, burst )
+	l.now = func( ) ( time.Time ) { return now }
+
+	return l, func( d time.Duration ) { now = now.Add( d ) }
+}
+
+/*
+	Allow count requests for key; returns the number allowed.
+*/
+func allow_n( l *Limiter, key string, count int ) ( n int ) {
+	for i := 0; i < count; i++ {
+		if l.Allow( key ) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestBurstAndRefill( t *testing.T ) {
+	l, advance := mk_test_limiter( 2, 5 )
+
+	if n := allow_n( l, "k", 8 ); n != 5 {
+		t.Fatalf( "expected the burst of 5 to be allowed, got %d", n )
+	}
+
+	advance( 400 * time.Millisecond )						// not quite one token at 2/s
+	if l.Allow( "k" ) {
+		t.Errorf( "allowed before a token was added" )
+	}
+
+	advance( 100 * time.Millisecond )
+	if ! l.Allow( "k" ) {
+		t.Errorf( "not allowed after a token was added" )
+	}
+
+	advance( time.Minute )									// refill never goes beyond the burst
+	if n := allow_n( l, "k", 8 ); n != 5 {
+		t.Errorf( "expected 5 allowed after a long idle time, got %d", n )
+	}
+}
+
+/*
+	A burst of less than 1 is set to the rate, and a rate of 0 means no limit.
+*/
+func TestDefaults( t *testing.T ) {
+	l, _ := mk_test_limiter( 3, 0 )
+	if n := allow_n( l, "k", 5 ); n != 3 {
+		t.Errorf( "expected burst to default to the rate (3), got %d", n )
+	}
+
+	if l := Mk_limiter( 0, 10 ); l != nil {
+		t.Errorf( "expected no limiter for a rate of 0" )
+	}
+	var nl *Limiter
+	if n := allow_n( nl, "k", 100 ); n != 100 {
+		t.Errorf( "nil limiter should allow everything, allowed %d", n )
+	}
+	nl.Refund( "k" )
+}
+
+/*
+	Each key has its own bucket; tokay keeps a limiter per kind of key (sender, user
+	and exchange) and the same name used as different kinds must not share.
+*/
+func TestKeyIsolation( t *testing.T ) {
+	l, _ := mk_test_limiter( 1, 2 )
+
+	if n := allow_n( l, "alice", 4 ); n != 2 {
+		t.Fatalf( "expected 2 allowed for alice, got %d", n )
+	}
+	if n := allow_n( l, "bob", 4 ); n != 2 {
+		t.Errorf( "alice's requests used bob's tokens: %d allowed", n )
+	}
+
+	sender, _ := mk_test_limiter( 1, 1 )
+	user, _ := mk_test_limiter( 1, 1 )
+	exch, _ := mk_test_limiter( 1, 1 )
+	if ! sender.Allow( "tokay" ) || sender.Allow( "tokay" ) {
+		t.Errorf( "sender limit not applied" )
+	}
+	if ! user.Allow( "tokay" ) || ! exch.Allow( "tokay" ) {
+		t.Errorf( "the same key in another limiter was limited" )
+	}
+}
+
+func TestRefund( t *testing.T ) {
+	l, _ := mk_test_limiter( 1, 2 )
+
+	allow_n( l, "k", 2 )
+	l.Refund( "k" )
+	if ! l.Allow( "k" ) {
+		t.Errorf( "refunded token not available" )
+	}
+	if l.Allow( "k" ) {
+		t.Errorf( "more than the refunded token was available" )
+	}
+
+	l.Refund( "k" )
+	l.Refund( "k" )
+	l.Refund( "k" )
+	if n := allow_n( l, "k", 5 ); n != 2 {
+		t.Errorf( "refunds should never fill a bucket beyond the burst: %d allowed", n )
+	}
+
+	l.Refund( "unknown" )									// nothing to give back to; must not create a bucket
+	if _, there := l.buckets["unknown"]; there {
+		t.Errorf( "refund created a bucket" )
+	}
+}
+
+/*
+	Once max_idle keys have buckets, adding another drops those which have refilled
+	but keeps any that are still short of tokens.
+*/
+func TestPrune( t *testing.T ) {
+	l, advance := mk_test_limiter( 1, 2 )
+
+	allow_n( l, "busy", 2 )									// needs 2s to refill
+	for i := 1; i < max_idle; i++ {
+		l.Allow( fmt.Sprintf( "key%d", i ) )				// each needs 1s
+	}
+	if len( l.buckets ) != max_idle {
+		t.Fatalf( "expected %d buckets, got %d", max_idle, len( l.buckets ) )
+	}
+
+	advance( time.Second )
+	l.Allow( "new" )
+	if len( l.buckets ) != 2 {
+		t.Errorf( "expected only busy and new to be left after pruning, got %d buckets", len( l.buckets ) )
+	}
+	if _, there := l.buckets["busy"]; ! there {
+		t.Errorf( "a bucket short of tokens was pruned" )
+	}
+	if l.Allow( "busy" ) && l.Allow( "busy" ) {
+		t.Errorf( "pruning refilled the busy bucket beyond what time allows" )
+	}
+}
@@ -0,0 +1,280 @@
+// vi: sw=4 ts=4:
+/*
+	Mnemonic:	schema.go
+	Abstract:	Validation of a VF config against the fields that VFd understands.
+				This lets a requestor catch mistakes before the config makes the
+				trip through rabbit and tokay only to be rejected (or worse, half
+				applied) by VFd. Every problem is reported, each with the field it
+				applies to, rather than stopping at the first.
+
+				Fields that VFd doesn't know about are reported as warnings since
+				VFd ignores them; they are most likely typos.
+
+	Date:		18 October 2026
+*/
+
+package vfcfg
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	Max_vfid	int = 127				// largest VF number any supported NIC has
+	Max_vlans	int = 64				// VFd's limit on vlans per VF
+	Max_macs	int = 64
+)
+
+var (
+	pciid_re	= regexp.MustCompile( `^[0-9a-fA-F]{4}:[0-9a-fA-F]{2}:[0-9a-fA-F]{2}\.[0-7]$` )
+	mac_re		= regexp.MustCompile( `^[0-9a-fA-F]{2}(:[0-9a-fA-F]{2}){5}$` )
+)
+
+/*
+	A problem with one field. Warnings don't prevent the config from being used.
+*/
+type Field_error struct {
+	Field	string		`json:"field"`
+	Msg		string		`json:"msg"`
+	Warning	bool		`json:"warning,omitempty"`
+}
+
+func (fe Field_error) Error( ) ( string ) {
+	if fe.Warning {
+		return fmt.Sprintf( "warning: %s: %s", fe.Field, fe.Msg )
+	}
+	return fmt.Sprintf( "%s: %s", fe.Field, fe.Msg )
+}
+
+/*
+	Checks applied to a field's value; each returns a message or "" if the value
+	is good.
+*/
+type checker func( v interface{} ) ( string )
+
+/*
+	The fields VFd accepts in a VF config.
+*/
+var schema = map[string]struct {
+	required	bool
+	check		checker
+} {
+	"name":				{ false, is_string },
+	"pciid":			{ true,	 is_pciid },
+	"vfid":				{ true,	 int_range( 0, Max_vfid ) },
+	"strip_stag":		{ false, is_bool },
+	"insert_stag":		{ false, is_bool },
+	"allow_bcast":		{ false, is_bool },
+	"allow_mcast":		{ false, is_bool },
+	"allow_un_ucast":	{ false, is_bool },
+	"allow_untagged":	{ false, is_bool },
+	"mac_anti_spoof":	{ false, is_bool },
+	"vlan_anti_spoof":	{ false, is_bool },
+	"start_cb":			{ false, is_string },
+	"stop_cb":			{ false, is_string },
+	"vm_mac":			{ false, is_unicast_mac },
+	"link_status":		{ false, one_of( "on", "off", "auto" ) },
+	"rate":				{ false, num_range( 0, 1 ) },		// fraction of the link speed; 0 is no limit
+	"vlans":			{ false, list_of( Max_vlans, int_range( 1, 4095 ) ) },
+	"macs":				{ false, list_of( Max_macs, is_mac ) },
+	"queues":			{ false, is_queues },
+}
+
+func is_string( v interface{} ) ( string ) {
+	if _, ok := v.( string ); !ok {
+		return "must be a string"
+	}
+	return ""
+}
+
+func is_bool( v interface{} ) ( string ) {
+	if _, ok := v.( bool ); !ok {
+		return "must be true or false"
+	}
+	return ""
+}
+
+func is_pciid( v interface{} ) ( string ) {
+	s, ok := v.( string )
+	if !ok || ! pciid_re.MatchString( s ) {
+		return "must be a PCI address of the form dddd:bb:ss.f (hex)"
+	}
+	return ""
+}
+
+func is_mac( v interface{} ) ( string ) {
+	s, ok := v.( string )
+	if !ok || ! mac_re.MatchString( s ) {
+		return "must be a MAC address of the form xx:xx:xx:xx:xx:xx"
+	}
+	return ""
+}
+
+/*
+	The MAC the VM is given for the VF; the NIC won't accept a multicast or zero
+	address.
+*/
+func is_unicast_mac( v interface{} ) ( string ) {
+	if m := is_mac( v ); m != "" {
+		return m
+	}
+
+	s := v.( string )
+	if strings.Trim( s, "0:" ) == "" {
+		return "must not be the zero address"
+	}
+	if b, err := strconv.ParseUint( s[:2], 16, 8 ); err == nil && b & 0x01 != 0 {
+		return "must be a unicast address (low bit of the first octet clear)"
+	}
+	return ""
+}
+
+func num_range( min float64, max float64 ) ( checker ) {
+	return func( v interface{} ) ( string ) {
+		f, ok := v.( float64 )
+		if !ok || f < min || f > max {
+			return fmt.Sprintf( "must be a number from %g to %g", min, max )
+		}
+		return ""
+	}
+}
+
+func int_range( min int, max int ) ( checker ) {
+	return func( v interface{} ) ( string ) {
+		f, ok := v.( float64 )
+		if !ok || f != float64( int( f ) ) || int( f ) < min || int( f ) > max {
+			return fmt.Sprintf( "must be an integer from %d to %d", min, max )
+		}
+		return ""
+	}
+}
+
+func one_of( values ...string ) ( checker ) {
+	return func( v interface{} ) ( string ) {
+		s, _ := v.( string )
+		for _, ok := range values {
+			if s == ok {
+				return ""
+			}
+		}
+		return "must be one of: " + strings.Join( values, ", " )
+	}
+}
+
+/*
+	A list whose elements each pass check; problems with elements are reported
+	with the index.
+*/
+func list_of( max int, check checker ) ( checker ) {
+	return func( v interface{} ) ( string ) {
+		l, ok := v.( []interface{} )
+		if !ok {
+			return "must be a list"
+		}
+		if len( l ) > max {
+			return fmt.Sprintf( "must have no more than %d entries", max )
+		}
+
+		msgs := make( []string, 0 )
+		for i, e := range l {
+			if m := check( e ); m != "" {
+				msgs = append( msgs, fmt.Sprintf( "[%d] %s", i, m ) )
+			}
+		}
+		return strings.Join( msgs, "; " )
+	}
+}
+
+/*
+	Queues are a list of { priority: n, share: "n%" } with one entry per traffic
+	class (priority 0 through 7).
+*/
+func is_queues( v interface{} ) ( string ) {
+	l, ok := v.( []interface{} )
+	if !ok {
+		return "must be a list"
+	}
+	if len( l ) > 8 {
+		return "must have no more than 8 entries (one per priority)"
+	}
+
+	seen := make( map[float64]bool )
+	msgs := make( []string, 0 )
+	for i, e := range l {
+		q, ok := e.( map[string]interface{} )
+		if !ok {
+			msgs = append( msgs, fmt.Sprintf( "[%d] must be an object", i ) )
+			continue
+		}
+		if m := int_range( 0, 7 )( q["priority"] ); m != "" {
+			msgs = append( msgs, fmt.Sprintf( "[%d] priority %s", i, m ) )
+		} else {
+			p := q["priority"].( float64 )
+			if seen[p] {
+				msgs = append( msgs, fmt.Sprintf( "[%d] priority %g is given more than once", i, p ) )
+			}
+			seen[p] = true
+		}
+
+		s, _ := q["share"].( string )
+		pct, err := strconv.ParseFloat( strings.TrimSuffix( s, "%" ), 64 )
+		if ! strings.HasSuffix( s, "%" ) || err != nil || pct < 0 || pct > 100 {
+			msgs = append( msgs, fmt.Sprintf( "[%d] share must be a percentage from 0%% to 100%% (e.g. \"10%%\")", i ) )
+		}
+	}
+	return strings.Join( msgs, "; " )
+}
+
+/*
+	Validate a config. All problems are returned, sorted by field; the config is
+	usable if none of them is an error (see Errors). A buffer which isn't a json
+	object is reported against the field "(config)".
+*/
+func Validate( buf []byte ) ( problems []Field_error ) {
+	m := make( map[string]interface{} )
+	if err := json.Unmarshal( buf, &m ); err != nil {
+		return []Field_error { { Field: "(config)", Msg: "not a json object: " + err.Error() } }
+	}
+
+	for name, f := range schema {
+		v, there := m[name]
+		switch {
+			case ! there:
+				if f.required {
+					problems = append( problems, Field_error { Field: name, Msg: "is required" } )
+				}
+
+			default:
+				if msg := f.check( v ); msg != "" {
+					problems = append( problems, Field_error { Field: name, Msg: msg } )
+				}
+		}
+	}
+
+	for name := range m {
+		if _, known := schema[name]; !known {
+			problems = append( problems, Field_error { Field: name, Msg: "not a field VFd recognises; ignored", Warning: true } )
+		}
+	}
+
+	sort.Slice( problems, func( i, j int ) bool { return problems[i].Field < problems[j].Field } )
+	return problems
+}
+
+/*
+	Return the number of problems which are errors rather than warnings.
+*/
+func Errors( problems []Field_error ) ( n int ) {
+	for _, p := range problems {
+		if ! p.Warning {
+			n++
+		}
+	}
+
+	return n
+}
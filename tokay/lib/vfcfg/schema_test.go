@@ -0,0 +1,68 @@
+// vi: sw=4 ts=4:
+/*
+	Mnemonic:	schema_test.go
+	Abstract:	Tests for VF config validation using the field names VFd's config
+				parser reads.
+
+	Date:		18 October 2026
+*/
+
+package vfcfg
+
+import (
+	"strings"
+	"testing"
+)
+
+/*
+	Return the problems as field: msg strings, warnings prefixed with "warning".
+*/
+func problem_list( cfg string ) ( []string ) {
+	l := make( []string, 0 )
+	for _, p := range Validate( []byte( cfg ) ) {
+		l = append( l, p.Error() )
+	}
+	return l
+}
+
+func TestGood( t *testing.T ) {
+	cfg := `{
+		"name": "vm1/eth1", "pciid": "0000:07:00.1", "vfid": 3,
+		"strip_stag": true, "allow_bcast": true, "allow_mcast": false, "allow_un_ucast": false,
+		"mac_anti_spoof": true, "vlan_anti_spoof": true,
+		"vlans": [ 10, 11 ], "macs": [ "86:f7:25:52:38:9e" ], "vm_mac": "fa:16:3e:00:00:01",
+		"rate": 0.5, "link_status": "auto",
+		"queues": [ { "priority": 0, "share": "10%" }, { "priority": 1, "share": "12.5%" } ]
+	}`
+
+	if p := problem_list( cfg ); len( p ) != 0 {
+		t.Errorf( "expected no problems, got %v", p )
+	}
+}
+
+func TestProblems( t *testing.T ) {
+	cases := []struct {
+		cfg		string
+		want	string						// substring of one of the problems
+		errors	int
+	} {
+		{ `{ "vfid": 1 }`, "pciid: is required", 1 },
+		{ `{ "pciid": "0000:07:00.1", "vfid": 1, "antispoof_mac": true }`, "warning: antispoof_mac", 0 },
+		{ `{ "pciid": "0000:07:00.1", "vfid": 1, "vm_mac": "01:00:5e:00:00:01" }`, "vm_mac: must be a unicast", 1 },
+		{ `{ "pciid": "0000:07:00.1", "vfid": 1, "vm_mac": "00:00:00:00:00:00" }`, "vm_mac: must not be the zero", 1 },
+		{ `{ "pciid": "0000:07:00.1", "vfid": 1, "rate": 2 }`, "rate: must be a number from 0 to 1", 1 },
+		{ `{ "pciid": "0000:07:00.1", "vfid": 1, "queues": [ { "priority": 0, "share": "%" } ] }`, "share must be a percentage", 1 },
+		{ `{ "pciid": "0000:07:00.1", "vfid": 1, "queues": [ { "priority": 2, "share": "10%" }, { "priority": 2, "share": "10%" } ] }`, "priority 2 is given more than once", 1 },
+		{ `{ "pciid": "0000:07:00.1", "vfid": 1, "queues": [ { "priority": 8, "share": "110%" } ] }`, "priority must be an integer from 0 to 7", 1 },
+	}
+
+	for _, c := range cases {
+		problems := Validate( []byte( c.cfg ) )
+		if n := Errors( problems ); n != c.errors {
+			t.Errorf( "%s: expected %d errors, got %d: %v", c.cfg, c.errors, n, problems )
+		}
+		if ! strings.Contains( strings.Join( problem_list( c.cfg ), "\n" ), c.want ) {
+			t.Errorf( "%s: expected a problem containing %q, got %v", c.cfg, c.want, problems )
+		}
+	}
+}
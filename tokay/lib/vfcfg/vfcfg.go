@@ -0,0 +1,177 @@
+// vi: sw=4 ts=4:
+/*
+	Mnemonic:	vfcfg.go
+	Abstract:	Functions which operate on a VF configuration (the json that is
+				written to the config directory for VFd to read on an add).
+				Tokay treats the config as opaque for the most part; these are
+				used where it needs to look inside (e.g. to summarise an update).
+				Also here is the policy applied to target names, which become the
+				config file names.
+
+	Date:		18 October 2026
+*/
+
+package vfcfg
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+/*
+	A difference in one top level field of two configs. Before or after is nil
+	if the field was added or removed.
+*/
+type Change struct {
+	Field	string			`json:"field"`
+	Before	interface{}		`json:"before"`
+	After	interface{}		`json:"after"`
+}
+
+/*
+	Unpack a config into a map. An empty buffer is treated as an empty config.
+*/
+func unpack( buf []byte ) ( map[string]interface{}, error ) {
+	m := make( map[string]interface{} )
+	if len( buf ) == 0 {
+		return m, nil
+	}
+
+	err := json.Unmarshal( buf, &m )
+	if err == nil && m == nil {
+		err = fmt.Errorf( "config is null, not a json object" )		// unmarshal of null leaves the map nil without complaint
+	}
+	return m, err
+}
+
+/*
+	Compare two configs and return the list of top level fields which differ
+	sorted by field name. Either buffer may be empty (e.g. there is no previous
+	config) in which case every field of the other is reported. An error is
+	returned if either is not a json object.
+*/
+func Diff( before []byte, after []byte ) ( changes []Change, err error ) {
+	bm, err := unpack( before )
+	if err != nil {
+		return nil, err
+	}
+	am, err := unpack( after )
+	if err != nil {
+		return nil, err
+	}
+
+	changes = make( []Change, 0 )
+	for f, bv := range bm {
+		av, there := am[f]
+		if ! there || ! reflect.DeepEqual( bv, av ) {
+			changes = append( changes, Change { Field: f, Before: bv, After: av } )
+		}
+	}
+	for f, av := range am {
+		if _, there := bm[f]; ! there {
+			changes = append( changes, Change { Field: f, After: av } )
+		}
+	}
+
+	sort.Slice( changes, func( i, j int ) bool { return changes[i].Field < changes[j].Field } )
+	return changes, nil
+}
+
+// ---------------- target names -------------------------------------------------------
+
+/*
+	Policy for target names. The target given on add/delete is used as the base
+	of the config file name, so it must be something that cannot escape the config
+	directory.  Names may contain letters, digits, dash, underscore and dot, plus
+	any characters in Extra; a slash or nil is never allowed, regardless of Extra,
+	and the name may not start with a dot. If Uuid_only is set the name must be a
+	uuid (8-4-4-4-12 hex digits).
+*/
+type Name_policy struct {
+	Max_len		int					// max length; if <= 0 Default_max_len is used
+	Extra		string				// additional characters allowed
+	Uuid_only	bool
+}
+
+const (
+	Default_max_len	int = 128
+)
+
+/*
+	Check name against the policy. Nil is returned if the name is acceptable,
+	otherwise an error describing the violation. A nil policy uses the defaults.
+*/
+func (p *Name_policy) Check( name string ) ( error ) {
+	var def Name_policy
+
+	if p == nil {
+		p = &def
+	}
+
+	max := p.Max_len
+	if max <= 0 {
+		max = Default_max_len
+	}
+
+	switch {
+		case name == "":
+			return fmt.Errorf( "invalid target: empty name" )
+
+		case len( name ) > max:
+			return fmt.Errorf( "invalid target: name longer than %d characters", max )
+
+		case name[0] == '.':
+			return fmt.Errorf( "invalid target: name may not start with a dot: %q", name )
+	}
+
+	if p.Uuid_only {
+		if ! is_uuid( name ) {
+			return fmt.Errorf( "invalid target: name must be a uuid: %q", name )
+		}
+		return nil
+	}
+
+	for _, c := range name {
+		switch {
+			case c == '/' || c == 0:
+				return fmt.Errorf( "invalid target: illegal character in name: %q", name )
+
+			case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == '.':
+
+			case strings.ContainsRune( p.Extra, c ):
+
+			default:
+				return fmt.Errorf( "invalid target: illegal character %q in name: %q", c, name )
+		}
+	}
+
+	return nil
+}
+
+/*
+	Returns true if the string is a uuid in the 8-4-4-4-12 form.
+*/
+func is_uuid( s string ) ( bool ) {
+	if len( s ) != 36 {
+		return false
+	}
+
+	for i, c := range s {
+		switch i {
+			case 8, 13, 18, 23:
+				if c != '-' {
+					return false
+				}
+
+			default:
+				if ! ( c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F' ) {
+					return false
+				}
+		}
+	}
+
+	return true
+}
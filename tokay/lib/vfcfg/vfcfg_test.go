@@ -0,0 +1,125 @@
+// vi: sw=4 ts=4:
+/*
+	Mnemonic:	vfcfg_test.go
+	Abstract:	Tests for the config comparison used to summarise an update, and
+				for the policy which keeps target names (config file names) inside
+				the config directory.
+
+	Date:		18 October 2026
+*/
+
+package vfcfg
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+/*
+	Return the changes as field:before:after strings with the values as json.
+*/
+func change_list( changes []Change ) ( string ) {
+	l := make( []string, 0, len( changes ) )
+	for _, c := range changes {
+		b, _ := json.Marshal( c.Before )
+		a, _ := json.Marshal( c.After )
+		l = append( l, c.Field + ":" + string( b ) + ":" + string( a ) )
+	}
+	return strings.Join( l, " " )
+}
+
+func TestDiff( t *testing.T ) {
+	cases := []struct {
+		name	string
+		before	string
+		after	string
+		want	string
+	} {
+		{ "same", `{ "vfid": 1, "vlans": [ 10 ] }`, `{ "vlans": [ 10 ], "vfid": 1 }`, `` },
+		{ "changed", `{ "vfid": 1, "strip_stag": false }`, `{ "vfid": 1, "strip_stag": true }`, `strip_stag:false:true` },
+		{ "added", `{ "vfid": 1 }`, `{ "vfid": 1, "rate": 0.5 }`, `rate:null:0.5` },
+		{ "removed", `{ "vfid": 1, "vm_mac": "fa:16:3e:00:00:01" }`, `{ "vfid": 1 }`, `vm_mac:"fa:16:3e:00:00:01":null` },
+		{ "list order", `{ "vlans": [ 10, 11 ] }`, `{ "vlans": [ 11, 10 ] }`, `vlans:[10,11]:[11,10]` },
+		{ "nested", `{ "queues": [ { "priority": 0, "share": "10%" } ], "vfid": 1 }`, `{ "queues": [ { "priority": 0, "share": "20%" } ], "vfid": 1 }`,
+			`queues:[{"priority":0,"share":"10%"}]:[{"priority":0,"share":"20%"}]` },
+		{ "several sorted", `{ "vfid": 1, "b": 1, "a": 1 }`, `{ "vfid": 2, "a": 2, "c": 3 }`, `a:1:2 b:1:null c:null:3 vfid:1:2` },
+		{ "no previous", ``, `{ "vfid": 1, "pciid": "0000:07:00.1" }`, `pciid:null:"0000:07:00.1" vfid:null:1` },
+		{ "all removed", `{ "vfid": 1 }`, ``, `vfid:1:null` },
+	}
+
+	for _, c := range cases {
+		changes, err := Diff( []byte( c.before ), []byte( c.after ) )
+		if err != nil {
+			t.Errorf( "%s: unexpected error: %s", c.name, err )
+			continue
+		}
+		if got := change_list( changes ); got != c.want {
+			t.Errorf( "%s: expected %q, got %q", c.name, c.want, got )
+		}
+	}
+}
+
+func TestDiffNotObject( t *testing.T ) {
+	good := `{ "vfid": 1 }`
+	for _, bad := range []string { `[ 1, 2 ]`, `"vfid"`, `42`, `null`, `{ "vfid": `, `not json` } {
+		if _, err := Diff( []byte( bad ), []byte( good ) ); err == nil {
+			t.Errorf( "expected an error for before %s", bad )
+		}
+		if _, err := Diff( []byte( good ), []byte( bad ) ); err == nil {
+			t.Errorf( "expected an error for after %s", bad )
+		}
+	}
+}
+
+func TestNamePolicy( t *testing.T ) {
+	uuid := "0f8e4a1c-2b3d-4e5f-8a9b-0c1d2e3f4a5b"
+	cases := []struct {
+		policy	*Name_policy
+		name	string
+		ok		bool
+	} {
+		{ nil, "vm1-eth0_a.b", true },
+		{ nil, "../../etc/vfd/vfd", false },
+		{ nil, "..", false },
+		{ nil, "vm1/eth0", false },
+		{ nil, "vm1/", false },
+		{ nil, ".hidden", false },
+		{ nil, "vm1..eth0", true },							// dots are fine when not leading and with no slash
+		{ nil, "", false },
+		{ nil, "vm1\x00.json", false },
+		{ nil, "vm1\neth0", false },
+		{ nil, "vm1\teth0", false },
+		{ nil, "vm1\x7f", false },
+		{ nil, "vm1 eth0", false },
+		{ nil, "vm1:eth0", false },
+		{ nil, "vmé", false },
+		{ nil, strings.Repeat( "a", Default_max_len ), true },
+		{ nil, strings.Repeat( "a", Default_max_len + 1 ), false },
+		{ &Name_policy { Max_len: 8 }, "12345678", true },
+		{ &Name_policy { Max_len: 8 }, "123456789", false },
+		{ &Name_policy { Extra: ":@" }, "vm1:eth0@host", true },
+		{ &Name_policy { Extra: "/" }, "vm1/eth0", false },				// extra can't let a slash in
+		{ &Name_policy { Extra: "/." }, "../../etc/vfd/vfd", false },
+		{ &Name_policy { Extra: "\x00" }, "vm1\x00", false },
+		{ &Name_policy { Extra: ".:" }, ".vm1", false },					// nor a leading dot
+		{ &Name_policy { Uuid_only: true }, uuid, true },
+		{ &Name_policy { Uuid_only: true }, strings.ToUpper( uuid ), true },
+		{ &Name_policy { Uuid_only: true }, "vm1-eth0", false },
+		{ &Name_policy { Uuid_only: true }, uuid + "0", false },
+		{ &Name_policy { Uuid_only: true }, "0f8e4a1c2b3d-4e5f-8a9b-0c1d2e3f4a5b-", false },		// dashes in the wrong places
+		{ &Name_policy { Uuid_only: true }, "0f8e4a1c-2b3d-4e5f-8a9b-0c1d2e3f4a5g", false },
+		{ &Name_policy { Uuid_only: true }, "../../../../../../etc/vfd/vfd.cfg.xx", false },		// 36 characters
+		{ &Name_policy { Uuid_only: true }, "0f8e4a1c/2b3d/4e5f/8a9b/0c1d2e3f4a5b", false },
+	}
+
+	for _, c := range cases {
+		err := c.policy.Check( c.name )
+		if ( err == nil ) != c.ok {
+			t.Errorf( "%q with policy %+v: expected ok=%v, got error %v", c.name, c.policy, c.ok, err )
+		}
+		if err != nil && ! strings.HasPrefix( err.Error(), "invalid target:" ) {
+			t.Errorf( "%q: error does not say the target is invalid: %s", c.name, err )
+		}
+	}
+}
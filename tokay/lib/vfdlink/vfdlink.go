@@ -0,0 +1,417 @@
+// vi: sw=4 ts=4:
+/*
+	Mnemonic:	vfdlink.go
+	Abstract:	The transport between tokay and VFd. Two are supported:
+
+					fifo	- the legacy pair of named pipes; requests are written
+							  to VFd's request fifo (double newline terminated) and
+							  responses are read from our fifo, framed with @eom@.
+
+					socket	- a unix domain socket (stream or seqpacket) which VFd
+							  listens on. Each message, in either direction, is a
+							  4 byte big endian length followed by that many bytes
+							  of json.
+
+				The serialiser sends and the response reader receives; each is a
+				single goroutine so the link needs to allow one of each to run
+				concurrently, but nothing more.
+
+				The listening side of the socket transport is here too so that a
+				fake VFd can be run in process.
+
+	Date:		18 October 2026
+*/
+
+package vfdlink
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+
+	"github.com/att/vfd.gaol/tokay/lib/eom"
+)
+
+/*
+	What the rest of tokay sees.
+*/
+type Link interface {
+	Send( msg []byte ) ( error )			// send a request to VFd
+	Recv( ) ( []byte, error )				// block until the next response is available
+	Reconnect( ) ( error )					// reestablish after Recv returned a (non-framing) error
+	Stats( ) ( resyncs int64, dropped int64 )	// number of dropped/partial responses and bytes lost
+	Close( ) ( error )
+}
+
+// ------------------- fifo -------------------------------------------------------
+
+/*
+	Open a fifo; it is created if it doesn't exist. The fifo is opened read/write
+	so that the open does not block waiting for the other side.
+*/
+func Mk_fifo( fname string ) ( fifo *os.File, err error ) {
+	var errbuf bytes.Buffer
+
+	fifo, err = os.OpenFile( fname, syscall.O_RDWR, 0664 )		 		// crack it open if there; in rw mode to prevent blocking
+	if err == nil {
+		return fifo, nil
+	}
+
+	err = syscall.Mkfifo( fname, 0660 )
+	if err == nil  {
+		return os.OpenFile( fname, syscall.O_RDWR, 0664 )
+	}
+
+	cmd := exec.Command( "mkfifo", "--mode=0666", fname )				// last resort
+	cmd.Stdout = &errbuf
+	err = cmd.Run()
+	if err != nil {
+		return nil, fmt.Errorf( "unable to create fifo: %s: %s", fname, err )
+	}
+
+	return os.OpenFile( fname, syscall.O_RDWR, 0664 )
+}
+
+/*
+	The legacy named pipe transport.
+*/
+type Fifo_link struct {
+	req_fname	string
+	resp_fname	string
+	req			*os.File
+	resp		*os.File
+	er			*eom.Reader
+}
+
+/*
+	Open the request fifo that VFd reads, and create/open the response fifo that
+	VFd writes to. Responses larger than max are dropped.
+*/
+func Mk_fifo_link( req_fname string, resp_fname string, max int ) ( l *Fifo_link, err error ) {
+	l = &Fifo_link {
+		req_fname:	req_fname,
+		resp_fname:	resp_fname,
+	}
+
+	l.req, err = os.OpenFile( req_fname, syscall.O_RDWR, 0664 )			// VFd creates it; read/write so we don't block
+	if err != nil {
+		return nil, fmt.Errorf( "unable to open request fifo: %s: %s", req_fname, err )
+	}
+
+	l.resp, err = Mk_fifo( resp_fname )
+	if err != nil {
+		l.req.Close()
+		return nil, err
+	}
+	l.er = eom.Mk_reader( l.resp, max )
+
+	return l, nil
+}
+
+func (l *Fifo_link) Send( msg []byte ) ( err error ) {
+	_, err = l.req.Write( msg )
+	return err
+}
+
+/*
+	Returns the next response. Eom.Err_too_big is returned if a response was dropped
+	and the caller should just call again.
+*/
+func (l *Fifo_link) Recv( ) ( []byte, error ) {
+	return l.er.Next()
+}
+
+/*
+	Reopen the response fifo.
+*/
+func (l *Fifo_link) Reconnect( ) ( err error ) {
+	l.resp.Close()
+	if l.resp, err = Mk_fifo( l.resp_fname ); err != nil {
+		return err
+	}
+	l.er.Reset( l.resp )
+	return nil
+}
+
+func (l *Fifo_link) Close( ) ( error ) {
+	l.resp.Close()
+	return l.req.Close()
+}
+
+/*
+	Return the resync stats from the framing reader.
+*/
+func (l *Fifo_link) Stats( ) ( resyncs int64, dropped int64 ) {
+	return l.er.Stats()
+}
+
+// ------------------- socket -----------------------------------------------------
+
+/*
+	Write one length prefixed message.
+*/
+func Write_frame( w io.Writer, msg []byte ) ( err error ) {
+	buf := make( []byte, 4 + len( msg ) )				// single write so a seqpacket is the whole message
+	binary.BigEndian.PutUint32( buf, uint32( len( msg ) ) )
+	copy( buf[4:], msg )
+
+	_, err = w.Write( buf )
+	return err
+}
+
+/*
+	Read one length prefixed message. If the length exceeds max, the message is
+	read and discarded and eom.Err_too_big is returned (the stream is still in sync).
+*/
+func Read_frame( r io.Reader, max int ) ( msg []byte, err error ) {
+	msg, _, err = read_frame( r, max )
+	return msg, err
+}
+
+/*
+	Read_frame, but also return the length from the header so the caller can
+	count what was dropped.
+*/
+func read_frame( r io.Reader, max int ) ( msg []byte, n int, err error ) {
+	var hdr [4]byte
+
+	if _, err = io.ReadFull( r, hdr[:] ); err != nil {
+		return nil, 0, err
+	}
+
+	n = int( binary.BigEndian.Uint32( hdr[:] ) )
+	if max > 0 && n > max {
+		if _, err = io.CopyN( io.Discard, r, int64( n ) ); err != nil {
+			return nil, n, err
+		}
+		return nil, n, eom.Err_too_big
+	}
+
+	msg = make( []byte, n )
+	if _, err = io.ReadFull( r, msg ); err != nil {
+		return nil, n, err
+	}
+
+	return msg, n, nil
+}
+
+/*
+	Read one message from a seqpacket socket. A read returns exactly one packet
+	and anything beyond the buffer is lost, so the header is peeked at first and
+	then a buffer of exactly the right size is used to read the whole packet.  A
+	packet whose length exceeds max is read into the header buffer (discarding
+	the rest) and reported as too big.
+*/
+func read_packet( conn net.Conn, max int ) ( msg []byte, n int, err error ) {
+	var hdr [4]byte
+
+	if max <= 0 {
+		max = eom.Default_max
+	}
+
+	sc, ok := conn.( syscall.Conn )
+	if ! ok {
+		return nil, 0, fmt.Errorf( "seqpacket connection does not expose its socket" )
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	recv := func( buf []byte, flags int ) ( plen int, rflags int, err error ) {
+		var rerr error
+
+		err = rc.Read( func( fd uintptr ) ( bool ) {
+			plen, _, rflags, _, rerr = syscall.Recvmsg( int( fd ), buf, nil, flags )
+			return rerr != syscall.EAGAIN						// false waits for the socket to be readable
+		} )
+		if err == nil {
+			err = rerr
+		}
+		if err == nil && plen == 0 {
+			err = io.EOF
+		}
+		return plen, rflags, err
+	}
+
+	plen, _, err := recv( hdr[:], syscall.MSG_PEEK )
+	if err != nil {
+		return nil, 0, err
+	}
+	if plen < 4 {
+		recv( hdr[:], 0 )										// drop it
+		return nil, plen, fmt.Errorf( "short packet: %d bytes", plen )
+	}
+
+	n = int( binary.BigEndian.Uint32( hdr[:] ) )
+	if n > max {
+		recv( hdr[:], 0 )
+		return nil, n, eom.Err_too_big
+	}
+
+	buf := make( []byte, 4 + n )
+	plen, rflags, err := recv( buf, 0 )
+	if err != nil {
+		return nil, 0, err
+	}
+	if rflags & syscall.MSG_TRUNC != 0 {
+		return nil, plen, fmt.Errorf( "packet is longer than its header length: %d", n )
+	}
+	if plen != 4 + n {
+		return nil, plen, fmt.Errorf( "packet length mismatch: header %d, received %d", n, plen - 4 )
+	}
+
+	return buf[4:], n, nil
+}
+
+/*
+	Map our transport names to the go network name.
+*/
+func net_name( transport string ) ( string, error ) {
+	switch transport {
+		case "unix", "stream":
+			return "unix", nil
+
+		case "unixpacket", "seqpacket":
+			return "unixpacket", nil
+	}
+
+	return "", fmt.Errorf( "unknown vfd transport: %s", transport )
+}
+
+/*
+	A unix domain socket transport.
+*/
+type Sock_link struct {
+	mu		sync.Mutex					// held while the connection is swapped
+	network	string
+	path	string
+	max		int
+	conn	net.Conn
+	resyncs	int64						// only touched by the reader
+	dropped	int64
+}
+
+/*
+	Connect to the socket that VFd is listening on. Transport is unix (stream) or
+	unixpacket (seqpacket).
+*/
+func Mk_sock_link( transport string, path string, max int ) ( l *Sock_link, err error ) {
+	network, err := net_name( transport )
+	if err != nil {
+		return nil, err
+	}
+
+	l = &Sock_link { network: network, path: path, max: max }
+	if l.conn, err = net.Dial( network, path ); err != nil {
+		return nil, fmt.Errorf( "unable to connect to VFd socket: %s: %s", path, err )
+	}
+
+	return l, nil
+}
+
+/*
+	Wrap a connection that has already been established. Used by the listening
+	side, and allows a test to hand in one end of a socket pair.
+*/
+func Mk_conn_link( conn net.Conn, max int ) ( *Sock_link ) {
+	return &Sock_link { conn: conn, max: max, network: conn.LocalAddr().Network() }
+}
+
+func (l *Sock_link) get_conn( ) ( net.Conn ) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.conn
+}
+
+func (l *Sock_link) Send( msg []byte ) ( error ) {
+	return Write_frame( l.get_conn(), msg )
+}
+
+func (l *Sock_link) Recv( ) ( msg []byte, err error ) {
+	var n int
+
+	if l.network == "unixpacket" {
+		msg, n, err = read_packet( l.get_conn(), l.max )
+	} else {
+		msg, n, err = read_frame( l.get_conn(), l.max )
+	}
+	if err != nil && n > 0 {						// oversized, or torn part way through
+		l.resyncs++
+		l.dropped += int64( n )
+	}
+
+	return msg, err
+}
+
+func (l *Sock_link) Stats( ) ( resyncs int64, dropped int64 ) {
+	return l.resyncs, l.dropped
+}
+
+/*
+	Close and redial. Only possible if we dialed in the first place.
+*/
+func (l *Sock_link) Reconnect( ) ( err error ) {
+	if l.path == "" {
+		return fmt.Errorf( "connection was not dialed; cannot reconnect" )
+	}
+
+	conn, err := net.Dial( l.network, l.path )
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	l.conn.Close()
+	l.conn = conn
+	l.mu.Unlock()
+	return nil
+}
+
+func (l *Sock_link) Close( ) ( error ) {
+	return l.get_conn().Close()
+}
+
+/*
+	Listen on the socket path for connections (the VFd side). Any existing socket
+	file is removed first.
+*/
+func Listen( transport string, path string ) ( net.Listener, error ) {
+	network, err := net_name( transport )
+	if err != nil {
+		return nil, err
+	}
+
+	os.Remove( path )
+	return net.Listen( network, path )
+}
+
+// ------------------- setup ------------------------------------------------------
+
+/*
+	Create the link based on the transport name from the config: fifo (default)
+	uses the request and response fifos; unix or unixpacket connect to the socket.
+*/
+func Mk_link( transport string, req_fifo string, resp_fifo string, sock_path string, max int ) ( Link, error ) {
+	switch transport {
+		case "", "fifo":
+			l, err := Mk_fifo_link( req_fifo, resp_fifo, max )
+			if err != nil {
+				return nil, err						// don't return a nil pointer wrapped in a non-nil interface
+			}
+			return l, nil
+
+		default:
+			l, err := Mk_sock_link( transport, sock_path, max )
+			if err != nil {
+				return nil, err
+			}
+			return l, nil
+	}
+}
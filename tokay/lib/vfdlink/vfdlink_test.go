@@ -0,0 +1,125 @@
+// vi: sw=4 ts=4:
+/*
+	Mnemonic:	vfdlink_test.go
+	Abstract:	Round trip tests for the socket transport using a socket pair for
+				each of the stream and seqpacket flavours: messages in both
+				directions, oversized messages dropped with the link still in sync,
+				and a seqpacket whose header doesn't match its length.
+
+	Date:		18 October 2026
+*/
+
+package vfdlink
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/att/vfd.gaol/tokay/lib/eom"
+)
+
+/*
+	Make a connected pair of sockets of the given type and wrap each end in a
+	link which accepts messages up to max bytes.
+*/
+func mk_pair( t *testing.T, stype int, max int ) ( *Sock_link, *Sock_link, net.Conn ) {
+	t.Helper()
+
+	fds, err := syscall.Socketpair( syscall.AF_UNIX, stype, 0 )
+	if err != nil {
+		t.Fatalf( "socketpair: %s", err )
+	}
+
+	conns := make( []net.Conn, 2 )
+	for i, fd := range fds {
+		f := os.NewFile( uintptr( fd ), "pair" )
+		conns[i], err = net.FileConn( f )
+		f.Close()									// FileConn dups the descriptor
+		if err != nil {
+			t.Fatalf( "fileconn: %s", err )
+		}
+	}
+
+	a := Mk_conn_link( conns[0], max )
+	b := Mk_conn_link( conns[1], max )
+	t.Cleanup( func() { a.Close(); b.Close() } )
+
+	return a, b, conns[0]
+}
+
+func round_trip( t *testing.T, stype int, network string ) {
+	a, b, _ := mk_pair( t, stype, 1024 )
+	if a.network != network {
+		t.Fatalf( "expected network %s, got %s", network, a.network )
+	}
+
+	msgs := []string { `{ "action": "ping" }`, "", strings.Repeat( "z", 1024 ) }
+	for _, m := range msgs {
+		if err := a.Send( []byte( m ) ); err != nil {
+			t.Fatalf( "send: %s", err )
+		}
+		got, err := b.Recv()
+		if err != nil {
+			t.Fatalf( "recv of %d bytes: %s", len( m ), err )
+		}
+		if string( got ) != m {
+			t.Fatalf( "expected %q, got %q", m, got )
+		}
+	}
+
+	if err := b.Send( []byte( `{ "state": "OK" }` ) ); err != nil {		// and the other way
+		t.Fatalf( "send: %s", err )
+	}
+	if got, err := a.Recv(); err != nil || string( got ) != `{ "state": "OK" }` {
+		t.Fatalf( "reply: %q %v", got, err )
+	}
+
+	big := strings.Repeat( "b", 4000 )
+	a.Send( []byte( big ) )
+	a.Send( []byte( "after" ) )
+	if _, err := b.Recv(); err != eom.Err_too_big {
+		t.Fatalf( "expected Err_too_big, got %v", err )
+	}
+	if got, err := b.Recv(); err != nil || string( got ) != "after" {
+		t.Fatalf( "link out of sync after a big message: %q %v", got, err )
+	}
+	if r, d := b.Stats(); r != 1 || d != int64( len( big ) ) {
+		t.Errorf( "expected 1 resync and %d bytes dropped, got %d and %d", len( big ), r, d )
+	}
+}
+
+func TestStream( t *testing.T ) {
+	round_trip( t, syscall.SOCK_STREAM, "unix" )
+}
+
+func TestSeqpacket( t *testing.T ) {
+	round_trip( t, syscall.SOCK_SEQPACKET, "unixpacket" )
+}
+
+/*
+	A packet whose header disagrees with its size is an error, in either
+	direction, and doesn't disturb the packet after it.
+*/
+func TestSeqpacketMismatch( t *testing.T ) {
+	_, b, aconn := mk_pair( t, syscall.SOCK_SEQPACKET, 1024 )
+
+	for _, hlen := range []uint32 { 3, 10 } {
+		var pkt bytes.Buffer
+		binary.Write( &pkt, binary.BigEndian, hlen )
+		pkt.WriteString( "12345" )
+		aconn.Write( pkt.Bytes() )
+		Write_frame( aconn, []byte( "good" ) )
+
+		if _, err := b.Recv(); err == nil || err == eom.Err_too_big {
+			t.Errorf( "header %d for 5 bytes: expected a length error, got %v", hlen, err )
+		}
+		if got, err := b.Recv(); err != nil || string( got ) != "good" {
+			t.Errorf( "header %d: next packet lost: %q %v", hlen, got, err )
+		}
+	}
+}
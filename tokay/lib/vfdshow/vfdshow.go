@@ -0,0 +1,244 @@
+// vi: sw=4 ts=4:
+/*
+	Mnemonic:	vfdshow.go
+	Abstract:	Parse the text that VFd returns for a show request into something
+				that can be worked with. VFd's output is meant for humans, so the
+				parser is forgiving: lines it doesn't understand are skipped.
+
+				The rows of interest begin with pf or vf followed by the id and the
+				PF's PCI address, then the link state, speed, duplex and counters:
+					pf  0  0000:01:00.0  UP    10000 FD  <rx/tx counters>
+					vf  3  0000:01:00.0  DOWN  10000 FD  <rx/tx counters>
+
+				The counters are taken in the order VFd writes its column headings
+				(Counter_names). A vf row belongs to the PF with the same PCI address.
+				Lines of the form 'name: value' which follow a pf or vf row are taken
+				to be settings of that PF or VF; vlans and macs are also split into
+				lists as they are of particular interest.  This covers show all, show
+				pfs (pf rows only) and the show of a single VF.
+
+	Date:		18 October 2026
+*/
+
+package vfdshow
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/*
+	Names of the counters, in the order they follow the duplex column on a pf or
+	vf row.
+*/
+var Counter_names = []string {
+	"rx_pkts", "rx_bytes", "rx_errors", "rx_dropped", "tx_pkts", "tx_bytes", "tx_errors", "spoofed",
+}
+
+/*
+	A physical function.
+*/
+type Pf struct {
+	Id			int					`json:"id"`
+	Pciid		string				`json:"pciid"`
+	Link		string				`json:"link,omitempty"`
+	Speed		string				`json:"speed,omitempty"`
+	Duplex		string				`json:"duplex,omitempty"`
+	Counters	map[string]int64	`json:"counters,omitempty"`
+	Attrs		map[string]string	`json:"attrs,omitempty"`		// name: value lines following the row
+}
+
+/*
+	A virtual function. Vlans and Macs are nil if VFd didn't list them.
+*/
+type Vf struct {
+	Pf			string				`json:"pf"`				// pciid of the owning PF
+	Vfid		int					`json:"vfid"`
+	Link		string				`json:"link,omitempty"`
+	Speed		string				`json:"speed,omitempty"`
+	Duplex		string				`json:"duplex,omitempty"`
+	Vlans		[]int				`json:"vlans,omitempty"`
+	Macs		[]string			`json:"macs,omitempty"`
+	Counters	map[string]int64	`json:"counters,omitempty"`
+	Attrs		map[string]string	`json:"attrs,omitempty"`
+}
+
+/*
+	Everything we found in the output.
+*/
+type Show struct {
+	Pfs		[]*Pf		`json:"pfs"`
+	Vfs		[]*Vf		`json:"vfs"`
+}
+
+/*
+	Return the lines from the msg field of a VFd response. VFd usually sends an
+	array of strings, but a single string is accepted too; either way embedded
+	newlines are split so that each returned string is one line.
+*/
+func Lines( msg json.RawMessage ) ( lines []string ) {
+	var (
+		list	[]string
+		one		string
+	)
+
+	if json.Unmarshal( msg, &list ) != nil {
+		if json.Unmarshal( msg, &one ) != nil {
+			return nil
+		}
+		list = []string{ one }
+	}
+
+	for _, l := range list {
+		lines = append( lines, strings.Split( l, "\n" )... )
+	}
+
+	return lines
+}
+
+/*
+	Pick up the columns following the pciid on a pf/vf row; any may be missing.
+	Counters which are not numeric are skipped.
+*/
+func row_cols( tokens []string ) ( link string, speed string, duplex string, counters map[string]int64 ) {
+	if len( tokens ) > 3 {
+		link = tokens[3]
+	}
+	if len( tokens ) > 4 {
+		speed = tokens[4]
+	}
+	if len( tokens ) > 5 {
+		duplex = tokens[5]
+	}
+
+	for i := 6; i < len( tokens ) && i - 6 < len( Counter_names ); i++ {
+		if v, err := strconv.ParseInt( tokens[i], 10, 64 ); err == nil {
+			if counters == nil {
+				counters = make( map[string]int64 )
+			}
+			counters[Counter_names[i-6]] = v
+		}
+	}
+
+	return link, speed, duplex, counters
+}
+
+/*
+	Parse the lines of show output.
+*/
+func Parse( lines []string ) ( *Show ) {
+	var (
+		cur_vf	*Vf						// the most recent vf row; name: value lines apply to it
+		cur_pf	*Pf						// or to the most recent pf row if no vf row followed it
+	)
+
+	s := &Show {
+		Pfs:	make( []*Pf, 0 ),
+		Vfs:	make( []*Vf, 0 ),
+	}
+
+	for _, line := range lines {
+		tokens := strings.Fields( line )
+		if len( tokens ) == 0 {
+			continue
+		}
+
+		kind := strings.ToLower( tokens[0] )
+		switch {
+			case kind == "pf" || kind == "vf":
+				if len( tokens ) < 3 {
+					continue
+				}
+				id, err := strconv.Atoi( tokens[1] )
+				if err != nil {
+					continue					// probably a header
+				}
+				link, speed, duplex, counters := row_cols( tokens )
+
+				if kind == "pf" {
+					cur_pf = &Pf { Id: id, Pciid: tokens[2], Link: link, Speed: speed, Duplex: duplex, Counters: counters }
+					s.Pfs = append( s.Pfs, cur_pf )
+					cur_vf = nil
+				} else {
+					cur_vf = &Vf { Pf: tokens[2], Vfid: id, Link: link, Speed: speed, Duplex: duplex, Counters: counters }
+					s.Vfs = append( s.Vfs, cur_vf )
+				}
+
+			case cur_vf != nil && ( kind == "vlans:" || kind == "vlan:" ):
+				cur_vf.Vlans = make( []int, 0 )
+				for _, t := range split_list( tokens[1:] ) {
+					if v, err := strconv.Atoi( t ); err == nil {
+						cur_vf.Vlans = append( cur_vf.Vlans, v )
+					}
+				}
+
+			case cur_vf != nil && ( kind == "macs:" || kind == "mac:" ):
+				cur_vf.Macs = split_list( tokens[1:] )
+
+			case strings.HasSuffix( tokens[0], ":" ) && len( tokens[0] ) > 1:
+				name := strings.ToLower( strings.TrimSuffix( tokens[0], ":" ) )
+				value := strings.Join( tokens[1:], " " )
+				switch {
+					case cur_vf != nil:
+						if cur_vf.Attrs == nil {
+							cur_vf.Attrs = make( map[string]string )
+						}
+						cur_vf.Attrs[name] = value
+
+					case cur_pf != nil:
+						if cur_pf.Attrs == nil {
+							cur_pf.Attrs = make( map[string]string )
+						}
+						cur_pf.Attrs[name] = value
+				}
+		}
+	}
+
+	return s
+}
+
+/*
+	Convenience which parses the msg field of a VFd show response and returns the
+	json for it.  An error is returned if nothing was recognised so that callers
+	don't publish an empty result as if it were meaningful.
+*/
+func To_json( msg json.RawMessage ) ( []byte, error ) {
+	s := Parse( Lines( msg ) )
+	if len( s.Pfs ) == 0 && len( s.Vfs ) == 0 {
+		return nil, fmt.Errorf( "no pf or vf information recognised" )
+	}
+
+	return json.Marshal( s )
+}
+
+/*
+	Tokens in a list may be space and/or comma separated; return the individual
+	values.
+*/
+func split_list( tokens []string ) ( values []string ) {
+	values = make( []string, 0, len( tokens ) )
+	for _, t := range tokens {
+		for _, v := range strings.Split( t, "," ) {
+			if v != "" {
+				values = append( values, v )
+			}
+		}
+	}
+
+	return values
+}
+
+/*
+	Find a VF given the PF pciid and VF id; nil if not there.
+*/
+func (s *Show) Find_vf( pciid string, vfid int ) ( *Vf ) {
+	for _, v := range s.Vfs {
+		if v.Vfid == vfid && strings.EqualFold( v.Pf, pciid ) {
+			return v
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,158 @@
+// vi: sw=4 ts=4:
+/*
+	Mnemonic:	vfdshow_test.go
+	Abstract:	Tests for the show parser. The fixtures follow the layout of iplex
+				show output: the column heading, leading white space, pf rows and
+				the vf rows of each pf, blank separator lines, and the vlans/macs
+				lines. They are written by hand (no VFd host was available when
+				they were made), and are the msg field of the response as tokay
+				receives it (an array of strings, some with embedded newlines).
+				Output captured from a real VFd should be added as further
+				fixtures rather than replacing these.
+
+	Date:		18 October 2026
+*/
+
+package vfdshow
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+const show_all = `[
+	"      PF/VF  ID    PCIID           Link      Speed     Duplex    RX pkts   RX bytes  RX errors RX dropped   TX pkts   TX bytes  TX errors  Spoofed",
+	"      pf     0     0000:08:00.0    UP        10000     FD        1289733   93542117          0          0    104230    8893120          0        0",
+	"      vf     0     0000:08:00.0    UP        10000     FD          43177    3012090          0          0     41830    2879220          0        0\n      vlans: 10,11\n      macs: fa:16:3e:3c:1f:0a",
+	"      vf     1     0000:08:00.0    DOWN      10000     FD              0          0          0          0         0          0          0        3",
+	"",
+	"      pf     1     0000:08:00.1    UP        10000     FD         802119   61004339          2          0     99871    7200131          0        0",
+	"      vf     0     0000:08:00.1    UP        10000     FD          11002     704128          0          0     10987     703168          0        0\n      vlans: 10 11 12\n      macs: fa:16:3e:3c:1f:0b, fa:16:3e:3c:1f:0c",
+	""
+]`
+
+const show_pfs = `[
+	"      PF/VF  ID    PCIID           Link      Speed     Duplex    RX pkts   RX bytes  RX errors RX dropped   TX pkts   TX bytes  TX errors  Spoofed",
+	"      pf     0     0000:08:00.0    UP        10000     FD        1289733   93542117          0          0    104230    8893120          0        0",
+	"      pf     1     0000:08:00.1    DOWN      0         HD              0          0          0          0         0          0          0        0"
+]`
+
+// a single string rather than an array; Lines accepts either
+const show_one = `"      PF/VF  ID    PCIID           Link      Speed     Duplex    RX pkts   RX bytes  RX errors RX dropped   TX pkts   TX bytes  TX errors  Spoofed\n      vf     3     0000:08:00.0    UP        10000     FD            512      32768          0          0       511      32704          0        0\n      vlans: 100\n      macs: \n      strip_stag: true\n"`
+
+func TestShowAll( t *testing.T ) {
+	s := Parse( Lines( json.RawMessage( show_all ) ) )
+
+	if len( s.Pfs ) != 2 || len( s.Vfs ) != 3 {
+		t.Fatalf( "expected 2 pfs and 3 vfs, got %d and %d", len( s.Pfs ), len( s.Vfs ) )
+	}
+
+	p := s.Pfs[1]
+	if p.Id != 1 || p.Pciid != "0000:08:00.1" || p.Link != "UP" || p.Speed != "10000" || p.Duplex != "FD" {
+		t.Errorf( "pf 1 row not parsed: %+v", p )
+	}
+	if p.Counters["rx_pkts"] != 802119 || p.Counters["rx_errors"] != 2 || p.Counters["tx_bytes"] != 7200131 {
+		t.Errorf( "pf 1 counters wrong: %v", p.Counters )
+	}
+
+	v := s.Find_vf( "0000:08:00.0", 0 )
+	if v == nil {
+		t.Fatalf( "vf 0 on 0000:08:00.0 not found" )
+	}
+	if len( v.Vlans ) != 2 || v.Vlans[0] != 10 || v.Vlans[1] != 11 {
+		t.Errorf( "vf 0 vlans wrong: %v", v.Vlans )
+	}
+	if len( v.Macs ) != 1 || v.Macs[0] != "fa:16:3e:3c:1f:0a" {
+		t.Errorf( "vf 0 macs wrong: %v", v.Macs )
+	}
+
+	v = s.Find_vf( "0000:08:00.0", 1 )
+	if v == nil || v.Link != "DOWN" || v.Counters["spoofed"] != 3 {
+		t.Errorf( "vf 1 on 0000:08:00.0 wrong: %+v", v )
+	}
+	if v != nil && ( v.Vlans != nil || v.Macs != nil ) {
+		t.Errorf( "vf 1 has no vlans/macs lines, but lists were set: %v %v", v.Vlans, v.Macs )
+	}
+
+	v = s.Find_vf( "0000:08:00.1", 0 )
+	if v == nil || len( v.Vlans ) != 3 || len( v.Macs ) != 2 || v.Macs[1] != "fa:16:3e:3c:1f:0c" {
+		t.Errorf( "vf 0 on 0000:08:00.1 wrong: %+v", v )
+	}
+}
+
+func TestShowPfs( t *testing.T ) {
+	s := Parse( Lines( json.RawMessage( show_pfs ) ) )
+
+	if len( s.Pfs ) != 2 || len( s.Vfs ) != 0 {
+		t.Fatalf( "expected 2 pfs and no vfs, got %d and %d", len( s.Pfs ), len( s.Vfs ) )
+	}
+	if s.Pfs[1].Link != "DOWN" || s.Pfs[1].Duplex != "HD" {
+		t.Errorf( "pf 1 row not parsed: %+v", s.Pfs[1] )
+	}
+}
+
+func TestShowOne( t *testing.T ) {
+	s := Parse( Lines( json.RawMessage( show_one ) ) )
+
+	v := s.Find_vf( "0000:08:00.0", 3 )
+	if v == nil {
+		t.Fatalf( "vf 3 not found in %+v", s )
+	}
+	if len( v.Vlans ) != 1 || v.Vlans[0] != 100 {
+		t.Errorf( "vlans wrong: %v", v.Vlans )
+	}
+	if v.Macs == nil || len( v.Macs ) != 0 {
+		t.Errorf( "an empty macs line should give an empty list: %v", v.Macs )
+	}
+	if v.Attrs["strip_stag"] != "true" {
+		t.Errorf( "name: value line not kept: %v", v.Attrs )
+	}
+}
+
+/*
+	To_json builds the parsed field of a show response.
+*/
+func TestParsedField( t *testing.T ) {
+	pj, err := To_json( json.RawMessage( show_all ) )
+	if err != nil {
+		t.Fatalf( "unexpected error: %s", err )
+	}
+
+	var parsed struct {
+		Pfs	[]struct {
+			Id		int		`json:"id"`
+			Pciid	string	`json:"pciid"`
+		}					`json:"pfs"`
+		Vfs	[]struct {
+			Pf			string				`json:"pf"`
+			Vfid		int					`json:"vfid"`
+			Vlans		[]int				`json:"vlans"`
+			Macs		[]string			`json:"macs"`
+			Counters	map[string]int64	`json:"counters"`
+		}					`json:"vfs"`
+	}
+	if err := json.Unmarshal( pj, &parsed ); err != nil {
+		t.Fatalf( "parsed field isn't valid json: %s: %s", err, pj )
+	}
+	if len( parsed.Pfs ) != 2 || len( parsed.Vfs ) != 3 {
+		t.Fatalf( "expected 2 pfs and 3 vfs in %s", pj )
+	}
+	if parsed.Vfs[2].Pf != "0000:08:00.1" || len( parsed.Vfs[2].Vlans ) != 3 || parsed.Vfs[2].Counters["tx_pkts"] != 10987 {
+		t.Errorf( "vf 0 on 0000:08:00.1 wrong in %s", pj )
+	}
+
+	for _, msg := range []string { `[ "VFd is unable to find vf 7" ]`, `""`, `{ "not": "a list" }` } {
+		if pj, err := To_json( json.RawMessage( msg ) ); err == nil {
+			t.Errorf( "expected an error for %s, got %s", msg, pj )
+		}
+	}
+}
+
+func TestHeadersSkipped( t *testing.T ) {
+	lines := strings.Split( "PF/VF  ID    PCIID\npf  ID  PCIID\nvf\nname: orphan", "\n" )
+	s := Parse( lines )
+	if len( s.Pfs ) != 0 || len( s.Vfs ) != 0 {
+		t.Errorf( "headings or short rows were taken as rows: %+v", s )
+	}
+}
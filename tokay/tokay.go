@@ -20,25 +20,33 @@ package main
 
 import (
 	"bytes"
-	"bufio"
+	"encoding/json"
 	"fmt"
 	"flag"
 	"os"
-	"os/exec"
+	"sort"
 	"strings"
 	"sync"
-	"syscall"
 	"time"
 
 	"github.com/att/gopkgs/ipc"				// for tickler
 	"github.com/streadway/amqp"				// underlying rabbit interface (3rd party)
 	"github.com/att/gopkgs/bleater"
 	"github.com/att/gopkgs/jsontools"
-	"github.com/att/gopkgs/rabbit_hole"		// rabbit MQ things
+	"github.com/att/gopkgs/rabbit_hole"		// rabbit MQ things (message struct)
 	"github.com/att/gopkgs/config"			// config file parsing
 	"github.com/att/gopkgs/uuid"			// uuid string generator
 
+	"github.com/att/vfd.gaol/tokay/lib/broker"		// rabbit, or in memory for self test
+	"github.com/att/vfd.gaol/tokay/lib/cfgstore"	// index of the vf configs we've written
 	"github.com/att/vfd.gaol/tokay/lib/chcom"		// channel comm structs (req/resp)
+	"github.com/att/vfd.gaol/tokay/lib/eom"			// framing of VFd responses
+	"github.com/att/vfd.gaol/tokay/lib/inflight"	// per target request tracking
+	"github.com/att/vfd.gaol/tokay/lib/reconcile"	// desired vs live comparison
+	"github.com/att/vfd.gaol/tokay/lib/throttle"	// rate limiting
+	"github.com/att/vfd.gaol/tokay/lib/vfcfg"		// vf config operations
+	"github.com/att/vfd.gaol/tokay/lib/vfdlink"		// transport to/from VFd
+	"github.com/att/vfd.gaol/tokay/lib/vfdshow"		// parsing of VFd show output
 )
 
 const (
@@ -47,6 +55,10 @@ const (
 	FL_forreal	
 )
 
+const (
+	sub_timeout	time.Duration = 60 * time.Second		// max wait for a response to a request we submitted to the serialiser
+)
+
 var (
 	version string
 )
@@ -58,13 +70,38 @@ type context struct {
 	flags		uint				// FL_constants
 	wg 			*sync.WaitGroup 
 	synch_ch	chan *chcom.Request	// channel that the serialiser listens to
+	lowpri_ch	chan *chcom.Request	// low priority requests; serialiser reads only when synch_ch is empty
 	resp_ch		chan interface{}	// channel the responder listens to
 	req_fifo	 string				// request fifo that VFd is listening on
 	resp_fifo	string				// fifo VFd will write reqsponses to
+	max_resp	int					// max size of a response from VFd
+	resp_timeout int64				// seconds to wait for VFd to respond
+	resp_grace	int64				// seconds a timed out request keeps its target in case VFd is still working on it
+	transport	string				// description of the link to VFd for messages
+	link		vfdlink.Link		// the link to VFd (fifo pair or socket)
 	cdir		string				// configuration directory where .json files are placed for VFd to parse
+	store		*cfgstore.Store		// what we've written to cdir and what VFd did with it
+	tpolicy		*vfcfg.Name_policy	// what is allowed in a target name
 	sid			string				// our unique sender id
+	inflight	*inflight.Tracker	// tracks the request in flight for each target
+	reject_conflicts bool			// reject, rather than queue, requests for a target that is busy
+	rpc_replies	bool				// send responses to the reply-to queue of requests which give one
+	vfd_update	bool				// VFd supports update; if false an update is done as delete+add
+	recon_ivl	int					// seconds between periodic reconciliations (0 == off)
+	recon_converge bool				// periodic reconciliation also corrects differences
+	stats_ivl	int					// seconds between stats collections (0 == off)
+	stats_exch	string				// exchange stats are written to (name:type+attrs:key)
+	events_exch	string				// exchange events are written to (empty == off)
+	events_ch	chan interface{}	// the events writer's port (nil if events are off)
+	hb_ivl		int					// seconds between VFd heartbeat pings (0 == off)
+	sender_limit *throttle.Limiter	// rate limits by sender, AMQP user and source exchange (nil if not limited)
+	user_limit	*throttle.Limiter
+	exch_limit	*throttle.Limiter
 
 									// things needed for writer
+	broker		broker.Broker		// rabbit (or the in memory stand-in)
+	rpc_broker	broker.Broker		// broker able to send reply-to responses (nil to use exch_key for everything)
+	rpc_ch		chan interface{}	// port of the reply-to writer; nil if rpc replies are off
 	wr_exch		string				// exchange string for writing (name:type+attrs:key)
 	qhost		string
 	qport		string				// port RMQ listens on
@@ -89,6 +126,93 @@ func gen_sender_id() ( sid string ) {
 	return fmt.Sprintf( "%s_%d", h, p )
 }
 
+/*
+	Returns true if the action changes the state of a VF and thus must be
+	ordered with any other such request for the same target.
+*/
+func is_vf_op( action string ) ( bool ) {
+	switch action {
+		case "add", "del", "delete", "update":
+			return true						// a user's update holds the target for all of its steps (see run_update)
+	}
+
+	return false
+}
+
+/*
+	Returns true if the action uses the target as a config file name.
+*/
+func names_file( action string ) ( bool ) {
+	switch action {
+		case "add", "del", "delete", "update", "get":
+			return true
+	}
+
+	return false
+}
+
+/*
+	Release the target held by the request that the response block belongs to.
+	If another request was queued behind it, that request is resubmitted to the
+	serialiser. The send is done by a goroutine as this is called by the responder
+	and we must not block it if the serialiser's channel is full.
+*/
+func release_target( ctx *context, resp *chcom.Response, sheep *bleater.Bleater ) {
+	if resp == nil || resp.Req == nil || resp.Req.Jtree == nil {
+		return
+	}
+
+	target := resp.Req.Jtree.Get_string( "target" )
+	if target == nil {
+		return
+	}
+
+	release_claim( ctx, *target, resp.Rid, sheep )
+}
+
+/*
+	Release the target if rid holds it, resubmitting the next queued request if
+	there is one. See release_target.
+*/
+func release_claim( ctx *context, target string, rid string, sheep *bleater.Bleater ) {
+	next := ctx.inflight.Release( target, rid )
+	if next != nil {
+		sheep.Baa( 2, "target %s released; resubmitting queued request: %s", target, next.Rid )
+		go func() {
+			ctx.synch_ch <- next
+		}()
+	}
+}
+
+/*
+	Claim each target for rid so that nothing else can act on them while a request
+	made up of several steps runs (the steps are submitted with rid as their owner).
+	Targets are claimed in sorted order so that two such requests can't each hold
+	a target the other is waiting for. A busy target is waited for, unless conflicts
+	are rejected or it is still busy after the sub-request timeout; then the targets
+	already claimed are released and the busy one is returned. The empty string is
+	returned when all are held.
+*/
+func claim_targets( ctx *context, targets []string, rid string, sheep *bleater.Bleater ) ( busy string ) {
+	sorted := append( []string( nil ), targets... )
+	sort.Strings( sorted )
+
+	for i, target := range sorted {
+		deadline := time.Now().Add( sub_timeout )
+		for ! ctx.inflight.Claim( target, rid ) {
+			if ctx.reject_conflicts || time.Now().After( deadline ) {
+				for _, t := range sorted[:i] {
+					release_claim( ctx, t, rid, sheep )
+				}
+				return target
+			}
+			time.Sleep( 100 * time.Millisecond )
+		}
+	}
+
+	return ""
+}
+
 /*
 	Build a buffer with a response json that will be sent to the requestor. Has
 	the form:
@@ -119,47 +243,67 @@ func build_response( sender string, state string, msg string, msg_key string, da
 }
 
 /*
-	Open a fifo for receiving responses back from VFd.
-	Pipe opens block until there is a writer.
+	Build a response for a show request. This is the same as build_response, but
+	with a parsed field which has the structured form of VFd's show output.
+	Parsed is json, and when empty the response is exactly what build_response
+	generates.
 */
-func mk_fifo( fname string ) ( fifo *os.File, err error ) {
-	var errbuf bytes.Buffer
+func build_show_response( sender string, state string, msg string, msg_key string, data *jsontools.Jtree, parsed []byte ) ( jresp string ) {
+	if len( parsed ) == 0 || data == nil {
+		return build_response( sender, state, msg, msg_key, data )
+	}
 
-	fifo, err = os.OpenFile( fname, syscall.O_RDWR, 0664 )		 		// crack it open if there; in rw mode to prevent blocking
-	if err == nil {
-		return fifo, nil
+	if state == "" {
+		state = "OK"
+	}
+
+	return fmt.Sprintf( `{ "sender": %q, "state": %q, "msg": %q, "msg_key": %q, "data": %s, "parsed": %s }`, sender, state, msg, msg_key, data.Frock(), parsed )
+}
+
+/*
+	If the response block is for a show request, parse the msg field of VFd's
+	response (raw json in blob) and return the structured json. Nil is returned
+	for other requests, or if nothing in the output was recognised.
+*/
+func parse_show( resp *chcom.Response, blob []byte ) ( []byte ) {
+	var vresp struct {
+		Msg		json.RawMessage		`json:"msg"`
+	}
+
+	if resp.Req == nil || resp.Req.Jtree == nil {
+		return nil
+	}
+	if action := resp.Req.Jtree.Get_string( "action" ); action == nil || *action != "show" {
+		return nil
 	}
 
-	err = syscall.Mkfifo( fname, 0660 )									// this is only supported on FreeBSD; if it fails we'll resort to external command
-	if err == nil  {
-		return os.OpenFile( fname, syscall.O_RDWR, 0664 )		 		// crack it open if there; in rw mode to prevent blocking
+	if json.Unmarshal( blob, &vresp ) != nil || len( vresp.Msg ) == 0 {
+		return nil
 	}
 
-	cmd := exec.Command( "mkfifo", "--mode=0666", fname )
-	cmd.Stdout = &errbuf
-	err = cmd.Run()
+	parsed, err := vfdshow.To_json( vresp.Msg )
 	if err != nil {
-		return nil, fmt.Errorf( "unable to create fifo: %s: %s", fname, err )
+		return nil
 	}
 
-	return os.OpenFile( fname, syscall.O_RDWR, 0664 )		 		// crack it open if there; in rw mode to prevent blocking
+	return parsed
 }
 
-
 /*
 	Start a writer into the target rabbit and return the struct needed to make 
-	use of it.
+	use of it. Wr_exch is the exchange string (name:type+attrs:key); if empty
+	the default response exchange is used.
 
 	NOTE: caller should call defer w.close() to ensure proper clean up when
 		their function exits.
 */
-func start_rmq_writer( ctx *context, sheep *bleater.Bleater ) ( w *rabbit_hole.Mq_writer ) {
+func start_rmq_writer( ctx *context, wr_exch string, sheep *bleater.Bleater ) ( w broker.Writer ) {
 	key := "response"											// default key, needed to create but we will likely never use it
 	etype := "direct+ad+!du"									// default type
 	exch := "tokay_resp"											// default exchange name
 
-	if ctx.wr_exch != ""  {
-		tokens := strings.Split( ctx.wr_exch, ":" )				// exchange-name:type+attrs:key
+	if wr_exch != ""  {
+		tokens := strings.Split( wr_exch, ":" )				// exchange-name:type+attrs:key
 		switch len( tokens ) {
 			case 3:
 				key = tokens[2]
@@ -178,24 +322,117 @@ func start_rmq_writer( ctx *context, sheep *bleater.Bleater ) ( w *rabbit_hole.M
 		}
 	}
 
-	sheep.Baa( 2, "attaching writer to %s@%s:%s ex=%s etype=%s key=%s", ctx.uname, ctx.qhost, "5672", exch, etype, key )
-	w, err := rabbit_hole.Mk_mqwriter( ctx.qhost, ctx.qport, ctx.uname, ctx.pw, exch, etype, &key )
+	sheep.Baa( 2, "attaching writer to %s ex=%s etype=%s key=%s", ctx.broker, exch, etype, key )
+	w, err := ctx.broker.Mk_writer( exch, etype, &key )
 	if err != nil {
-		sheep.Baa(  0, "abort: unable to attach a writer to %s %s: %s\n", ctx.qhost, exch, err )
+		sheep.Baa(  0, "abort: unable to attach a writer to %s %s: %s\n", ctx.broker, exch, err )
 		os.Exit( 1 )
 	}
-	sheep.Baa( 1, "writer attached to %s@%s:%s ex=%s etype=%s key=%s", ctx.uname, ctx.qhost, "5672", exch, etype, key )
+	sheep.Baa( 1, "writer attached to %s ex=%s etype=%s key=%s", ctx.broker, exch, etype, key )
 	w.Start_writer( key )								// start the writer listening for things to write
 
 	return w
 }
 
+/*
+	Record the outcome of a request that VFd responded to in the config store.
+	Only the actions which change a VF are of interest to the store.
+*/
+func record_result( ctx *context, resp *chcom.Response, state *string, sheep *bleater.Bleater ) {
+	if resp == nil || resp.Req == nil || resp.Req.Jtree == nil {
+		return
+	}
+
+	action := resp.Req.Jtree.Get_string( "action" )
+	target := resp.Req.Jtree.Get_string( "target" )
+	if action == nil || target == nil || ! is_vf_op( *action ) {
+		return
+	}
+
+	err := ctx.store.Result( *target, *action, state != nil && *state == "OK" )
+	if err != nil {
+		sheep.Baa( 0, "WRN: unable to save config store index: %s", err )
+	}
+}
+
+/*
+	Build the json for a list or get request from the config store. For list, all
+	targets and their status are returned; for get, the entry for the target,
+	including the config, is returned. Ok is false if the target is not known.
+*/
+func store_info( ctx *context, action string, target *string ) ( data *jsontools.Jtree, ok bool ) {
+	var jbuf []byte
+
+	if action == "list" {
+		jbuf, _ = json.Marshal( struct {
+			Configs []cfgstore.Entry	`json:"configs"`
+		} { ctx.store.List() } )
+	} else {
+		if target == nil {
+			return nil, false
+		}
+
+		e, found := ctx.store.Get( *target )
+		if ! found {
+			return nil, false
+		}
+		jbuf, _ = json.Marshal( e )
+	}
+
+	data, err := jsontools.Json2tree( jbuf )
+	return data, err == nil
+}
+
+/*
+	Check the request against the configured rate limits. If any limit is exceeded
+	a short description of the offending key is returned; the empty string is
+	returned if the request may be queued. A request which is rejected doesn't
+	use up any allowance: tokens taken from the limits checked before the one
+	which said no are given back.
+
+	The sender limit is advisory: the sender comes from the request body and a
+	requestor can put anything there. The user limit is keyed on the AMQP user id
+	which rabbit validates, so it is the one to rely on.
+*/
+func throttled( ctx *context, req *chcom.Request ) ( why string ) {
+	sender := "unknown"								// same default the serialiser uses
+	if s := req.Jtree.Get_string( "sender" ); s != nil {
+		sender = *s
+	}
+
+	limits := []struct {
+		l		*throttle.Limiter
+		key		string
+		what	string
+		skip	bool
+	} {
+		{ ctx.sender_limit, sender, "sender ", false },
+		{ ctx.user_limit, req.User, "user ", req.User == "" },		// publisher didn't set a user id; nothing to limit on
+		{ ctx.exch_limit, req.Source, "exchange ", false },
+	}
+	for i, lim := range limits {
+		if lim.skip {
+			continue
+		}
+		if ! lim.l.Allow( lim.key ) {
+			for _, taken := range limits[:i] {
+				if ! taken.skip {
+					taken.l.Refund( taken.key )
+				}
+			}
+			return lim.what + lim.key
+		}
+	}
+
+	return ""
+}
+
 /*
 	One collector is started for each exchange that we're listening to.  This unpacks the json received and
 	passes the map to the goroutine that serialises the requests to VFd. If the jdump option was 
 	on in the config file then we dump the raw json to the log in additon to passing it on.
 */
-func collector( ctx *context, ch_name string, rdr *rabbit_hole.Mq_reader, master_sheep *bleater.Bleater ) {
+func collector( ctx *context, ch_name string, rdr broker.Reader, master_sheep *bleater.Bleater ) {
 
 	rh_ch := make( chan amqp.Delivery, 4096 )			// our listen channel
 	count := 0
@@ -207,7 +444,11 @@ func collector( ctx *context, ch_name string, rdr *rabbit_hole.Mq_reader, master
 
 	sheep.Baa( 1, "reading from %s", ch_name )
 
-	rdr.Start_eating( rh_ch )
+	if err := rdr.Start_eating( rh_ch ); err != nil {
+		sheep.Baa( 0, "ERR: unable to start reading from %s: %s", ch_name, err )
+		ctx.wg.Done()
+		return
+	}
 	for {
 		select {
 			case msg := <- rh_ch:						// wait for next msg from rabbit hole
@@ -238,14 +479,25 @@ func collector( ctx *context, ch_name string, rdr *rabbit_hole.Mq_reader, master
 						req := &chcom.Request {
 							Resp_ch:	ctx.rmqw_ch,				// channel where responses are expected to be sent back to rmq
 							Source:		ch_name,
+							User:		msg.UserId,					// set only if the publisher supplied it (rabbit validates it)
 							Exch_key:	*exch_key,					// user's exchange level key expected to be used in the rabbit message
 							Msg_key:	*msg_key,					// user's disambiguation key
 							Rid:		uuid.NewRandom().String(),	// generate a random uuid that we'll send in to avoid dupolication if multiple users send concurrent requests
 							Single_use:	false,						// our response channel is multi use and should not be closed
 						}
+						if msg.ReplyTo != "" && ctx.rpc_ch != nil {	// rpc style request; the response goes to the reply queue with the correlation id
+							req.Resp_ch = ctx.rpc_ch
+							req.Reply_to = msg.ReplyTo
+							req.Corr_id = msg.CorrelationId
+						}
 
 						req.Jtree = jt
-						ctx.synch_ch <- req							// send the request on to serialisation
+						if why := throttled( ctx, req ); why == "" {
+							ctx.synch_ch <- req						// send the request on to serialisation
+						} else {
+							sheep.Baa( 2, "request throttled: rate limit exceeded for %s msg_key=%s", why, req.Msg_key )
+							send_response( req, build_response( ctx.sid, "THROTTLED", "rate limit exceeded: " + why, req.Msg_key, nil ) )		// respond now; it never goes to the serialiser
+						}
 					} else {
 						sheep.Baa( 1, "no exec mode set, RMQ message ignored (%d bytes)", len( msg.Body ) )
 					}
@@ -263,29 +515,23 @@ func collector( ctx *context, ch_name string, rdr *rabbit_hole.Mq_reader, master
 
 /*
 	Save VF configuration data in the config file. The file is named id.json.
-	Returns the filename written to (success only) or error.
+	The file is replaced atomically so VFd never reads a partial config.
+	Returns the filename written to and the checksum of the contents (success
+	only) or error.
 */
-func stash_vf_cfg( ctx *context, id *string, config *string ) ( fname string, err error ) {
+func stash_vf_cfg( ctx *context, id *string, config *string ) ( fname string, csum string, err error ) {
 
-	fname = fmt.Sprintf( "%s/%s.json", ctx.cdir, *id )
-	f, err := os.Create( fname )		// create; truncate if it exists
-	if err != nil {
-		return "", err
+	if err = ctx.tpolicy.Check( *id ); err != nil {		// serialiser should have vetted, but never write outside of cdir
+		return "", "", err
 	}
-	defer f.Close( )	
 
-	buffer := []byte( *config )			// the config in writable form
-	
-	for remain := len( buffer ) ; remain > 0; {
-		n, err := f.Write( buffer )
-		if err != nil {
-			return "", err
-		}
-
-		remain -= n;
+	fname = fmt.Sprintf( "%s/%s.json", ctx.cdir, *id )
+	csum, err = cfgstore.Write_atomic( fname, []byte( *config ), 0644 )
+	if err != nil {
+		return "", "", err
 	}
 
-	return fname, nil
+	return fname, csum, nil
 }
 
 /*
@@ -294,13 +540,14 @@ func stash_vf_cfg( ctx *context, id *string, config *string ) ( fname string, er
 			action: add|del|Dump|mirror|ping|verbose|show
 			params: {
 				filename:	<json filename> 		#for add/del
+				checksum:	sha256:<hex>			# checksum of the file contents when we wrote it (add/update)
 				resource:	<request data>			# all for show all etc.
 				r_fifo:		<response-fifo-name>
 				vfd_rid:	<response key>			# our key to match VFd response with a pending block
 			}
 		}
 */
-func mk_vfd_request( action string, fname *string, data *string, fifo string, key *string  ) ( string )  {
+func mk_vfd_request( action string, fname *string, csum *string, data *string, fifo string, key *string  ) ( string )  {
 	s := "{ "
 
 	s += fmt.Sprintf( `"action": %q,`, action )
@@ -309,6 +556,9 @@ func mk_vfd_request( action string, fname *string, data *string, fifo string, ke
 		if fname != nil {
 			s += fmt.Sprintf( ` "filename": %q,`, *fname )
 		}
+		if csum != nil {
+			s += fmt.Sprintf( ` "checksum": %q,`, *csum )
+		}
 		if data != nil {
 			s += fmt.Sprintf( ` "resource": %q,`, *data )
 		}
@@ -335,8 +585,18 @@ func mk_vfd_request( action string, fname *string, data *string, fifo string, ke
 				add:  well formed json passed in some shape or form to VFd (NOT a string!!)
 				del:  empty
 				show: all | pf
+				batch: array of add/delete/show requests (see run_batch)
+				transaction: array of add requests applied all or nothing (see run_transaction)
+				update: well formed json, the complete new config for the target (see run_update)
+				list: empty; returns the configs tokay has written and their status
+				get: empty; returns the stored config and status for the target
+				reconcile: optional desired state and converge flag (see run_reconcile)
 		}
 
+		If the AMQP message carried a reply-to queue (and reply_to is on in the config),
+		the response is sent to that queue on the default exchange with the message's
+		correlation id, and exch_key is not used.
+
 		The vfd_req is frocked and then is passed 'as is' to VFd via the config file. 
 		is written to a config file and the name of the file is passed inside of a 
 		small request on the fifo. The id is the action id; e.g. the virtualisation 
@@ -345,6 +605,10 @@ func mk_vfd_request( action string, fname *string, data *string, fifo string, ke
 		If it is missing then we assume the sender isn't listening for a response and 
 		won't send one. We will, however, create a dummy id so that the response back 
 		from VFd can be matched and logged. 
+
+		Add and delete requests are ordered per target: if a request for the target
+		is still in flight, the new request is either held until the in-flight one
+		completes, or rejected with a CONFLICT state (conflict_mode in the config).
 */
 func serialiser( ctx *context, master_sheep *bleater.Bleater ) {
 
@@ -353,16 +617,18 @@ func serialiser( ctx *context, master_sheep *bleater.Bleater ) {
 	master_sheep.Add_child( sheep )												// add to the caller's sheep tree (should force to target file if opened by perent)
 	sheep.Baa( 1, "serialiser is running" )
 
-	fifo, err := os.OpenFile( ctx.req_fifo, syscall.O_RDWR, 0664 )	 			// crack open the pipe to VFd (read/write so we don't block)
-	if err != nil {
-		sheep.Baa( 0, "abort: unable to open request fifo: %s: %s", ctx.req_fifo, err )
-		os.Exit( 1 )
-	}
-	defer fifo.Close( )
-	sheep.Baa( 1, "writing requests to VFd via: %s", ctx.req_fifo )
+	sheep.Baa( 1, "writing requests to VFd via: %s", ctx.transport )
 
 	for {
-		req := <- ctx.synch_ch			// wait for next message (formatted into jtree struct)
+		var req *chcom.Request
+		select {
+			case req = <- ctx.synch_ch:			// next message (formatted into jtree struct); always take these first
+			default:
+				select {						// nothing waiting; block on both
+					case req = <- ctx.synch_ch:
+					case req = <- ctx.lowpri_ch:
+				}
+		}
 
 		sheep.Baa( 1, "processing request from: %s exch_key=%s msg_key=%s", req.Source, req.Exch_key, req.Msg_key )
 
@@ -390,10 +656,37 @@ func serialiser( ctx *context, master_sheep *bleater.Bleater ) {
 		vfd_rid := &req.Rid								// the id we use to track message/response between us and VFd
 		action := req.Jtree.Get_string( "action" )		// what exactly the requestor desires (add, del, show...)
 		target := req.Jtree.Get_string( "target" )		// what we're acting on, or how we're acting (e.g. filename)
-		resp.Rdata = build_response( ctx.sid, "ERROR", "request timeout", resp.Msg_key, nil )		// default message when waiting; possibly overwritten below
+		resp.Rdata = build_response( ctx.sid, "TIMEOUT", "request timeout", resp.Msg_key, nil )		// default message when waiting; possibly overwritten below
 
 		if action != nil {
 			sheep.Baa( 2, "processing action: %s from %s", *action, *sender )
+			local_resp := false						// set when the response is built here and nothing goes to VFd
+
+			if target != nil && names_file( *action ) {
+				if err := ctx.tpolicy.Check( *target ); err != nil {		// target is used to build a file name; don't let it wander
+					sheep.Baa( 1, "%s request rejected: %s", *action, err )
+					resp.Rdata = build_response( ctx.sid, "INVALID", fmt.Sprintf( "request dropped: %s", err ), *msg_key, nil )
+					ctx.resp_ch <- resp
+					continue
+				}
+			}
+
+			claim_rid := *vfd_rid
+			if req.Owner != "" {
+				claim_rid = req.Owner										// a step of a request which already holds the target
+			}
+			if target != nil && is_vf_op( *action ) && ! ctx.inflight.Claim( *target, claim_rid ) {		// another request for the target is in flight
+				if ctx.reject_conflicts {
+					sheep.Baa( 1, "conflict: %s for target %s rejected; target has a request in flight", *action, *target )
+					resp.Rdata = build_response( ctx.sid, "CONFLICT", fmt.Sprintf( "target has a request in flight: %s", *target ), *msg_key, nil )
+					ctx.resp_ch <- resp
+				} else {
+					ctx.inflight.Hold( *target, req )
+					sheep.Baa( 1, "target busy: %s for target %s queued (%d waiting)", *action, *target, ctx.inflight.Held( *target ) )
+				}
+				continue
+			}
+
 			reason := ""
 			fifo_buffer = ""						// assume nothing to be written onto the fifo
 
@@ -402,11 +695,24 @@ func serialiser( ctx *context, master_sheep *bleater.Bleater ) {
 	
 				case "ping", "dump":				// any action that doesn't have parms is simple
 					sheep.Baa( 1, "sending %s", *action )
-					fifo_buffer = mk_vfd_request( *action, nil, nil, ctx.resp_fifo, vfd_rid )
+					fifo_buffer = mk_vfd_request( *action, nil, nil, nil, ctx.resp_fifo, vfd_rid )
 
 				case "Ping":								// internal ping to us, not passed to VFd. build a simple version reqponse to show that the path into this funciton and back works
 					sheep.Baa( 1, "responding to Ping: %s", *exch_key )
 					resp.Rdata = fmt.Sprintf( `{ "sender": %q, "state": "OK", "msg_key": "%s", "msg": [ "Pong: %s" ] }`, ctx.sid, *msg_key, version )
+					local_resp = true
+
+				case "list", "get":										// config store queries; answered by us, no trip to VFd
+					if data, ok := store_info( ctx, *action, target ); ok {
+						resp.Rdata = build_response( ctx.sid, "OK", "", *msg_key, data )
+						local_resp = true
+					} else {
+						if target == nil {
+							reason = "no target field in request"
+						} else {
+							reason = "no config stored for target: " + *target
+						}
+					}
 					
 					
 				case "add":
@@ -414,11 +720,14 @@ func serialiser( ctx *context, master_sheep *bleater.Bleater ) {
 						data, ok := req.Jtree.Get_subtree( "req_data" )			// data for this is the stuff we dump into the vf config; it is _real_ json in the request, not a string
 						if ok {
 							vfconfig_str := data.Frock()								// the config for the VF; it's json, so frock it into a string
-							fname, err := stash_vf_cfg( ctx, target, &vfconfig_str )	// write the json config info into config directory where VFd can eat it
+							fname, csum, err := stash_vf_cfg( ctx, target, &vfconfig_str )	// write the json config info into config directory where VFd can eat it
 							if err == nil {
 								sheep.Baa( 1, "sending add request stashed in config file: %s", fname )
+								if err = ctx.store.Stashed( *target, fname, []byte( vfconfig_str ) ); err != nil {
+									sheep.Baa( 0, "WRN: unable to save config store index: %s", err )
+								}
 
-								fifo_buffer = mk_vfd_request( "add", &fname, nil, ctx.resp_fifo, vfd_rid )		// we just send in the file name
+								fifo_buffer = mk_vfd_request( "add", &fname, &csum, nil, ctx.resp_fifo, vfd_rid )		// we just send in the file name and its checksum
 							} else {
 								reason = "unable to update config: %s" +  fmt.Sprintf( "%s", err )
 							}
@@ -435,9 +744,9 @@ func serialiser( ctx *context, master_sheep *bleater.Bleater ) {
 						if fname != "" {
 							sheep.Baa( 1, "sending del request with reference name/id: %s", fname )
 
-							fifo_buffer = mk_vfd_request( "delete", &fname, nil, ctx.resp_fifo, vfd_rid )
+							fifo_buffer = mk_vfd_request( "delete", &fname, nil, nil, ctx.resp_fifo, vfd_rid )
 						} else {
-							reason = "unable to update config: %s" +  fmt.Sprintf( "%s", err )
+							reason = "unable to build config file name"
 						}
 					} else {
 						reason = "no target field in request"
@@ -446,28 +755,73 @@ func serialiser( ctx *context, master_sheep *bleater.Bleater ) {
 				case "mirror":
 					data := req.Jtree.Get_string( "req_data" )			// mirror data is the pf vf direction and target-pf
 					if data != nil {
-						fifo_buffer = mk_vfd_request( *action, nil, data, ctx.resp_fifo, vfd_rid )
+						fifo_buffer = mk_vfd_request( *action, nil, nil, data, ctx.resp_fifo, vfd_rid )
 					} else {
 						reason = "pf/vf/direction/target data missing, or was not a string"
 					}
 
 				case "show":
-					fifo_buffer = mk_vfd_request( *action, nil, target, ctx.resp_fifo, vfd_rid )
+					fifo_buffer = mk_vfd_request( *action, nil, nil, target, ctx.resp_fifo, vfd_rid )
+
+				case "batch":									// sub-requests are pushed back through here; we cannot block so a goroutine manages them
+					sheep.Baa( 1, "starting batch request: %s", *vfd_rid )
+					go run_batch( ctx, req, sheep )
+					continue
+
+				case "transaction":
+					sheep.Baa( 1, "starting transaction: %s", *vfd_rid )
+					go run_transaction( ctx, req, sheep )
+					continue
+
+				case "reconcile":
+					sheep.Baa( 1, "starting reconciliation: %s", *vfd_rid )
+					go run_reconcile( ctx, req, sheep )
+					continue
+
+				case "update":
+					if ! req.Internal {										// user request; run_update will send the steps back through here
+						sheep.Baa( 1, "starting update: %s", *vfd_rid )
+						go run_update( ctx, req, sheep )
+						continue
+					}
+
+					if target != nil {										// VFd update step from run_update
+						data, ok := req.Jtree.Get_subtree( "req_data" )
+						if ok {
+							vfconfig_str := data.Frock()
+							fname, csum, err := stash_vf_cfg( ctx, target, &vfconfig_str )
+							if err == nil {
+								sheep.Baa( 1, "sending update request stashed in config file: %s", fname )
+								if err = ctx.store.Stashed( *target, fname, []byte( vfconfig_str ) ); err != nil {
+									sheep.Baa( 0, "WRN: unable to save config store index: %s", err )
+								}
+								fifo_buffer = mk_vfd_request( "update", &fname, &csum, nil, ctx.resp_fifo, vfd_rid )
+							} else {
+								reason = "unable to update config: " +  fmt.Sprintf( "%s", err )
+							}
+						} else {
+							reason = "no req_data field in request"
+						}
+					} else {
+						reason = "no target field in request"
+					}
 
 				default:
 					reason = "unknown action: " + *action
 			}
 
 			if fifo_buffer != "" {								// buffer to push into the fifo is not empty
-				nw, err := fifo.Write( []byte( fifo_buffer ) )
+				err := ctx.link.Send( []byte( fifo_buffer ) )
 				if err == nil {
 					resp.Wait = true							// request sent, responder should wait for answer
 				} else {
-					sheep.Baa( 0, "attempt to write to fifo failed: n=%d %s", nw, err )
+					sheep.Baa( 0, "attempt to send request to VFd failed: %s", err )
 					resp.Rdata = build_response( ctx.sid, "ERROR", fmt.Sprintf( "unable to send req: %s", err ), *msg_key, nil )
 				}
 			} else {
-				resp.Rdata = build_response( ctx.sid, "ERROR", fmt.Sprintf( "request dropped: %s", reason ), *msg_key, nil )
+				if ! local_resp {
+					resp.Rdata = build_response( ctx.sid, "ERROR", fmt.Sprintf( "request dropped: %s", reason ), *msg_key, nil )
+				}
 			}
 		} else {
 			sheep.Baa( 1, "no action in request?" )
@@ -484,147 +838,899 @@ func serialiser( ctx *context, master_sheep *bleater.Bleater ) {
 	ctx.wg.Done()				// should not get here
 }
 
-// ------------------- response processing ----------------------------------------------------------------
+// ------------------- compound requests ------------------------------------------------------------------
 /*
-	Opens and listens to the response pipe (fifo) from VFd. When a response message is read
-	it is written onto the responder channel. This function blocks on the fifo, so it
-	shouldn't do anything but just shove the next response along for processing
+	Submit a request that we generated to the serialiser and wait for the response.
+	The request is given a private response channel so the response comes back to
+	us rather than going out to rabbit. The parent is the user's request that caused
+	this one and supplies the source and keys. Internal should be set if the request
+	is a step that the serialiser would not accept directly from a user.
+
+	Returns the state from the response and the response json.  If nothing comes
+	back within the sub-request timeout, the state is TIMEOUT and the json is a
+	response we built.
 */
-func resp_reader( ctx *context, master_sheep *bleater.Bleater ) {
-	var (
-		rerr error
-	)
+func submit_wait( ctx *context, parent *chcom.Request, jt *jsontools.Jtree, internal bool ) ( state string, rdata string ) {
+	return submit_wait_ch( ctx, ctx.synch_ch, parent, jt, internal )
+}
 
-	sheep := bleater.Mk_bleater( 0, os.Stderr )			// a local sheep to label messages
-	sheep.Set_prefix( "resp_reader" )
-	master_sheep.Add_child( sheep )						// add to the caller's sheep tree (should force to target file if opened by perent)
-	sheep.Baa( 1, "resp_reader is running" )
+/*
+	Submit a request on the given serialiser channel and wait for the response. See
+	submit_wait.
+*/
+func submit_wait_ch( ctx *context, synch_ch chan *chcom.Request, parent *chcom.Request, jt *jsontools.Jtree, internal bool ) ( state string, rdata string ) {
+	return submit_step( ctx, synch_ch, parent, jt, internal, "" )
+}
 
-	fifo, err := mk_fifo( ctx.resp_fifo )
-	if err != nil {
-		sheep.Baa( 0, "abort: unable to open response fifo: %s: %s", ctx.resp_fifo, err )
-		os.Exit( 1 )
+/*
+	Submit a request and wait for the response as submit_wait_ch does. If owner is
+	not empty it is the rid of the request which holds the target; the step is
+	allowed to act on the target under that claim (and does not release it).
+*/
+func submit_step( ctx *context, synch_ch chan *chcom.Request, parent *chcom.Request, jt *jsontools.Jtree, internal bool, owner string ) ( state string, rdata string ) {
+	req := &chcom.Request {
+		Resp_ch:	make( chan interface{}, 1 ),		// buffered so the responder never blocks on us
+		Source:		parent.Source,
+		User:		parent.User,
+		Exch_key:	parent.Exch_key,
+		Msg_key:	parent.Msg_key,
+		Rid:		uuid.NewRandom().String(),
+		Single_use:	true,
+		Internal:	internal,
+		Owner:		owner,
+		Jtree:		jt,
 	}
-	defer fifo.Close( )
-	sheep.Baa( 0, "respnse fifo opened: %s", ctx.resp_fifo )
-
-	br := bufio.NewReader( fifo )
 
-	for {
-		jblob := ""
+	synch_ch <- req
 
-		for ; rerr == nil; {
-			rec, rerr := br.ReadString( '\n' )				// we look for the marker string on a line by itself, so separate on newlines
-			if  rerr != nil || rec == "@eom@\n" {			// marker indicates the end
-				break
-			} else {
-				if len( rec ) > 0  {
-					sheep.Baa( 4, "resp_reader: added %d bytes to blob", len( rec ) )
-					jblob += rec + "\n"
-				}
+	select {
+		case stuff := <- req.Resp_ch:
+			if mqm, ok := stuff.( *rabbit_hole.Mq_msg ); ok {
+				rdata = string( mqm.Data )
 			}
-		}
 
-		sheep.Baa( 1, "msg from VFd: %d bytes", len( jblob ) )
-		ctx.resp_ch <- []byte( jblob )
+		case <- time.After( sub_timeout ):
+			return "TIMEOUT", build_response( ctx.sid, "TIMEOUT", "no response to sub-request", parent.Msg_key, nil )
+	}
+
+	state = "ERROR"
+	if rjt, err := jsontools.Json2tree( []byte( rdata ) ); err == nil {
+		if s := rjt.Get_string( "state" ); s != nil {
+			state = *s
+		}
+	} else {
+		rdata = build_response( ctx.sid, "ERROR", "unparsable sub-request response", parent.Msg_key, nil )
 	}
+
+	return state, rdata
 }
 
 /*
-	Listens to a channel for one of two things: 
-		1) json blobs that were received from VFd as responses
-		2) responses from the serialiser which can be:
-			a) ready to send now (error or local info so no request went to VFd)
-			b) waiting for an VFd response blob, so we must queue or match if VFd
-				responded before we got the response block.
+	Build the message for the writer which sends the response to the requestor: a
+	reply to the request's reply-to queue if it gave one, otherwise a message with
+	the user's exchange key.
+*/
+func resp_msg( req *chcom.Request, rdata string ) ( interface{} ) {
+	if req.Reply_to != "" {
+		return &broker.Rpc_msg {
+			Reply_to:	req.Reply_to,
+			Corr_id:	req.Corr_id,
+			Data:		[]byte( rdata ),
+		}
+	}
 
-	When a response is ready to be sent, it is written to the channel
-	that is in the resposne block; this is likely a private RMQ exchange
-	that was connected to when the request was received.
+	return &rabbit_hole.Mq_msg {						// a message that allows us to set the key
+		Data: []byte( rdata ),
+		Key: req.Exch_key,								// user's response id is the key
+	}
+}
 
-	This thread will create a writer into the rabbit environment
-	and write responses on the exchange (config file) using the 
-	request ID as the message key.
+/*
+	Send a response that was built outside of the responder directly to the writer
+	channel in the request.
+*/
+func send_response( req *chcom.Request, rdata string ) {
+	req.Resp_ch <- resp_msg( req, rdata )
+}
 
-	Json that is written to the requestor is:
-		msg_key: <disabmbiguation-key-provided-in-request>
-		data: { <json data from vfd> }
+/*
+	Run a batch request. The req_data field is expected to be an array of requests
+	each with the same action, target and req_data fields as a single request:
+		{
+			action: "batch",
+			stop_on_error: <bool>		(optional; stop processing at the first failure)
+			req_data: [ { action: "add", target: "vm1-eth0", req_data: { ... } }, ... ]
+		}
 
-	The exchange key passed in the requst is placed only in the RMQ header.
+	Only add, delete and show requests may be batched. Each is passed through the
+	serialiser in order, and we wait for its response before sending the next. When
+	all have completed (or one failed and stop_on_error was set) a single response
+	is published which has the result of each item in data.results.
+
+	This must be run as a goroutine as it pushes requests to the serialiser.
 */
-func responder( ctx *context, master_sheep *bleater.Bleater ) {
+func run_batch( ctx *context, req *chcom.Request, sheep *bleater.Bleater ) {
+	var breq struct {
+		Req_data		[]json.RawMessage	`json:"req_data"`
+		Stop_on_error	bool				`json:"stop_on_error"`
+	}
 
-	sheep := bleater.Mk_bleater( 0, os.Stderr )			// a local sheep to label messages
-	sheep.Set_prefix( "responder" )
-	master_sheep.Add_child( sheep )						// add to the caller's sheep tree (should force to target file if opened by perent)
-	sheep.Baa( 1, "responder is running" )
+	err := json.Unmarshal( []byte( req.Jtree.Frock() ), &breq )
+	if err != nil || len( breq.Req_data ) == 0 {
+		send_response( req, build_response( ctx.sid, "ERROR", "request dropped: batch req_data missing, empty or not an array", req.Msg_key, nil ) )
+		return
+	}
 
-	tch := make( chan *ipc.Chmsg, 1 )					// channel for tickles
-	tklr := ipc.Mk_tickler( 2 )
-	tklr.Add_spot( 5, tch, 0, nil, 0 )
+	state := "OK"
+	results := make( []string, 0, len( breq.Req_data ) )
+	nok := 0
+	for i, item := range breq.Req_data {
+		istate := "ERROR"
+		irdata := ""
 
-	pending_resp := make( map[string]*chcom.Response )
-	unmatched := make( map[string][]byte )				// msgs received before we see the response block from serialiser
-	for {
-		var (
-			action *string
-			vfd_rid *string		// response id from anlois
-		)
+		ijt, err := jsontools.Json2tree( item )
+		if err == nil {
+			action := ijt.Get_string( "action" )
+			switch {
+				case action == nil:
+					irdata = build_response( ctx.sid, "ERROR", "no action in batch item", req.Msg_key, nil )
 
-		select {
-			case _ = <-tch:								// a tickle, check for stale requests
-				now := time.Now().Unix()
-				for _, r := range pending_resp {
-					if r.Tstamp < now {
-						rdata := fmt.Sprintf( `{ "sender": %q, "state": "ERROR", "msg_key": %q, "msg": "timeout: no response from VFd" }`, ctx.sid, r.Msg_key )
-						mqm := &rabbit_hole.Mq_msg {				// a message that allows us to set the key
-								Data: []byte( rdata ),
-								Key: r.Exch_key,
-							}
-						r.Req.Resp_ch <- mqm						// just send the immediate response out
+				case *action == "add" || *action == "del" || *action == "delete" || *action == "show":
+					istate, irdata = submit_wait( ctx, req, ijt, false )
 
-						sheep.Baa( 1, "response timed out for request %s", r.Rid )
-						delete( pending_resp, r.Rid )
-					}
-				}
+				default:
+					irdata = build_response( ctx.sid, "ERROR", "action not allowed in a batch: " + *action, req.Msg_key, nil )
+			}
+		} else {
+			irdata = build_response( ctx.sid, "ERROR", fmt.Sprintf( "batch item is not valid json: %s", err ), req.Msg_key, nil )
+		}
 
-			case stuff := <- ctx.resp_ch:							// block and wait for something
-				switch msg := stuff.(type) {
-					case []byte:
-						jtree, err := jsontools.Json2tree( msg ) 			// blob of bytes expected to be json goo; convert it
-						if err == nil {
-							action = jtree.Get_string( "action" )
-							vfd_rid = jtree.Get_string( "vfd_rid" )
-						} else {
-							sheep.Baa( 0, "bad response data from VFd: %s", msg )
-							break
-						}
+		sheep.Baa( 2, "batch %s item %d finished: %s", req.Rid, i, istate )
+		results = append( results, fmt.Sprintf( `{ "index": %d, "state": %q, "response": %s }`, i, istate, irdata ) )
+		if istate == "OK" {
+			nok++
+		} else {
+			state = "ERROR"
+			if breq.Stop_on_error {
+				break
+			}
+		}
+	}
 
-						if vfd_rid != nil && action != nil {
-							switch *action {							// VFd may communicate things other than responses
-								case "response":
-									resp := pending_resp[*vfd_rid]						// see if we have a request that matches
-									if resp != nil {
-										state := jtree.Get_string( "state" )			// pull the state out of the VFd message
-										msg := jtree.Get_string( "msg" )				// if VFd put a string in, we'll pull it up too, but likley an array of strings which we don't promote
-										rbuf := ""
-										if msg == nil {
-											rbuf = build_response( ctx.sid, *state, "", resp.Msg_key, jtree )		// create a response using the user supplied key, and stuffing in the vfd response as data
-										} else {
-											rbuf = build_response( ctx.sid, *state, *msg, resp.Msg_key, jtree )
-										}
+	msg := fmt.Sprintf( "%d of %d batch requests succeeded", nok, len( breq.Req_data ) )
+	data, err := jsontools.Json2tree( []byte( `{ "results": [ ` + strings.Join( results, ", " ) + ` ] }` ) )
+	if err != nil {
+		sheep.Baa( 0, "ERR: unable to build batch response: %s", err )
+		data = nil
+	}
+	sheep.Baa( 1, "batch %s complete: %s", req.Rid, msg )
+	send_response( req, build_response( ctx.sid, state, msg, req.Msg_key, data ) )
+}
 
-										mqm := &rabbit_hole.Mq_msg {					// a message that allows us to set the key
-											Data: []byte( rbuf ),
-											Key: resp.Exch_key,							// user's response id is the key
-										}
-										resp.Req.Resp_ch <- mqm							// send the response to the output channel specified when request sent to serialiser
+/*
+	Run a transaction request: a list of adds which are applied in order. If an add
+	fails, a delete is issued for each target that was already added (most recent
+	first) so that VFd is left as it was before the request.
+		{
+			action: "transaction",
+			req_data: [ { target: "vm1-eth0", req_data: { <vf config> } }, ... ]
+		}
 
-										delete( pending_resp, *vfd_rid )
-										sheep.Baa( 2, "VFd response received, found matching request: vfd_rid=%s", *vfd_rid )
-									} else {
-										sheep.Baa( 1, "VFd response received, matching request not found: vfd_rid=%s", *vfd_rid )
-										unmatched[*vfd_rid] = msg
+	Each item may also have an action field, but it must be add. The items are all
+	vetted before anything is sent to VFd. The response has the targets added, the
+	response for the add which failed (if any), and the result of each rollback
+	delete in data. An add which timed out may yet have been applied by VFd, so
+	its target is deleted in the rollback too.
+
+	All of the targets are claimed before the first add and are held until the
+	rollback (if any) is finished, so no other request for them can run in between.
+	If a target is busy and conflicts are rejected, nothing is done and the state
+	is CONFLICT.
+
+	This must be run as a goroutine as it pushes requests to the serialiser.
+*/
+func run_transaction( ctx *context, req *chcom.Request, sheep *bleater.Bleater ) {
+	var treq struct {
+		Req_data	[]struct {
+			Action		string			`json:"action"`
+			Target		string			`json:"target"`
+			Req_data	json.RawMessage	`json:"req_data"`
+		}	`json:"req_data"`
+	}
+
+	err := json.Unmarshal( []byte( req.Jtree.Frock() ), &treq )
+	if err != nil || len( treq.Req_data ) == 0 {
+		send_response( req, build_response( ctx.sid, "ERROR", "request dropped: transaction req_data missing, empty or not an array of add requests", req.Msg_key, nil ) )
+		return
+	}
+
+	for i, item := range treq.Req_data {						// vet all before we start
+		reason := ""
+		switch {
+			case item.Action != "" && item.Action != "add":
+				reason = "only add is allowed in a transaction: " + item.Action
+
+			case item.Target == "":
+				reason = "no target field"
+
+			case len( item.Req_data ) == 0 || item.Req_data[0] != '{':
+				reason = "req_data missing or not a json object"
+		}
+
+		if reason != "" {
+			send_response( req, build_response( ctx.sid, "ERROR", fmt.Sprintf( "request dropped: transaction item %d: %s", i, reason ), req.Msg_key, nil ) )
+			return
+		}
+	}
+
+	targets := make( []string, 0, len( treq.Req_data ) )
+	for _, item := range treq.Req_data {
+		targets = append( targets, item.Target )
+	}
+	if busy := claim_targets( ctx, targets, req.Rid, sheep ); busy != "" {
+		sheep.Baa( 1, "transaction %s: target %s is busy; nothing was done", req.Rid, busy )
+		send_response( req, build_response( ctx.sid, "CONFLICT", fmt.Sprintf( "target has a request in flight: %s", busy ), req.Msg_key, nil ) )
+		return
+	}
+	release := func( ) {									// before we respond; the requestor may act on the response at once
+		for _, target := range targets {
+			release_claim( ctx, target, req.Rid, sheep )
+		}
+	}
+	step := func( jt *jsontools.Jtree ) ( string, string ) {
+		return submit_step( ctx, ctx.synch_ch, req, jt, false, req.Rid )
+	}
+
+	added := make( []string, 0, len( treq.Req_data ) )
+	undo := make( []string, 0, len( treq.Req_data ) )		// targets to delete if we fail; may include one VFd didn't confirm
+	failed := "null"
+	for _, item := range treq.Req_data {
+		ajt, err := jsontools.Json2tree( []byte( fmt.Sprintf( `{ "action": "add", "target": %q, "req_data": %s }`, item.Target, item.Req_data ) ) )
+		state := "ERROR"
+		rdata := ""
+		if err == nil {
+			state, rdata = step( ajt )
+		} else {
+			rdata = build_response( ctx.sid, "ERROR", fmt.Sprintf( "unable to build add request: %s", err ), req.Msg_key, nil )
+		}
+
+		if state != "OK" {
+			sheep.Baa( 1, "transaction %s: add failed for %s: %s", req.Rid, item.Target, state )
+			failed = fmt.Sprintf( `{ "target": %q, "state": %q, "response": %s }`, item.Target, state, rdata )
+			if state == "TIMEOUT" {								// VFd might have applied it before we gave up
+				undo = append( undo, item.Target )
+			}
+			break
+		}
+
+		added = append( added, item.Target )
+		undo = append( undo, item.Target )
+	}
+
+	rolled_back := make( []string, 0, len( undo ) )
+	if failed != "null" {
+		for i := len( undo ) - 1; i >= 0; i-- {
+			djt, _ := jsontools.Json2tree( []byte( fmt.Sprintf( `{ "action": "delete", "target": %q }`, undo[i] ) ) )
+			state, _ := step( djt )
+			if state != "OK" {
+				sheep.Baa( 0, "WRN: transaction %s: rollback delete failed for %s: %s", req.Rid, undo[i], state )
+			}
+			rolled_back = append( rolled_back, fmt.Sprintf( `{ "target": %q, "state": %q }`, undo[i], state ) )
+		}
+	}
+
+	jadded, _ := json.Marshal( added )
+	state := "OK"
+	msg := fmt.Sprintf( "%d VFs added", len( added ) )
+	if failed != "null" {
+		state = "ERROR"
+		msg = fmt.Sprintf( "transaction failed after %d of %d adds; %d rolled back", len( added ), len( treq.Req_data ), len( rolled_back ) )
+	}
+
+	data, err := jsontools.Json2tree( []byte( fmt.Sprintf( `{ "added": %s, "failed": %s, "rolled_back": [ %s ] }`, jadded, failed, strings.Join( rolled_back, ", " ) ) ) )
+	if err != nil {
+		sheep.Baa( 0, "ERR: unable to build transaction response: %s", err )
+		data = nil
+	}
+	sheep.Baa( 1, "transaction %s complete: %s", req.Rid, msg )
+	release()
+	send_response( req, build_response( ctx.sid, state, msg, req.Msg_key, data ) )
+}
+
+/*
+	Run an update request. The req_data is the complete new config for the target
+	(as for add). The new config is compared with the config last stashed for the
+	target, and then it is applied either with a VFd update request, or if VFd does
+	not support update (update_mode in the config), by a delete followed by an add.
+	If the add fails, the previous config (when we have it) is added back so that
+	the VF is not left unconfigured.
+
+	The serialiser claimed the target for the update before starting us, and every
+	step is submitted under that claim; nothing else queued for the target can run
+	between the delete and the add (or the restore). The claim is released when we
+	finish, just before the response is sent.
+
+	The response data contains the before and after configs, the list of fields
+	which changed, and the response from each request sent to VFd.
+
+	This must be run as a goroutine as it pushes requests to the serialiser.
+*/
+func run_update( ctx *context, req *chcom.Request, sheep *bleater.Bleater ) {
+	target := req.Jtree.Get_string( "target" )
+	if target == nil {
+		send_response( req, build_response( ctx.sid, "ERROR", "request dropped: no target field in request", req.Msg_key, nil ) )
+		return
+	}
+
+	step := func( jt *jsontools.Jtree, internal bool ) ( string, string ) {
+		return submit_step( ctx, ctx.synch_ch, req, jt, internal, req.Rid )
+	}
+	data, ok := req.Jtree.Get_subtree( "req_data" )
+	if ! ok {
+		release_claim( ctx, *target, req.Rid, sheep )
+		send_response( req, build_response( ctx.sid, "ERROR", "request dropped: no req_data field in request", req.Msg_key, nil ) )
+		return
+	}
+
+	after := data.Frock()
+	var (
+		before	[]byte
+		err		error
+	)
+	if e, found := ctx.store.Get( *target ); found && e.Status != cfgstore.ST_deleted {
+		before = []byte( e.Config )
+	} else {
+		before, err = os.ReadFile( fmt.Sprintf( "%s/%s.json", ctx.cdir, *target ) )		// VFd may have moved it; if so we report all fields as new
+	}
+	if err != nil || len( bytes.TrimSpace( before ) ) == 0 {
+		before = nil
+	}
+
+	changes, err := vfcfg.Diff( before, []byte( after ) )
+	if err != nil {
+		sheep.Baa( 1, "update %s: unable to compare configs for %s: %s", req.Rid, *target, err )
+		before = nil														// previous is bad; can't restore it either
+		changes, _ = vfcfg.Diff( nil, []byte( after ) )
+	}
+
+	mode := "readd"
+	if ctx.vfd_update {
+		mode = "update"
+	}
+
+	steps := make( []string, 0, 3 )
+	state := "ERROR"
+	msg := ""
+	if ctx.vfd_update {
+		ujt, _ := jsontools.Json2tree( []byte( fmt.Sprintf( `{ "action": "update", "target": %q, "req_data": %s }`, *target, after ) ) )
+		ustate, rdata := step( ujt, true )
+		steps = append( steps, rdata )
+		state = ustate
+		msg = "update " + ustate
+	} else {
+		djt, _ := jsontools.Json2tree( []byte( fmt.Sprintf( `{ "action": "delete", "target": %q }`, *target ) ) )
+		dstate, rdata := step( djt, false )
+		steps = append( steps, rdata )
+
+		if dstate == "OK" {
+			ajt, _ := jsontools.Json2tree( []byte( fmt.Sprintf( `{ "action": "add", "target": %q, "req_data": %s }`, *target, after ) ) )
+			astate, rdata := step( ajt, false )
+			steps = append( steps, rdata )
+			state = astate
+			msg = "update (delete+add) " + astate
+
+			if astate != "OK" && before != nil {									// put things back the way we found them
+				sheep.Baa( 0, "WRN: update %s: add of new config failed for %s; restoring previous config", req.Rid, *target )
+				rjt, _ := jsontools.Json2tree( []byte( fmt.Sprintf( `{ "action": "add", "target": %q, "req_data": %s }`, *target, before ) ) )
+				rstate, rdata := step( rjt, false )
+				steps = append( steps, rdata )
+				msg += "; previous config restore " + rstate
+			}
+		} else {
+			msg = "update aborted: delete of current config " + dstate				// nothing changed, so nothing to restore
+		}
+	}
+
+	jbefore := "null"
+	if before != nil {
+		jbefore = string( before )
+	}
+	jchanges, _ := json.Marshal( changes )
+	rdata, err := jsontools.Json2tree( []byte( fmt.Sprintf( `{ "mode": %q, "before": %s, "after": %s, "changes": %s, "steps": [ %s ] }`, mode, jbefore, after, jchanges, strings.Join( steps, ", " ) ) ) )
+	if err != nil {
+		sheep.Baa( 0, "ERR: unable to build update response: %s", err )
+		rdata = nil
+	}
+	sheep.Baa( 1, "update %s complete for %s: %s (%d fields changed)", req.Rid, *target, msg, len( changes ) )
+	release_claim( ctx, *target, req.Rid, sheep )					// before we respond; the requestor may act on the response at once
+	send_response( req, build_response( ctx.sid, state, msg, req.Msg_key, rdata ) )
+}
+
+/*
+	Run a reconcile request. VFd is asked to show all, and the VFs it reports are
+	compared with the configs that should be in place. Those are either supplied
+	in the request, or are the configs in the store which were not deleted or
+	rejected:
+		{
+			action: "reconcile",
+			req_data: {
+				desired: [ { target: "vm1-eth0", config: { <vf config> } }, ... ]		(optional)
+				converge: <bool>														(optional)
+			}
+		}
+
+	The response data has the report (missing, extra and drifted VFs). If converge
+	is set, missing VFs are added, drifted VFs are updated, and extra VFs are deleted
+	if we can find the target name they were added with in the store. The result of
+	each is listed in the actions array of the response data.
+
+	This must be run as a goroutine as it pushes requests to the serialiser.
+*/
+func run_reconcile( ctx *context, req *chcom.Request, sheep *bleater.Bleater ) {
+	var rreq struct {
+		Req_data	struct {
+			Desired		[]reconcile.Desired	`json:"desired"`
+			Converge	bool				`json:"converge"`
+		}	`json:"req_data"`
+	}
+
+	json.Unmarshal( []byte( req.Jtree.Frock() ), &rreq )			// all optional; if it doesn't parse we use the store and don't converge
+	desired := rreq.Req_data.Desired
+	dsource := "request"
+	if desired == nil {
+		dsource = "store"
+		desired = make( []reconcile.Desired, 0 )
+		for _, le := range ctx.store.List() {
+			if le.Status == cfgstore.ST_deleted || le.Status == cfgstore.ST_rejected {
+				continue
+			}
+			if e, ok := ctx.store.Get( le.Target ); ok && len( e.Config ) > 0 {
+				desired = append( desired, reconcile.Desired { Target: e.Target, Config: e.Config } )
+			}
+		}
+	}
+
+	sjt, _ := jsontools.Json2tree( []byte( `{ "action": "show", "target": "all" }` ) )
+	state, rdata := submit_wait( ctx, req, sjt, false )
+	if state != "OK" {
+		send_response( req, build_response( ctx.sid, "ERROR", "reconcile: show all failed: " + state, req.Msg_key, nil ) )
+		return
+	}
+
+	var sresp struct {
+		Data	struct {
+			Msg		json.RawMessage		`json:"msg"`
+		}	`json:"data"`
+	}
+	json.Unmarshal( []byte( rdata ), &sresp )
+	live := vfdshow.Parse( vfdshow.Lines( sresp.Data.Msg ) )
+
+	rpt := reconcile.Compare( desired, live )
+	msg := fmt.Sprintf( "%d matched, %d missing, %d extra, %d drifted", len( rpt.Matched ), len( rpt.Missing ), len( rpt.Extra ), len( rpt.Drifted ) )
+
+	actions := make( []string, 0 )
+	if rreq.Req_data.Converge && ! rpt.Clean() {
+		configs := make( map[string]json.RawMessage, len( desired ) )
+		for _, d := range desired {
+			configs[d.Target] = d.Config
+		}
+
+		converge := func( action string, target string, config json.RawMessage ) {
+			jreq := fmt.Sprintf( `{ "action": %q, "target": %q }`, action, target )
+			if config != nil {
+				jreq = fmt.Sprintf( `{ "action": %q, "target": %q, "req_data": %s }`, action, target, config )
+			}
+
+			state := "ERROR"
+			if cjt, err := jsontools.Json2tree( []byte( jreq ) ); err == nil {
+				state, _ = submit_wait( ctx, req, cjt, false )
+			}
+			sheep.Baa( 1, "reconcile %s: %s %s: %s", req.Rid, action, target, state )
+			actions = append( actions, fmt.Sprintf( `{ "action": %q, "target": %q, "state": %q }`, action, target, state ) )
+		}
+
+		for _, m := range rpt.Missing {
+			converge( "add", m.Target, configs[m.Target] )
+		}
+		for _, d := range rpt.Drifted {
+			converge( "update", d.Target, configs[d.Target] )
+		}
+		for _, x := range rpt.Extra {						// we can delete only if we know the name it was added with
+			for _, le := range ctx.store.List() {
+				if e, ok := ctx.store.Get( le.Target ); ok {
+					if pciid, vfid, ok := reconcile.Vf_key( e.Config ); ok && vfid == x.Vfid && strings.EqualFold( pciid, x.Pf ) {
+						converge( "delete", e.Target, nil )
+						break
+					}
+				}
+			}
+		}
+
+		msg += fmt.Sprintf( "; %d converge requests sent", len( actions ) )
+	}
+
+	jrpt, _ := json.Marshal( rpt )
+	data, err := jsontools.Json2tree( []byte( fmt.Sprintf( `{ "desired_source": %q, "report": %s, "actions": [ %s ] }`, dsource, jrpt, strings.Join( actions, ", " ) ) ) )
+	if err != nil {
+		sheep.Baa( 0, "ERR: unable to build reconcile response: %s", err )
+		data = nil
+	}
+	sheep.Baa( 1, "reconcile %s complete: %s", req.Rid, msg )
+	send_response( req, build_response( ctx.sid, "OK", msg, req.Msg_key, data ) )
+}
+
+/*
+	Periodically reconcile the configs in the store with VFd. The outcome is only
+	logged; there is no requestor to respond to.
+*/
+func reconcile_timer( ctx *context, master_sheep *bleater.Bleater ) {
+	sheep := bleater.Mk_bleater( 0, os.Stderr )			// a local sheep to label messages
+	sheep.Set_prefix( "reconcile" )
+	master_sheep.Add_child( sheep )
+	sheep.Baa( 1, "periodic reconciliation every %ds; converge=%v", ctx.recon_ivl, ctx.recon_converge )
+
+	jstr := fmt.Sprintf( `{ "action": "reconcile", "req_data": { "converge": %v } }`, ctx.recon_converge )
+	for {
+		time.Sleep( time.Duration( ctx.recon_ivl ) * time.Second )
+
+		jt, _ := jsontools.Json2tree( []byte( jstr ) )
+		req := &chcom.Request {
+			Resp_ch:	make( chan interface{}, 1 ),
+			Source:		"reconcile_timer",
+			Msg_key:	"periodic-reconcile",
+			Rid:		uuid.NewRandom().String(),
+			Single_use:	true,
+			Jtree:		jt,
+		}
+
+		run_reconcile( ctx, req, sheep )
+		if mqm, ok := ( <- req.Resp_ch ).( *rabbit_hole.Mq_msg ); ok {
+			sheep.Baa( 1, "periodic reconciliation: %s", mqm.Data )
+		}
+	}
+}
+
+/*
+	Convert a string for use as a word in a topic routing key: dots separate words,
+	so they are replaced.
+*/
+func key_word( s string ) ( string ) {
+	return strings.Replace( s, ".", "_", -1 )
+}
+
+/*
+	Periodically ask VFd to show all and publish the counters for each PF and VF on
+	the stats exchange. Requests go to the serialiser at low priority so they never
+	delay a user's request.  Each PF and VF is a separate message:
+		{
+			sender: <tokay id>, type: "stats", timestamp: <unix>,
+			kind: pf|vf, pf: <pciid>, vfid: <n> (vf only), link: <state>,
+			counters: { rx_pkts: n, rx_bytes: n, rx_errors: n, rx_dropped: n, tx_pkts: n, ... }
+		}
+
+	The routing key is stats.<sender>.pf or stats.<sender>.vf so that topic exchange
+	listeners can select.
+*/
+func stats_collector( ctx *context, master_sheep *bleater.Bleater ) {
+	sheep := bleater.Mk_bleater( 0, os.Stderr )			// a local sheep to label messages
+	sheep.Set_prefix( "stats" )
+	master_sheep.Add_child( sheep )
+	sheep.Baa( 1, "stats collection every %ds", ctx.stats_ivl )
+
+	sw := start_rmq_writer( ctx, ctx.stats_exch, sheep )
+	defer sw.Close()
+
+	skey := key_word( ctx.sid )
+	for {
+		time.Sleep( time.Duration( ctx.stats_ivl ) * time.Second )
+
+		jt, _ := jsontools.Json2tree( []byte( `{ "action": "show", "target": "all" }` ) )
+		parent := &chcom.Request {
+			Source:		"stats_collector",
+			Msg_key:	"stats",
+			Rid:		uuid.NewRandom().String(),
+			Jtree:		jt,
+		}
+		state, rdata := submit_wait_ch( ctx, ctx.lowpri_ch, parent, jt, false )
+		if state != "OK" {
+			sheep.Baa( 1, "stats: show all failed: %s", state )
+			continue
+		}
+
+		var sresp struct {
+			Parsed	*vfdshow.Show	`json:"parsed"`
+		}
+		if json.Unmarshal( []byte( rdata ), &sresp ) != nil || sresp.Parsed == nil {
+			sheep.Baa( 1, "stats: no usable show output from VFd" )
+			continue
+		}
+
+		now := time.Now().Unix()
+		for _, pf := range sresp.Parsed.Pfs {
+			jc, _ := json.Marshal( pf.Counters )
+			sw.Port() <- &rabbit_hole.Mq_msg {
+				Data: []byte( fmt.Sprintf( `{ "sender": %q, "type": "stats", "timestamp": %d, "kind": "pf", "pf": %q, "link": %q, "counters": %s }`, ctx.sid, now, pf.Pciid, pf.Link, jc ) ),
+				Key: "stats." + skey + ".pf",
+			}
+		}
+		for _, vf := range sresp.Parsed.Vfs {
+			jc, _ := json.Marshal( vf.Counters )
+			sw.Port() <- &rabbit_hole.Mq_msg {
+				Data: []byte( fmt.Sprintf( `{ "sender": %q, "type": "stats", "timestamp": %d, "kind": "vf", "pf": %q, "vfid": %d, "link": %q, "counters": %s }`, ctx.sid, now, vf.Pf, vf.Vfid, vf.Link, jc ) ),
+				Key: "stats." + skey + ".vf",
+			}
+		}
+		sheep.Baa( 2, "stats published: %d pfs %d vfs", len( sresp.Parsed.Pfs ), len( sresp.Parsed.Vfs ) )
+	}
+}
+
+// ------------------- events -----------------------------------------------------------------------------
+/*
+	Publish an event on the events exchange if events are enabled. The routing key is
+	events.<sender>.<kind> (kind is e.g. vf.add, vfd.down or error) so that topic
+	exchange listeners can select. The message is:
+		{ sender: <tokay id>, type: "event", timestamp: <unix>, event: <kind>,
+		  target: <target>, state: <state>, msg: <text> }
+
+	This never blocks; if the writer is backed up the event is dropped rather than
+	holding up the caller (usually the responder).
+*/
+func publish_event( ctx *context, kind string, target string, state string, msg string ) {
+	if ctx.events_ch == nil {
+		return
+	}
+
+	mqm := &rabbit_hole.Mq_msg {
+		Data: []byte( fmt.Sprintf( `{ "sender": %q, "type": "event", "timestamp": %d, "event": %q, "target": %q, "state": %q, "msg": %q }`,
+			ctx.sid, time.Now().Unix(), kind, target, state, msg ) ),
+		Key: "events." + key_word( ctx.sid ) + "." + kind,
+	}
+
+	select {
+		case ctx.events_ch <- mqm:
+		default:
+	}
+}
+
+/*
+	Publish the event for a request that VFd responded to (or timed out): a
+	vf.<action> event for requests which change a VF, and an error event for any
+	other request which failed. The event's state is the response state, so a
+	timeout is TIMEOUT rather than ERROR.
+*/
+func response_event( ctx *context, resp *chcom.Response, state *string, msg *string ) {
+	if ctx.events_ch == nil || resp == nil || resp.Req == nil || resp.Req.Jtree == nil {
+		return
+	}
+
+	st := "unknown"
+	if state != nil {
+		st = *state
+	}
+	m := ""
+	if msg != nil {
+		m = *msg
+	}
+	t := ""
+	if target := resp.Req.Jtree.Get_string( "target" ); target != nil {
+		t = *target
+	}
+
+	action := resp.Req.Jtree.Get_string( "action" )
+	switch {
+		case action != nil && is_vf_op( *action ):
+			a := *action
+			if a == "del" {
+				a = "delete"
+			}
+			publish_event( ctx, "vf." + a, t, st, m )
+
+		case st != "OK":
+			a := "unknown"
+			if action != nil {
+				a = *action
+			}
+			publish_event( ctx, "error", t, st, a + ": " + m )
+	}
+}
+
+/*
+	Ping VFd periodically and publish vfd.up or vfd.down when the state changes (and
+	for the first ping). Pings go to the serialiser at low priority.
+*/
+func vfd_heartbeat( ctx *context, master_sheep *bleater.Bleater ) {
+	sheep := bleater.Mk_bleater( 0, os.Stderr )			// a local sheep to label messages
+	sheep.Set_prefix( "heartbeat" )
+	master_sheep.Add_child( sheep )
+	sheep.Baa( 1, "VFd heartbeat every %ds", ctx.hb_ivl )
+
+	was := ""
+	for {
+		jt, _ := jsontools.Json2tree( []byte( `{ "action": "ping" }` ) )
+		parent := &chcom.Request {
+			Source:		"heartbeat",
+			Msg_key:	"heartbeat",
+			Rid:		uuid.NewRandom().String(),
+			Jtree:		jt,
+		}
+		state, _ := submit_wait_ch( ctx, ctx.lowpri_ch, parent, jt, false )
+
+		now := "vfd.up"
+		if state != "OK" {
+			now = "vfd.down"
+		}
+		if now != was {
+			sheep.Baa( 1, "VFd heartbeat changed: %s (ping state %s)", now, state )
+			publish_event( ctx, now, "", state, "VFd heartbeat" )
+			was = now
+		}
+
+		time.Sleep( time.Duration( ctx.hb_ivl ) * time.Second )
+	}
+}
+
+// ------------------- response processing ----------------------------------------------------------------
+/*
+	Listens to the link from VFd (the response fifo, or the socket). When a response
+	message is read it is written onto the responder channel. This function blocks
+	on the link, so it shouldn't do anything but just shove the next response along
+	for processing.
+
+	Oversized or torn messages are dropped and the link resynchronises on the next
+	message. If the read fails, the link is reopened.
+*/
+func resp_reader( ctx *context, master_sheep *bleater.Bleater ) {
+	sheep := bleater.Mk_bleater( 0, os.Stderr )			// a local sheep to label messages
+	sheep.Set_prefix( "resp_reader" )
+	master_sheep.Add_child( sheep )						// add to the caller's sheep tree (should force to target file if opened by perent)
+	sheep.Baa( 1, "resp_reader is running" )
+	sheep.Baa( 0, "reading responses from VFd via: %s", ctx.transport )
+
+	for {
+		jblob, err := ctx.link.Recv()
+		switch {
+			case err == nil:
+				if len( jblob ) > 0 {
+					sheep.Baa( 1, "msg from VFd: %d bytes", len( jblob ) )
+					ctx.resp_ch <- jblob
+				}
+
+			case err == eom.Err_too_big:
+				resyncs, dropped := ctx.link.Stats()
+				sheep.Baa( 0, "WRN: response from VFd exceeded %d bytes and was discarded; resynchronised (%d resyncs, %d bytes dropped)", ctx.max_resp, resyncs, dropped )
+
+			default:
+				resyncs, dropped := ctx.link.Stats()
+				sheep.Baa( 0, "ERR: read from VFd failed: %s (%d resyncs, %d bytes dropped); reopening", err, resyncs, dropped )
+				for {
+					time.Sleep( time.Second )
+					if err = ctx.link.Reconnect(); err == nil {
+						break
+					}
+					sheep.Baa( 0, "ERR: unable to reopen link to VFd: %s: %s", ctx.transport, err )
+				}
+				sheep.Baa( 0, "link to VFd reopened: %s", ctx.transport )
+		}
+	}
+}
+
+/*
+	Listens to a channel for one of two things: 
+		1) json blobs that were received from VFd as responses
+		2) responses from the serialiser which can be:
+			a) ready to send now (error or local info so no request went to VFd)
+			b) waiting for an VFd response blob, so we must queue or match if VFd
+				responded before we got the response block.
+
+	When a response is ready to be sent, it is written to the channel
+	that is in the resposne block; this is likely a private RMQ exchange
+	that was connected to when the request was received.
+
+	This thread will create a writer into the rabbit environment
+	and write responses on the exchange (config file) using the 
+	request ID as the message key.
+
+	Json that is written to the requestor is:
+		msg_key: <disabmbiguation-key-provided-in-request>
+		data: { <json data from vfd> }
+
+	The exchange key passed in the requst is placed only in the RMQ header.
+*/
+func responder( ctx *context, master_sheep *bleater.Bleater ) {
+
+	sheep := bleater.Mk_bleater( 0, os.Stderr )			// a local sheep to label messages
+	sheep.Set_prefix( "responder" )
+	master_sheep.Add_child( sheep )						// add to the caller's sheep tree (should force to target file if opened by perent)
+	sheep.Baa( 1, "responder is running" )
+
+	tch := make( chan *ipc.Chmsg, 1 )					// channel for tickles
+	tklr := ipc.Mk_tickler( 2 )
+	tick := ctx.resp_timeout								// check for stale requests often enough to honour short timeouts
+	if tick > 5 || tick < 1 {
+		tick = 5
+	}
+	tklr.Add_spot( tick, tch, 0, nil, 0 )
+
+	pending_resp := make( map[string]*chcom.Response )
+	late := make( map[string]*chcom.Response )			// timed out requests still holding their target; VFd may yet act on them
+	unmatched := make( map[string][]byte )				// msgs received before we see the response block from serialiser
+	for {
+		var (
+			action *string
+			vfd_rid *string		// response id from anlois
+		)
+
+		select {
+			case _ = <-tch:								// a tickle, check for stale requests
+				now := time.Now().Unix()
+				for _, r := range pending_resp {
+					if r.Tstamp < now {
+						rdata := fmt.Sprintf( `{ "sender": %q, "state": "TIMEOUT", "msg_key": %q, "msg": "timeout: no response from VFd" }`, ctx.sid, r.Msg_key )
+						r.Req.Resp_ch <- resp_msg( r.Req, rdata )	// just send the immediate response out
+
+						sheep.Baa( 1, "response timed out for request %s; target kept for up to %ds in case VFd is still working on it", r.Rid, ctx.resp_grace )
+						timeout_state := "TIMEOUT"
+						timeout_msg := "timeout: no response from VFd"
+						response_event( ctx, r, &timeout_state, &timeout_msg )
+						delete( pending_resp, r.Rid )
+						r.Tstamp = now + ctx.resp_grace					// don't let the next request for the target overlap this one
+						late[r.Rid] = r
+					}
+				}
+
+				for _, r := range late {
+					if r.Tstamp < now {
+						sheep.Baa( 1, "no late response from VFd for request %s; releasing its target", r.Rid )
+						delete( late, r.Rid )
+						release_target( ctx, r, sheep )
+					}
+				}
+
+			case stuff := <- ctx.resp_ch:							// block and wait for something
+				switch msg := stuff.(type) {
+					case []byte:
+						jtree, err := jsontools.Json2tree( msg ) 			// blob of bytes expected to be json goo; convert it
+						if err == nil {
+							action = jtree.Get_string( "action" )
+							vfd_rid = jtree.Get_string( "vfd_rid" )
+						} else {
+							sheep.Baa( 0, "bad response data from VFd: %s", msg )
+							break
+						}
+
+						if vfd_rid != nil && action != nil {
+							switch *action {							// VFd may communicate things other than responses
+								case "response":
+									resp := pending_resp[*vfd_rid]						// see if we have a request that matches
+									if resp != nil {
+										parsed := parse_show( resp, msg )				// structured show output (nil if not a show)
+										state := jtree.Get_string( "state" )			// pull the state out of the VFd message
+										msg := jtree.Get_string( "msg" )				// if VFd put a string in, we'll pull it up too, but likley an array of strings which we don't promote
+										rbuf := ""
+										if msg == nil {
+											rbuf = build_show_response( ctx.sid, *state, "", resp.Msg_key, jtree, parsed )		// create a response using the user supplied key, and stuffing in the vfd response as data
+										} else {
+											rbuf = build_show_response( ctx.sid, *state, *msg, resp.Msg_key, jtree, parsed )
+										}
+
+										delete( pending_resp, *vfd_rid )
+										record_result( ctx, resp, state, sheep )
+										release_target( ctx, resp, sheep )				// before the response goes out: the requestor may act on it at once
+										resp.Req.Resp_ch <- resp_msg( resp.Req, rbuf )	// send the response to the output channel specified when request sent to serialiser
+										response_event( ctx, resp, state, msg )
+										sheep.Baa( 2, "VFd response received, found matching request: vfd_rid=%s", *vfd_rid )
+									} else if lr := late[*vfd_rid]; lr != nil {		// the requestor has had a timeout; record what really happened and free the target
+										state := jtree.Get_string( "state" )
+										sheep.Baa( 1, "late VFd response received for timed out request: vfd_rid=%s", *vfd_rid )
+										delete( late, *vfd_rid )
+										if state != nil {
+											record_result( ctx, lr, state, sheep )
+											response_event( ctx, lr, state, jtree.Get_string( "msg" ) )
+										}
+										release_target( ctx, lr, sheep )
+									} else {
+										sheep.Baa( 1, "VFd response received, matching request not found: vfd_rid=%s", *vfd_rid )
+										unmatched[*vfd_rid] = msg
 									}
 				
 								default:
@@ -644,16 +1750,13 @@ func responder( ctx *context, master_sheep *bleater.Bleater ) {
 						}
 
 						if msg.Wait {
-							msg.Tstamp = time.Now().Unix() + 15				// second granularity is fine here; when this resopnse goes stale
+							msg.Tstamp = time.Now().Unix() + ctx.resp_timeout	// second granularity is fine here; when this resopnse goes stale
 							pending_resp[msg.Rid] = msg						// just tuck the request info away until we have a response
 
 							sheep.Baa( 2, "request awaiting response has been queued for: %s", msg.Rid )
 						} else {
-							mqm := &rabbit_hole.Mq_msg {				// a message that allows us to set the key
-								Data: []byte( msg.Rdata ),
-								Key: msg.Exch_key,
-							}
-							msg.Req.Resp_ch <- mqm						// just send the immediate response out
+							release_target( ctx, msg, sheep )			// request was dropped; target (if claimed) is free
+							msg.Req.Resp_ch <- resp_msg( msg.Req, msg.Rdata )		// just send the immediate response out
 						}
 
 					default:
@@ -665,6 +1768,99 @@ func responder( ctx *context, master_sheep *bleater.Bleater ) {
 }
 
 
+/*
+	Start the goroutines which make up the pipeline: the serialiser, the reader of
+	VFd responses, the responder, the writer back to rabbit, and a collector for
+	each request exchange in exchanges (comma separated name:type+opts:key). The
+	link to VFd and the broker must already be in the context. Used by main and
+	by the self test so that the test runs exactly what tokay runs.
+*/
+func start_pipeline( ctx *context, exchanges string, big_sheep *bleater.Bleater ) {
+	if exchanges != "" && ctx.events_exch != "" {			// before the responder starts; it publishes events
+		ew := start_rmq_writer( ctx, ctx.events_exch, big_sheep )
+		ctx.events_ch = ew.Port()
+	}
+
+	if exchanges != "" && ctx.rpc_broker != nil {			// before the collectors start; they route reply-to requests here
+		if ab, ok := ctx.rpc_broker.( *broker.Amqp ); ok {
+			ab.Log = func( format string, args ...interface{} ) { big_sheep.Baa( 0, "ERR: reply-to: " + format, args... ) }
+		}
+		if rw, err := ctx.rpc_broker.Mk_writer( "", "", nil ); err == nil {		// the default exchange
+			rw.Start_writer( "" )
+			ctx.rpc_ch = rw.Port()
+		} else {
+			big_sheep.Baa( 0, "WRN: unable to attach reply-to writer to %s; reply-to is ignored and exch_key used: %s", ctx.rpc_broker, err )
+		}
+	}
+
+	go serialiser( ctx, big_sheep )					// serialise requests (from rabbit collector(s))
+	ctx.wg.Add( 1 )
+
+	go resp_reader( ctx, big_sheep )				// read responses from VFd
+	ctx.wg.Add( 1 )
+
+	go responder( ctx, big_sheep )					// match pending responses with VFd data and send to the correct response writer
+	ctx.wg.Add( 1 )
+
+	if ctx.recon_ivl > 0 {
+		go reconcile_timer( ctx, big_sheep )		// not counted in the wait group; it never finishes on its own
+	}
+
+	if exchanges != "" {
+		etokens := strings.Split( exchanges, "," )		// exchange[:type:key] tokens from -e (this could be zero if no rabbit user/pw defined)
+		if len( etokens ) > 0 {
+			rwriter := start_rmq_writer( ctx, ctx.wr_exch, big_sheep )		// kick the thread that will write back to rmq
+			ctx.rmqw_ch = rwriter.Port();							// collectors will insert this in requests passed to serialiser
+
+			if ctx.stats_ivl > 0 {
+				go stats_collector( ctx, big_sheep )			// not counted in the wait group; it never finishes on its own
+			}
+			if ctx.hb_ivl > 0 && ctx.events_ch != nil {
+				go vfd_heartbeat( ctx, big_sheep )				// likewise
+			}
+	
+	
+			big_sheep.Baa( 2, "connecting to exchanges; adding collectors" )
+			for _, exch := range etokens {					// create one collector per exchange
+				if( exch == "" ) {
+					continue 
+				}
+
+				big_sheep.Baa( 1, "token: %s", exch )
+				tokens := strings.SplitN( exch, ":", 3 )	// split into 3 exch-name:type+opts:key
+
+				etype := "direct+!du+ad"					// defaults if fields are missing
+				ekey := "tokay_req"							// default listen key
+				switch len( tokens ) {
+					case 2:
+						if tokens[1] != "" {
+							etype = tokens[1]
+						}
+	
+					case 3:
+						if tokens[1] != "" {				// allow name::key
+							etype = tokens[1]
+						}
+						if tokens[2] != "" {				// could be name:type:
+							ekey = tokens[2]
+						}
+				}
+	
+				big_sheep.Baa( 1, "creating rmq link: %s ex=%s etype=%s ekey=%s", ctx.broker, tokens[0], etype, ekey )
+				r, err := ctx.broker.Mk_reader( tokens[0], etype, &ekey )		// collector expected to close on return
+				if err != nil {
+					big_sheep.Baa( 0, "abort: unable to attach a reader for %s: %s", exch, err )
+					os.Exit( 1 )
+				}
+	
+				go collector( ctx, tokens[0], r, big_sheep )		// basic collector on each exchange
+	
+				ctx.wg.Add( 1 )
+			}
+		}
+	}
+}
+
 // -----------------------------------------------------------------------------------------------
 func main( ) {
 	var (
@@ -723,6 +1919,7 @@ func main( ) {
 		wg:	&wg,
 	}
 	ctx.synch_ch = make( chan *chcom.Request, 2048 )
+	ctx.lowpri_ch = make( chan *chcom.Request, 16 )
 	ctx.sid = gen_sender_id()
 
 
@@ -739,6 +1936,48 @@ func main( ) {
 	ctx.req_fifo = jcfg.Extract_string( "tokay default", "vfd_fifo", "/var/lib/vfd/request.fifo" )			// where VFd listens for requests
 	ctx.resp_fifo = jcfg.Extract_string( "tokay default", "resp_fifo", "/var/lib/vfd/fifos/tokay.fifo" )	// where we will listen for responses
 	ctx.cdir = jcfg.Extract_string( "tokay default", "conf_dir", "/var/lib/vfd/config" )					// where config files are deposited
+	ctx.max_resp = jcfg.Extract_int( "tokay default", "max_resp_size", eom.Default_max )						// larger responses from VFd are discarded
+	ctx.resp_timeout = int64( jcfg.Extract_posint( "tokay default", "resp_timeout", 15 ) )					// seconds before we give up on VFd
+	ctx.resp_grace = int64( jcfg.Extract_int( "tokay default", "resp_grace", 30 ) )							// seconds a timed out request keeps its target
+	ctx.inflight = inflight.Mk_tracker()
+	ctx.tpolicy = &vfcfg.Name_policy { }
+	tp_cfg, err := jcfg.Extract_section( "tokay default", "target_policy", "" )				// optional; defaults are reasonable
+	if err == nil {
+		ctx.tpolicy.Max_len = tp_cfg.Extract_int( "default", "max_len", vfcfg.Default_max_len )
+		ctx.tpolicy.Extra = tp_cfg.Extract_string( "default", "allow_chars", "" )
+		ctx.tpolicy.Uuid_only = tp_cfg.Extract_int( "default", "uuid_only", 0 ) != 0
+	}
+	ctx.store, err = cfgstore.Mk_store( ctx.cdir, jcfg.Extract_string( "tokay default", "store_index", ctx.cdir + "/tokay_store.idx" ) )
+	if err != nil {
+		big_sheep.Baa( 0, "WRN: %s", err )
+	}
+	rc_cfg, err := jcfg.Extract_section( "tokay default", "reconcile", "" )							// periodic reconciliation is off unless configured
+	if err == nil {
+		ctx.recon_ivl = rc_cfg.Extract_int( "default", "interval", 0 )
+		ctx.recon_converge = rc_cfg.Extract_int( "default", "converge", 0 ) != 0
+	}
+	st_cfg, err := jcfg.Extract_section( "tokay default", "stats", "" )								// stats publishing is off unless configured
+	if err == nil {
+		ctx.stats_ivl = st_cfg.Extract_int( "default", "interval", 0 )
+		ctx.stats_exch = st_cfg.Extract_string( "default", "exch", "tokay_stats:topic+!du+ad:stats" )
+	}
+	ev_cfg, err := jcfg.Extract_section( "tokay default", "events", "" )								// event publishing is off unless configured
+	if err == nil {
+		ctx.events_exch = ev_cfg.Extract_string( "default", "exch", "tokay_events:topic+!du+ad:events" )
+		ctx.hb_ivl = ev_cfg.Extract_int( "default", "heartbeat", 0 )
+	}
+	ctx.vfd_update = jcfg.Extract_string( "tokay default", "update_mode", "readd" ) == "vfd"				// vfd if VFd supports update, else readd (delete+add)
+	ctx.rpc_replies = jcfg.Extract_string( "tokay default", "reply_to", "on" ) != "off"						// honour AMQP reply-to/correlation-id on requests
+	cmode := jcfg.Extract_string( "tokay default", "conflict_mode", "queue" )								// queue or reject requests for a busy target
+	switch cmode {
+		case "queue":
+
+		case "reject":
+			ctx.reject_conflicts = true
+
+		default:
+			big_sheep.Baa( 0, "WRN: unrecognised conflict_mode in config: %s; requests for a busy target will be queued", cmode )
+	}
 	cvlevel := jcfg.Extract_int( "tokay default", "verbose", 1 )
 	big_sheep.Set_level(  uint( cvlevel ) )
 
@@ -760,6 +1999,13 @@ func main( ) {
 		os.Exit( 1 )
 	}
 
+	rl_cfg, err := jcfg.Extract_section( "tokay default", "rate_limit", "" )			// optional rate limits; rates are requests/sec, 0 disables
+	if err == nil {
+		ctx.sender_limit = throttle.Mk_limiter( rl_cfg.Extract_int( "default", "sender_rate", 0 ), rl_cfg.Extract_int( "default", "sender_burst", 0 ) )
+		ctx.user_limit = throttle.Mk_limiter( rl_cfg.Extract_int( "default", "user_rate", 0 ), rl_cfg.Extract_int( "default", "user_burst", 0 ) )
+		ctx.exch_limit = throttle.Mk_limiter( rl_cfg.Extract_int( "default", "exch_rate", 0 ), rl_cfg.Extract_int( "default", "exch_burst", 0 ) )
+	}
+
 	v := jcfg.Extract_posint( "tokay default", "verbose", 1 )
 	big_sheep.Set_level( uint( v ) )
 
@@ -781,64 +2027,28 @@ func main( ) {
 
 	ctx.pw = pw										// could have come from env or config; set in context now
 	ctx.uname = uname
+	rmq := broker.Mk_rmq( ctx.qhost, ctx.qport, uname, pw )
+	rmq.Rport = *rport								// readers have always used the command line port
+	ctx.broker = rmq
+	if ctx.rpc_replies {
+		ctx.rpc_broker = broker.Mk_amqp( ctx.qhost, ctx.qport, uname, pw, nil )		// rabbit_hole can't set the correlation id
+	}
 
 	ctx.resp_ch = make( chan interface{}, 1024 )	// responder will listen to this for responses from VFd and for queued responses from synch thread
-	
-	go serialiser( ctx, big_sheep )					// serialise requests (from rabbit collector(s))
-	wg.Add( 1 )
-
-	go resp_reader( ctx, big_sheep )				// read responses from VFd
-	wg.Add( 1 )
-
-	go responder( ctx, big_sheep )					// match pending responses with VFd data and send to the correct response writer
-	wg.Add( 1 )
-
-	if exchange != nil && *exchange != "" {
-		etokens := strings.Split( *exchange, "," )		// exchange[:type:key] tokens from -e (this could be zero if no rabbit user/pw defined)
-		if len( etokens ) > 0 {
-			rwriter := start_rmq_writer( ctx, big_sheep )		// kick the thread that will write back to rmq
-			ctx.rmqw_ch = rwriter.Port;							// collectors will insert this in requests passed to serialiser
-	
-	
-			big_sheep.Baa( 2, "connecting to exchanges; adding collectors" )
-			for _, exch := range etokens {					// create one collector per exchange
-				if( exch == "" ) {
-					continue 
-				}
 
-				big_sheep.Baa( 1, "token: %s", exch )
-				tokens := strings.SplitN( exch, ":", 3 )	// split into 3 exch-name:type+opts:key
-
-				etype := "direct+!du+ad"					// defaults if fields are missing
-				ekey := "tokay_req"							// default listen key
-				switch len( tokens ) {
-					case 2:
-						if tokens[1] != "" {
-							etype = tokens[1]
-						}
-	
-					case 3:
-						if tokens[1] != "" {				// allow name::key
-							etype = tokens[1]
-						}
-						if tokens[2] != "" {				// could be name:type:
-							ekey = tokens[2]
-						}
-				}
-	
-				big_sheep.Baa( 1, "creating rmq link: %s %s %s ex=%s etype=%s ekey=%s", uname, pw, ctx.qhost, tokens[0], etype, ekey )
-				r, err := rabbit_hole.Mk_mqreader( ctx.qhost, *rport, uname, pw, tokens[0], etype, &ekey )		// collector expected to close on return
-				if err != nil {
-					big_sheep.Baa( 0, "abort: unable to attach a reader for %s: %s", exch, err )
-					os.Exit( 1 )
-				}
-	
-				go collector( ctx, tokens[0], r, big_sheep )		// basic collector on each exchange
-	
-				wg.Add( 1 )
-			}
-		}
+	transport := jcfg.Extract_string( "tokay default", "vfd_transport", "fifo" )						// fifo (legacy), or unix/unixpacket socket
+	sock_path := jcfg.Extract_string( "tokay default", "vfd_socket", "/var/lib/vfd/pipes/vfd.sock" )
+	ctx.transport = fmt.Sprintf( "fifo: %s/%s", ctx.req_fifo, ctx.resp_fifo )
+	if transport != "fifo" {
+		ctx.transport = fmt.Sprintf( "%s: %s", transport, sock_path )
+	}
+	ctx.link, err = vfdlink.Mk_link( transport, ctx.req_fifo, ctx.resp_fifo, sock_path, ctx.max_resp )
+	if err != nil {
+		big_sheep.Baa( 0, "abort: unable to establish link to VFd: %s", err )
+		os.Exit( 1 )
 	}
+	
+	start_pipeline( ctx, *exchange, big_sheep )
 
 	// chill -- probably forever
 	wg.Wait()
@@ -0,0 +1,1188 @@
+// vi: sw=4 ts=4:
+/*
+	Mnemonic:	tokay_req.go
+	Abstract:	Accepts a VFd request that should be sent via RabbitMQ to tokay which is expected
+				to forward the request to VFd. The response json received from tokay is written to
+				standard out as is.  This is somewhat specialised as it needs to know how to format
+				the various VFd requests; tokay is only a passthrough expecting the sender to know
+				exactly how to build a VFd request.
+
+	Date:		20 March 2018
+	Author:		E. Scott Daniels
+
+	Useful links:
+			https://godoc.org/github.com/streadway/amqp#example-Channel-Consume
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"flag"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/att/gopkgs/jsontools"
+	"github.com/att/gopkgs/rabbit_hole"
+	"github.com/att/gopkgs/bleater"
+	"github.com/att/gopkgs/uuid"
+
+	"github.com/att/vfd.gaol/tokay/client"
+	"github.com/att/vfd.gaol/tokay/lib/broker"
+	"github.com/att/vfd.gaol/tokay/lib/lineedit"
+	"github.com/att/vfd.gaol/tokay/lib/profile"
+	"github.com/att/vfd.gaol/tokay/lib/render"
+	"github.com/att/vfd.gaol/tokay/lib/vfcfg"
+)
+
+const (
+	Rbuf_len	int = 1024 * 32			// this should be plenty of space for the response
+)
+
+const (									// exit codes; 1 is usage or setup failure
+	RC_ok			int = 0
+	RC_usage		int = 1
+	RC_error		int = 2
+	RC_timeout		int = 3				// tokay (or VFd via tokay) reported a timeout
+	RC_conflict		int = 5
+	RC_throttled	int = 6
+	RC_invalid		int = 7
+	RC_no_response	int = 8				// nothing heard from tokay within -t seconds
+	RC_unknown		int = 9				// response had no, or an unrecognised, state
+)
+
+var state_rc = map[string]int {			// maps the state in the response to our exit code
+	"OK":			RC_ok,
+	"ERROR":		RC_error,
+	"TIMEOUT":		RC_timeout,
+	"CONFLICT":		RC_conflict,
+	"THROTTLED":	RC_throttled,
+	"INVALID":		RC_invalid,
+}
+
+var (
+	key_counter int = 0					// keep random string unique
+	resp_key string = "no-key"			// key we look for on the response exchange
+)
+
+// -----------------------------------------------------------------------------------------------
+/*
+	Make a random key for a message.
+*/
+func gen_key( ) ( string ) {
+	key_counter += 1
+	return fmt.Sprintf( "%s-%d", uuid.NewRandom().String(), key_counter )
+}
+
+/*
+	Map the state in a response to the exit code.
+*/
+func rc_for( state *string ) ( int ) {
+	if state == nil {
+		return RC_unknown
+	}
+
+	if rc, ok := state_rc[*state]; ok {
+		return rc
+	}
+	return RC_unknown
+}
+
+/*
+	Write a response in the output format (-o); raw writes it as received. If the
+	response can't be rendered it is written raw.
+*/
+func write_resp( body []byte, format string ) {
+	if format != "raw" && render.Write( os.Stdout, format, body ) == nil {
+		return
+	}
+
+	fmt.Printf( "%s\n", body )
+}
+
+/*
+	Run as a goroutine, this waits for messages from the other side rabbit reader (rdr) and
+	does something with what it receives. When we exit, we send the exit code derived from
+	the state of the last response on the done channel so that the main process can exit.
+	Format is the output format (-o), raw (-j), or empty for the pretty printed json tree.
+*/
+func collector( ch_name string, rdr broker.Reader, num int, format string,  done chan int, sheep *bleater.Bleater ) {
+
+	rh_ch := make( chan amqp.Delivery, 4096 )			// our listen channel
+	count := 0
+	defer rdr.Close()									// ensure reader is closed on return
+
+	sheep.Baa( 1, "reading from tokay response exchange: %s", ch_name )
+	
+	rc := RC_unknown
+	if err := rdr.Start_eating( rh_ch ); err != nil {
+		fmt.Fprintf( os.Stderr, "abort: unable to read from %s: %s\n", ch_name, err )
+		done <- RC_usage
+		return
+	}
+	for {
+		msg := <- rh_ch									// wait for next msg from rabbit hole
+		jt, err := jsontools.Json2tree( msg.Body )
+		if err == nil {
+			rc = rc_for( jt.Get_string( "state" ) )
+		} else {
+			rc = RC_unknown
+		}
+
+		if format == "" && err == nil {
+			jt.Pretty_print( os.Stdout )
+		} else {
+			write_resp( msg.Body, format )
+		}
+
+		msg.Body = nil
+		count++
+		if( num > 0 && count >= num ) {
+			break
+		}
+
+	}
+
+	rdr.Stop()					// turn off listner
+	done <- rc					// release main
+	return
+}
+
+// -------------- request builders ---------------------------------
+/*
+	These functions all accept an 'argv' array. [0] is assumed to be the request name
+	(e.g. show or add), and postitional parms (probably from the command line) are
+	expected to following in elements 1..n.  Tokay expects two types of request parameter
+	fields:  target, req_data.  Target is the target of the operation (e.g. file name for
+	add/del, or "all," "pfs," etc. for show; it is typically a single token.  Strings contiaining
+	multiple tokens, or raw json (unescaped), are passed using the req_data field. This includes
+	the string of mirror parms as well as the json for add.
+*/
+
+/*
+	Generate an add request, argv[1] is expected to be target name (port id, or what ever will be used
+	as the .json file name.  The configuration json follows either as argv[2], or is read from
+	the file named after -f (argv[3]; - is standard input).  The config is validated against
+	the fields VFd accepts; if there are errors, an empty request and the list of problems
+	are returned so that nothing malformed is sent. Warnings are written to stderr.
+*/
+func mk_add( argv []string ) ( string, []vfcfg.Field_error ) {
+	var (
+		config	[]byte
+		err		error
+	)
+
+	switch {
+		case len( argv ) > 3 && argv[2] == "-f":
+			if argv[3] == "-" {
+				config, err = io.ReadAll( os.Stdin )
+			} else {
+				config, err = os.ReadFile( argv[3] )
+			}
+			if err != nil {
+				return "", []vfcfg.Field_error { { Field: "(config)", Msg: fmt.Sprintf( "unable to read %s: %s", argv[3], err ) } }
+			}
+
+		case len( argv ) > 2 && argv[2] != "-f":
+			config = []byte( argv[2] )
+
+		default:
+			return "", nil
+	}
+
+	req, problems := client.Add_req( resp_key, gen_key(), argv[1], config )
+	if req == "" {
+		return "", problems
+	}
+	for _, p := range problems {
+		fmt.Fprintf( os.Stderr, "%s\n", p )
+	}
+
+	return req, nil
+}
+
+/*
+	Generate a delete request. Argv[1] is expected to be the name given on an add request
+	previously submitted to VFd.
+*/
+func mk_del( argv []string ) ( string ) {
+	if len( argv ) < 2  {
+		return ""
+	}
+
+	return client.Delete_req( resp_key, gen_key(), argv[1] )
+}
+
+/*
+	Generate a dump request. Response from this is just an ack; dump output goes into VFd log, so direct
+	access to the system is needed.
+*/
+func mk_dump( argv []string ) ( string ) {
+
+	return client.Dump_req( resp_key, gen_key() )
+}
+
+/*
+	Generate a show request. Argv[1] 
+*/
+func mk_show( argv []string ) ( string ) {
+	show_type := "all"				// default to all.
+
+	if len( argv ) > 1 {
+		show_type = argv[1]
+	}
+	return client.Show_req( resp_key, gen_key(), show_type )
+}
+
+/*
+	Generate a ping request. The kind of ping (Ping or ping) is pulled from the command args.
+*/
+func mk_ping( argv []string ) ( string ) {
+	return client.Ping_req( resp_key, gen_key(), argv[0] )
+}
+
+/*
+	Generate a list or get request; these are answered by tokay from its config store.
+	For get, argv[1] is expected to be the target name given on the add.
+*/
+func mk_store_req( argv []string ) ( string ) {
+	if argv[0] == "list" {
+		return client.List_req( resp_key, gen_key() )
+	}
+
+	if len( argv ) < 2  {
+		return ""
+	}
+	return client.Get_req( resp_key, gen_key(), argv[1] )
+}
+
+/*
+	Generate a verbose request.
+*/
+func mk_verbose( argv []string ) ( string ) {
+	if len( argv ) > 1 {
+		return client.Verbose_req( resp_key, gen_key(), argv[1] )
+	} else {
+		return ""
+	}
+}
+
+/*
+	Generate a mirror request. Argv[1] we assume is a string which contains:
+		<pf> <vf> <direction> [<target>]
+
+	The string is passed to tokay/VFd as is in request data. 
+*/
+func mk_mirror( argv []string ) ( string ) {
+	data := argv[1]
+	if len( argv ) > 2 {		// assume each given as separate, bang together
+		for i := 2; i < len( argv ); i++ {
+			data += " " + argv[i]
+		}
+	}
+		
+	return client.Mirror_req( resp_key, gen_key(), data )
+}
+
+/*
+	Build the request for one action and its arguments. Returns an empty string if
+	the arguments aren't right, and problems if the config given on an add is not
+	valid.
+*/
+func mk_request( argv []string ) ( req string, problems []vfcfg.Field_error ) {
+	switch( argv[0] ) {
+		case "add":
+			return mk_add( argv )
+
+		case "del", "delete":
+			req = mk_del( argv )
+
+		case "dump":
+			req = mk_dump( argv )
+
+		case "list", "get":			// answered by tokay from its config store
+			req = mk_store_req( argv )
+
+		case "mirror":
+			req = mk_mirror( argv )
+
+		case "ping", "Ping":		// ping passed to VFd for response, Ping answered by tokay
+			req = mk_ping( argv )
+
+		case "show":
+			req = mk_show( argv )
+
+		case "verbose":
+			req = mk_verbose( argv )
+	}
+
+	return req, nil
+}
+
+/*
+	Return the first line of the msg field of a response; VFd may send a list.
+*/
+func msg_line( msg interface{} ) ( string ) {
+	switch m := msg.(type) {
+		case string:
+			return strings.SplitN( m, "\n", 2 )[0]
+
+		case []interface{}:
+			if len( m ) > 0 {
+				return msg_line( m[0] )
+			}
+	}
+
+	return ""
+}
+
+/*
+	Fix up the arguments of a script or shell line: an add config may be given as
+	@file, or inline where the json may have been split on spaces. Lines aren't
+	split by a shell, so one level of quotes round the config (as the shell help
+	shows it) is removed here.
+*/
+func line_argv( argv []string ) ( []string ) {
+	if argv[0] == "add" && len( argv ) > 2 && argv[2] != "-f" {
+		cfg := strings.Join( argv[2:], " " )						// inline json may contain spaces
+		if n := len( cfg ); n > 1 && ( cfg[0] == '\'' || cfg[0] == '"' ) && cfg[n-1] == cfg[0] {
+			cfg = cfg[1:n-1]
+		}
+		if strings.HasPrefix( cfg, "@" ) {
+			return []string { argv[0], argv[1], "-f", cfg[1:] }
+		}
+		return []string { argv[0], argv[1], cfg }
+	}
+
+	return argv
+}
+
+/*
+	Send the request and wait (up to timeout seconds, 0 forever) for the response
+	with its msg_key on dch; responses to other requests (e.g. earlier ones which
+	timed out) are skipped. Returns the response (nil if none), its state, the
+	first line of its msg, and the exit code for the state.
+*/
+func send_wait( w broker.Writer, dch chan amqp.Delivery, req string, timeout int, sheep *bleater.Bleater ) ( body []byte, state string, msg string, rc int ) {
+	var rmeta struct {
+		Msg_key	string	`json:"msg_key"`
+	}
+	json.Unmarshal( []byte( req ), &rmeta )
+	w.Port() <- req
+
+	var tmo <-chan time.Time
+	if timeout > 0 {
+		tmo = time.After( time.Duration( timeout ) * time.Second )
+	}
+
+	for {
+		select {
+			case d := <- dch:
+				resp := make( map[string]interface{} )
+				if json.Unmarshal( d.Body, &resp ) != nil || resp["msg_key"] != rmeta.Msg_key {
+					sheep.Baa( 2, "ignoring response for another request: %s", d.Body )
+					continue
+				}
+				state, _ = resp["state"].( string )
+				return d.Body, state, msg_line( resp["msg"] ), rc_for( &state )
+
+			case <- tmo:
+				return nil, "NORESPONSE", "no response from tokay", RC_no_response
+		}
+	}
+}
+
+/*
+	Run each request in the script, one line per request, over the one writer and reader.
+	Lines are an action and its arguments as they would be given on the command line; an
+	add config may be given as @file. Blank lines and lines starting with # are skipped.
+	Requests are run in order, each waiting (up to timeout seconds, 0 forever) for its
+	response which is matched on msg_key.  A summary line is written for each request,
+	preceded by the response in the format given (none if format is empty).  Returns the
+	exit code for the first request which didn't succeed, or RC_ok.
+*/
+func run_script( script io.Reader, w broker.Writer, rdr broker.Reader, timeout int, format string, sheep *bleater.Bleater ) ( rc int ) {
+	dch := make( chan amqp.Delivery, 4096 )
+	defer rdr.Close()
+	if err := rdr.Start_eating( dch ); err != nil {
+		fmt.Fprintf( os.Stderr, "abort: unable to read responses: %s\n", err )
+		return RC_usage
+	}
+
+	br := bufio.NewScanner( script )
+	br.Buffer( make( []byte, 0, Rbuf_len ), 1024 * 1024 )
+	lnum := 0
+	nok := 0
+	nreq := 0
+	for br.Scan() {
+		lnum++
+		argv := strings.Fields( br.Text() )
+		if len( argv ) == 0 || strings.HasPrefix( argv[0], "#" ) {
+			continue
+		}
+		nreq++
+
+		argv = line_argv( argv )
+
+		state := ""
+		msg := ""
+		lrc := RC_ok
+		start := time.Now()
+		req, problems := mk_request( argv )
+		switch {
+			case len( problems ) > 0:
+				state = "INVALID"
+				msg = problems[0].Error()
+				if len( problems ) > 1 {
+					msg += fmt.Sprintf( " (and %d more)", len( problems ) - 1 )
+				}
+				lrc = RC_invalid
+
+			case req == "":
+				state = "INVALID"
+				msg = "unrecognised action or missing arguments"
+				lrc = RC_usage
+
+			default:
+				sheep.Baa( 2, "line %d: sending req: %s", lnum, req )
+				var body []byte
+				body, state, msg, lrc = send_wait( w, dch, req, timeout, sheep )
+				if body != nil && format != "" {
+					write_resp( body, format )
+				}
+		}
+
+		if lrc == RC_ok {
+			nok++
+		} else if rc == RC_ok {
+			rc = lrc
+		}
+		fmt.Printf( "%4d  %-10s %6dms  %s: %s\n", lnum, state, time.Since( start ).Milliseconds(), strings.Join( argv, " " ), msg )
+	}
+	if err := br.Err(); err != nil {
+		fmt.Fprintf( os.Stderr, "error reading script: %s\n", err )
+		if rc == RC_ok {
+			rc = RC_usage
+		}
+	}
+
+	fmt.Printf( "%d of %d requests succeeded\n", nok, nreq )
+	return rc
+}
+
+var shell_actions = []string { "add", "delete", "dump", "get", "list", "mirror", "ping", "Ping", "show", "verbose" }
+var shell_builtins = []string { "exit", "format", "help", "history", "quit", "timeout" }
+var show_types = []string { "all", "pfs", "extended", "mirror" }
+
+/*
+	Return the completions for the shell: the actions and builtins for the first
+	word, show types and targets used so far for a target.
+*/
+func shell_completer( targets map[string]bool ) ( lineedit.Completer ) {
+	return func( before []string, partial string ) ( []string ) {
+		if len( before ) == 0 {
+			return append( append( []string {}, shell_actions... ), shell_builtins... )
+		}
+		if len( before ) > 1 {
+			return nil
+		}
+
+		c := make( []string, 0, len( targets ) + len( show_types ) )
+		switch before[0] {
+			case "show":
+				c = append( c, show_types... )
+
+			case "format":
+				return append( []string { "raw", "pretty" }, render.Formats... )
+
+			case "add", "del", "delete", "get":			// just the targets
+
+			default:
+				return nil
+		}
+		for t := range targets {
+			c = append( c, t )
+		}
+		sort.Strings( c )
+		return c
+	}
+}
+
+/*
+	Interactive shell: read requests from the terminal, one per line as they would
+	be given in a batch script, and send each over the one writer and reader. Each
+	response is matched on msg_key and written in the format (pretty printed json
+	if empty). The history is kept in ~/.tokay_req_history. Returns the exit code
+	of the last request.
+*/
+func run_shell( w broker.Writer, rdr broker.Reader, timeout int, format string, sheep *bleater.Bleater ) ( rc int ) {
+	dch := make( chan amqp.Delivery, 4096 )
+	defer rdr.Close()
+	if err := rdr.Start_eating( dch ); err != nil {
+		fmt.Fprintf( os.Stderr, "abort: unable to read responses: %s\n", err )
+		return RC_usage
+	}
+
+	targets := make( map[string]bool )
+	ed := lineedit.Mk_editor( os.Stdin, os.Stdout )
+	ed.Complete = shell_completer( targets )
+	hfile := profile.Expand( "~/.tokay_req_history" )
+	if err := ed.Load_history( hfile ); err != nil {
+		sheep.Baa( 1, "unable to load history: %s", err )
+	}
+	defer func() {
+		if err := ed.Save_history( hfile ); err != nil {
+			sheep.Baa( 1, "unable to save history: %s", err )
+		}
+	}()
+
+	if ed.Is_tty() {
+		fmt.Printf( "connected; enter requests as on the command line (help lists commands, ^D exits)\n" )
+	}
+	for {
+		line, err := ed.Read_line( "tokay> " )
+		if err == lineedit.Err_interrupt {
+			continue
+		}
+		if err != nil {
+			if err != io.EOF {
+				fmt.Fprintf( os.Stderr, "error reading input: %s\n", err )
+			}
+			return rc
+		}
+
+		argv := strings.Fields( line )
+		if len( argv ) == 0 || strings.HasPrefix( argv[0], "#" ) {
+			continue
+		}
+		ed.Add_history( line )
+
+		switch argv[0] {
+			case "exit", "quit":
+				return rc
+
+			case "help", "?":
+				fmt.Printf( "requests: %s\n", strings.Join( shell_actions, ", " ) )
+				fmt.Printf( "    add <target> @<file> | add <target> '<config-json>'\n" )
+				fmt.Printf( "format [table|csv|json|yaml|raw|pretty]   show or set the output format\n" )
+				fmt.Printf( "timeout [seconds]   show or set the response timeout (0 waits forever)\n" )
+				fmt.Printf( "history   list previous lines\n" )
+				fmt.Printf( "exit, quit, ^D   leave the shell\n" )
+				continue
+
+			case "history":
+				for i, h := range ed.History() {
+					fmt.Printf( "%4d  %s\n", i + 1, h )
+				}
+				continue
+
+			case "format":
+				if len( argv ) > 1 {
+					switch {
+						case argv[1] == "pretty":	format = ""
+						case argv[1] == "raw", render.Valid( argv[1] ):	format = argv[1]
+						default:
+							fmt.Printf( "unrecognised output format: %s\n", argv[1] )
+							continue
+					}
+				}
+				if format == "" {
+					fmt.Printf( "format: pretty\n" )
+				} else {
+					fmt.Printf( "format: %s\n", format )
+				}
+				continue
+
+			case "timeout":
+				if len( argv ) > 1 {
+					var t int
+					if _, err := fmt.Sscanf( argv[1], "%d", &t ); err != nil || t < 0 {
+						fmt.Printf( "timeout must be a number of seconds\n" )
+						continue
+					}
+					timeout = t
+				}
+				fmt.Printf( "timeout: %ds\n", timeout )
+				continue
+		}
+
+		argv = line_argv( argv )
+		req, problems := mk_request( argv )
+		if len( problems ) > 0 {
+			fmt.Printf( "VF config is not valid:\n" )
+			for _, p := range problems {
+				fmt.Printf( "\t%s\n", p )
+			}
+			rc = RC_invalid
+			continue
+		}
+		if req == "" {
+			fmt.Printf( "unrecognised action or missing arguments: %s (try help)\n", argv[0] )
+			rc = RC_usage
+			continue
+		}
+		if len( argv ) > 1 {
+			switch argv[0] {
+				case "add", "del", "delete", "get", "show":
+					targets[argv[1]] = true
+			}
+		}
+
+		sheep.Baa( 2, "sending req: %s", req )
+		start := time.Now()
+		body, state, msg, lrc := send_wait( w, dch, req, timeout, sheep )
+		rc = lrc
+		switch {
+			case body == nil:
+				fmt.Printf( "%s: %s within %ds\n", state, msg, timeout )
+
+			case format == "":
+				if jt, err := jsontools.Json2tree( body ); err == nil {
+					jt.Pretty_print( os.Stdout )
+				} else {
+					fmt.Printf( "%s\n", body )
+				}
+
+			default:
+				write_resp( body, format )
+		}
+		sheep.Baa( 1, "%s %dms", state, time.Since( start ).Milliseconds() )
+	}
+}
+
+/*
+	What we heard from one tokay during a fan out.
+*/
+type fan_result struct {
+	Sender		string			`json:"sender"`
+	Key			string			`json:"key"`			// request routing key the request was sent with
+	State		string			`json:"state"`
+	Msg			string			`json:"msg"`
+	Response	json.RawMessage	`json:"response,omitempty"`
+}
+
+/*
+	Send the request to each tokay by publishing it once for each routing key in keys, and
+	collect the responses. Each copy of the request gets its own msg_key so that responses
+	can be tied back to the key they answer; a key which reaches several tokays (e.g. on a
+	topic exchange) produces several responses. Responses are collected until timeout
+	seconds pass, or sooner once every key has been answered and, if expect is not empty,
+	every sender listed has answered; when wait_all is set (the exchange may route a key
+	to many tokays) and nothing is expected, we always wait for the timeout.
+
+	Every response is kept, even when two come from the same (or an unnamed) sender; they
+	are only grouped by sender when written. The combined results are written in the
+	format: table (the default), csv, json, yaml or raw (indented json).
+	Keys and expected senders with no response are flagged as NORESPONSE. Returns the exit
+	code: RC_no_response if anything didn't answer, otherwise that of the first response
+	that wasn't OK.
+*/
+func run_fanout( req string, keys []string, expect []string, w broker.Writer, rdr broker.Reader, timeout int, wait_all bool, format string, sheep *bleater.Bleater ) ( rc int ) {
+	dch := make( chan amqp.Delivery, 4096 )
+	defer rdr.Close()
+	if err := rdr.Start_eating( dch ); err != nil {
+		fmt.Fprintf( os.Stderr, "abort: unable to read responses: %s\n", err )
+		return RC_usage
+	}
+
+	jreq := make( map[string]interface{} )
+	if err := json.Unmarshal( []byte( req ), &jreq ); err != nil {
+		fmt.Fprintf( os.Stderr, "internal error: request isn't valid json: %s\n", err )
+		return RC_usage
+	}
+
+	mkeys := make( map[string]string )					// msg_key -> routing key
+	answered := make( map[string]bool )					// by routing key
+	for _, k := range keys {
+		mk := gen_key()
+		mkeys[mk] = k
+		jreq["msg_key"] = mk
+		jr, _ := json.Marshal( jreq )
+		sheep.Baa( 2, "fan out to %s: %s", k, jr )
+		w.Port() <- &rabbit_hole.Mq_msg { Data: jr, Key: k }
+	}
+
+	if timeout <= 0 {
+		timeout = 30									// we have to stop sometime
+	}
+	tmo := time.After( time.Duration( timeout ) * time.Second )
+	results := make( []*fan_result, 0, len( keys ) )	// every response, in arrival order
+	heard := make( map[string]bool )					// senders which answered
+	collecting := true
+	for collecting {
+		select {
+			case d := <- dch:
+				var resp struct {
+					Sender	string		`json:"sender"`
+					State	string		`json:"state"`
+					Msg_key	string		`json:"msg_key"`
+					Msg		interface{}	`json:"msg"`
+				}
+				if json.Unmarshal( d.Body, &resp ) != nil {
+					continue
+				}
+				k, ok := mkeys[resp.Msg_key]
+				if ! ok {
+					sheep.Baa( 2, "ignoring response for another request: %s", d.Body )
+					continue
+				}
+
+				answered[k] = true
+				heard[resp.Sender] = true
+				results = append( results, &fan_result { Sender: resp.Sender, Key: k, State: resp.State, Msg: msg_line( resp.Msg ), Response: json.RawMessage( d.Body ) } )
+
+				done := len( answered ) == len( keys ) && ( ! wait_all || len( expect ) > 0 )
+				for _, e := range expect {
+					if ! heard[e] {
+						done = false
+					}
+				}
+				collecting = ! done
+
+			case <- tmo:
+				collecting = false
+		}
+	}
+
+	list := results
+	for _, k := range keys {
+		if ! answered[k] {
+			list = append( list, &fan_result { Key: k, State: "NORESPONSE", Msg: "no response for key" } )
+		}
+	}
+	for _, e := range expect {
+		if ! heard[e] {
+			list = append( list, &fan_result { Sender: e, State: "NORESPONSE", Msg: "expected sender did not respond" } )
+		}
+	}
+	sort.SliceStable( list, func( i, j int ) bool { return list[i].Sender < list[j].Sender } )
+
+	for _, r := range list {
+		switch {
+			case r.State == "NORESPONSE":
+				rc = RC_no_response
+
+			case rc == RC_ok:
+				rc = rc_for( &r.State )
+		}
+	}
+
+	switch format {
+		case "json", "yaml", "raw":
+			by_sender := make( map[string][]*fan_result )		// a sender may have answered more than once
+			missing := make( []*fan_result, 0 )
+			for _, r := range list {
+				if r.State == "NORESPONSE" {
+					missing = append( missing, r )
+				} else {
+					by_sender[r.Sender] = append( by_sender[r.Sender], r )
+				}
+			}
+			out, _ := json.MarshalIndent( map[string]interface{} { "responses": by_sender, "missing": missing }, "", "  " )
+			write_resp( out, format )
+
+		case "csv":
+			cw := csv.NewWriter( os.Stdout )
+			cw.Write( []string { "SENDER", "KEY", "STATE", "MSG" } )
+			for _, r := range list {
+				cw.Write( []string { r.Sender, r.Key, r.State, r.Msg } )
+			}
+			cw.Flush()
+
+		default:
+			fmt.Printf( "%-32s %-20s %-10s %s\n", "SENDER", "KEY", "STATE", "MSG" )
+			for _, r := range list {
+				sender := r.Sender
+				if sender == "" {
+					sender = "-"
+				}
+				fmt.Printf( "%-32s %-20s %-10s %s\n", sender, r.Key, r.State, r.Msg )
+			}
+	}
+
+	return rc
+}
+
+/*
+	Apply the profile environment to the settings which were not given on the command
+	line (set holds the names of the flags which were).
+*/
+func apply_env( env *profile.Env, set map[string]bool, host *string, port *string, exch *string, rexch *string, evexch *string, stexch *string ) {
+	if env == nil {
+		return
+	}
+
+	for _, f := range []struct {
+		flag	string
+		dest	*string
+		value	string
+	} {
+		{ "h", host, env.Host },
+		{ "p", port, env.Port },
+		{ "e", exch, env.Req_exch },
+		{ "r", rexch, env.Resp_exch },
+		{ "W", evexch, env.Events_exch },
+		{ "X", stexch, env.Stats_exch },
+	} {
+		if ! set[f.flag] && f.value != "" {
+			*f.dest = f.value
+		}
+	}
+}
+
+/*
+	Split an exchange given as name[:type[:key]]; missing parts come from the defaults.
+*/
+func split_exch( exch string, etype string, key string ) ( string, string, string ) {
+	tokens := strings.Split( exch, ":" )
+	switch len( tokens ) {
+		case 3:
+			key = tokens[2]
+			fallthrough
+		case 2:
+			etype = tokens[1]
+	}
+
+	return tokens[0], etype, key
+}
+
+/*
+	Watch mode: bind a reader with the topic filter to each of the exchanges (events
+	and stats; empty names are skipped) and write every message received to stdout
+	until interrupted. Without an output format the routing key is written before
+	the pretty printed message.
+*/
+func run_watch( mq broker.Broker, exchanges []string, filter string, format string, sheep *bleater.Bleater ) ( rc int ) {
+	wch := make( chan amqp.Delivery, 4096 )
+	readers := make( []broker.Reader, 0, len( exchanges ) )
+
+	for _, ex := range exchanges {
+		if ex == "" {
+			continue
+		}
+
+		name, etype, _ := split_exch( ex, "topic+!du+ad", "" )
+		r, err := mq.Mk_reader( name, etype, &filter )
+		if err != nil {
+			fmt.Fprintf( os.Stderr, "abort: unable to attach a reader on %s: %s\n", name, err )
+			return 1
+		}
+		sheep.Baa( 1, "watching %s ex=%s etype=%s filter=%s", mq, name, etype, filter )
+		if err := r.Start_eating( wch ); err != nil {
+			fmt.Fprintf( os.Stderr, "abort: unable to read from %s: %s\n", name, err )
+			r.Close()
+			return 1
+		}
+		readers = append( readers, r )
+	}
+	if len( readers ) == 0 {
+		fmt.Fprintf( os.Stderr, "nothing to watch: both the events (-W) and stats (-X) exchanges are off\n" )
+		return RC_usage
+	}
+
+	sig_ch := make( chan os.Signal, 1 )
+	signal.Notify( sig_ch, os.Interrupt )
+
+	first := true
+	for {
+		select {
+			case msg := <- wch:
+				switch format {
+					case "":
+						fmt.Printf( "--- %s\n", msg.RoutingKey )
+						if jt, err := jsontools.Json2tree( msg.Body ); err == nil {
+							jt.Pretty_print( os.Stdout )
+						} else {
+							fmt.Printf( "%s\n", msg.Body )
+						}
+
+					case "raw":
+						fmt.Printf( "%s %s\n", msg.RoutingKey, msg.Body )
+
+					default:
+						if render.Write_stream( os.Stdout, format, msg.RoutingKey, msg.Body, first ) != nil {
+							fmt.Printf( "%s %s\n", msg.RoutingKey, msg.Body )
+						}
+				}
+				first = false
+
+			case <- sig_ch:
+				for _, r := range readers {
+					r.Stop()
+					r.Close()
+				}
+				return RC_ok
+		}
+	}
+}
+
+// -----------------------------------------------------------------------------------------------
+
+func main( ) {
+	var (
+		uname	string = ""
+		pw		string = ""
+		err		error
+		done = make( chan int, 1 )				// collector sends the exit code when finished
+	)
+
+	script		:= flag.String( "b", "", "batch: run the requests in the script file (- for stdin), one per line" )
+	fan_keys	:= flag.String( "F", "", "fan out: comma separated request routing keys; the request is sent with each" )
+	expect		:= flag.String( "S", "", "fan out: comma separated tokay senders expected to respond" )
+	prof_file	:= flag.String( "c", "", "profile file (default ~/.tokay_req if it exists)" )
+	env_name	:= flag.String( "E", "", "environment from the profile file (default is the profile's default)" )
+	events_exch	:= flag.String( "W", "tokay_events:topic+!du+ad", "watch: exchange tokay writes events to (empty to skip)" )
+	stats_exch	:= flag.String( "X", "tokay_stats:topic+!du+ad", "watch: exchange tokay writes stats to (empty to skip)" )
+	exchange	:= flag.String( "e", "tokay_req", "exchange tokay is listening on (can be given as exname:type+ops:key)" )
+	ex_host		:= flag.String( "h", "localhost", "host where RabbitMQ is running" )
+	raw_json	:= flag.Bool( "j", false, "raw json output" )
+	out_fmt		:= flag.String( "o", "", "output format: table, csv, json or yaml" )
+	rmqport		:= flag.String( "p", "5672", "Rabbit MQ port" )
+	rexch		:= flag.String( "r", "tokay_resp", "exchange tokay will write to" )
+	timeout		:= flag.Int( "t", 30, "seconds to wait for a response (0 waits forever)" )
+
+	vlevel		:= flag.Uint( "V", 0, "verbosity level n" )
+	verbose		:= flag.Bool( "v", false, "verbosity 1" )
+	wants_help	:= flag.Bool( "?", false, "print additional usage details" )
+	flag.Parse()
+	argv := flag.Args()		// positional arguments
+
+	if *wants_help || ( len( argv ) <= 0 && *script == "" ) {
+		fmt.Fprintf( os.Stderr, "tokay_req V1.0/18320\n\n" )
+		flag.Usage()
+
+		fmt.Fprintf( os.Stderr, "\n" )
+		fmt.Fprintf( os.Stderr, "exchange types:  direct, fanout, topic\n" )
+		fmt.Fprintf( os.Stderr, "exchange opts:  ad | !ad  (autodelete)\n" )
+		fmt.Fprintf( os.Stderr, "exchange opts:  du | !du  (durable)\n" )
+		fmt.Fprintf( os.Stderr, "exchange options are separated from type, and each other, by a plus sign (+)\n" )
+		fmt.Fprintf( os.Stderr, "\nRMQ_UNAME and RMQ_PW must be set in the environment, or a credentials file given in the profile,\n" )
+		fmt.Fprintf( os.Stderr, "to provide rabbit user name and password. The environment wins if both are set.\n" )
+		fmt.Fprintf( os.Stderr, "Profile environments supply host, port, exchanges, credentials and TLS; command line flags override them.\n" )
+		fmt.Fprintf( os.Stderr, "Valid arguments: add, delete, get, list, show, mirror, verbose, shell, watch\n" )
+		fmt.Fprintf( os.Stderr, "add usage: add <target> '<config-json>' | add <target> -f <file>  (- reads standard input); the config is validated before sending\n" )
+		fmt.Fprintf( os.Stderr, "batch scripts (-b) have one request per line as given on the command line; add configs may be given as @file\n" )
+		fmt.Fprintf( os.Stderr, "fan out (-F) results are listed by sender; keys and -S senders which don't answer within -t are flagged\n" )
+		fmt.Fprintf( os.Stderr, "shell: an interactive prompt which sends each request typed over one connection; tab completes actions and targets\n" )
+		fmt.Fprintf( os.Stderr, "watch usage: watch [topic-filter]  (default #); streams tokay events (-W) and stats (-X) until interrupted\n" )
+		fmt.Fprintf( os.Stderr, "    event keys are events.<sender>.<vf.add|vf.delete|vf.update|vfd.up|vfd.down|error>; stats keys are stats.<sender>.<pf|vf>\n" )
+		fmt.Fprintf( os.Stderr, "output (-o): table lists PF/VF/link/vlans/macs for show responses; json is one line with sorted keys\n" )
+		fmt.Fprintf( os.Stderr, "\nexit codes:  %d OK, %d usage/setup error, %d ERROR, %d TIMEOUT, %d CONFLICT, %d THROTTLED, %d INVALID,\n",
+			RC_ok, RC_usage, RC_error, RC_timeout, RC_conflict, RC_throttled, RC_invalid )
+		fmt.Fprintf( os.Stderr, "             %d no response within -t seconds, %d response state missing or unrecognised\n", RC_no_response, RC_unknown )
+
+		rc := 0
+		if ! *wants_help {
+			rc = 1
+		}
+		
+		os.Exit( rc )
+	}
+
+	format := *out_fmt						// empty is the pretty printed tree
+	if format == "" && *raw_json {
+		format = "raw"
+	}
+	if *out_fmt != "" && ! render.Valid( *out_fmt ) {
+		fmt.Fprintf( os.Stderr, "unrecognised output format: %s (expected one of: %s)\n", *out_fmt, strings.Join( render.Formats, ", " ) )
+		os.Exit( RC_usage )
+	}
+
+	if *vlevel <= 0 && *verbose {
+		*vlevel = 1
+	}
+	sheep := bleater.Mk_bleater( *vlevel, os.Stderr )		// the master bleater should we ever have a daemon like control interface to affect all thread levels
+	sheep.Set_prefix( "main" )
+	sheep.Set_level( *vlevel )
+	resp_key = gen_key()									// the key used as the rmq response exchange key
+
+	watching := len( argv ) > 0 && argv[0] == "watch"
+	shell := len( argv ) > 0 && argv[0] == "shell"
+	req := ""
+	if *script == "" && ! watching && ! shell {
+		var problems []vfcfg.Field_error
+		if req, problems = mk_request( argv ); len( problems ) > 0 {
+			fmt.Fprintf( os.Stderr, "VF config is not valid:\n" )
+			for _, p := range problems {
+				fmt.Fprintf( os.Stderr, "\t%s\n", p )
+			}
+			os.Exit( RC_invalid )
+		}
+		if argv[0] == "Ping" {
+			sheep.Baa( 1, "sending request: %s", req )
+		}
+
+		if req == "" {
+			sheep.Baa( 0, "unrecognised action or invalid arguments for %s", argv[0] )
+			flag.Usage()
+			os.Exit( 1 )
+		}
+		sheep.Baa( 2, "sending req: %s", req )
+	}
+	
+	set := make( map[string]bool )			// flags given on the command line; these win over the profile
+	flag.Visit( func( f *flag.Flag ) { set[f.Name] = true } )
+	pfname := *prof_file
+	if pfname == "" {
+		pfname = profile.Default_file()
+	}
+	prof, err := profile.Load( pfname, *prof_file != "" )		// the default file need not exist
+	if err != nil {
+		fmt.Fprintf( os.Stderr, "abort: %s\n", err )
+		os.Exit( 1 )
+	}
+	env, err := prof.Env( *env_name )
+	if err != nil {
+		fmt.Fprintf( os.Stderr, "abort: %s\n", err )
+		os.Exit( 1 )
+	}
+	apply_env( env, set, ex_host, rmqport, exchange, rexch, events_exch, stats_exch )
+
+	pw = os.Getenv( "RMQ_PW" )				// user name and password must come from environment so it's not exposed on the command line
+	uname = os.Getenv( "RMQ_UNAME" )
+	if pw == "" || uname == "" {			// or from the credentials file named in the profile
+		cuname, cpw, err := env.Creds()
+		if err != nil {
+			fmt.Fprintf( os.Stderr, "abort: %s\n", err )
+			os.Exit( 1 )
+		}
+		if uname == "" {
+			uname = cuname
+		}
+		if pw == "" {
+			pw = cpw
+		}
+	}
+
+	if pw == "" || uname == ""  {
+		fmt.Fprintf( os.Stderr, "rabbitMQ username and password must be defined in the environment (RMQ_PW, RMQ_UNAME) or a profile credentials file\n" )
+		os.Exit( 1 )
+	}
+
+	var mq broker.Broker = broker.Mk_rmq( *ex_host, *rmqport, uname, pw )
+	if env != nil && env.Tls != nil {		// rabbit_hole can't do TLS; go direct
+		tcfg, err := broker.Tls_config( profile.Expand( env.Tls.Ca ), profile.Expand( env.Tls.Cert ), profile.Expand( env.Tls.Key ), env.Tls.Skip_verify )
+		if err != nil {
+			fmt.Fprintf( os.Stderr, "abort: %s\n", err )
+			os.Exit( 1 )
+		}
+		mq = broker.Mk_amqp( *ex_host, *rmqport, uname, pw, tcfg )
+	}
+
+	if watching {
+		filter := "#"
+		if len( argv ) > 1 {
+			filter = argv[1]
+		}
+		os.Exit( run_watch( mq, []string { *events_exch, *stats_exch }, filter, format, sheep ) )
+	}
+
+	etype := "direct+!du+ad"								// direct, auto delete, not durable
+	ekey := "tokay_req"										// default key for request messages
+
+	tokens := strings.Split( *exchange, ":" )				// exch might be exname:etype:key where type might be <type>+[!]<attr1>[!]<attr2>.. etc
+	switch len( tokens ) {
+		case 1:	
+			break;					// just exchange name
+
+		case 3:						// exchagne etype and key
+			ekey = tokens[2]
+			fallthrough
+		case 2:						// exchange etype
+			exchange = &tokens[0]
+			etype = tokens[1]
+	}
+
+	sheep.Baa( 1, "attaching writer to %s ex=%s etype=%s wkey=%s", mq, *exchange, etype, ekey )
+	w, err := mq.Mk_writer( *exchange, etype, &ekey )		// attach to the exchange for writing
+	if err != nil {
+		sheep.Baa(  0, "abort: unable to attach a writer to %s: %s\n", exchange, err )
+		os.Exit( 1 )
+	}
+	w.Start_writer( ekey )				// let it loose
+	etype_req := etype					// fan out needs to know if one key may reach many
+
+	ekey = resp_key										// shouldn't be overriden below, but allow for testing maybe?
+	etype = "direct+!du+ad"								// can be supplied on exchange name, but we hope it's not needed
+
+	tokens = strings.Split( *rexch, ":" )				// prep response reader exchange
+	switch len( tokens ) {
+		case 1:	
+			break;					// just exchange name everything unchanged
+
+		case 3:						// exchagne etype and key
+			//ekey = tokens[2]		// we don't allow response key to be fiddled since we already generated the request before setting connections
+			fallthrough
+		case 2:						// exchange etype
+			rexch = &tokens[0]
+			etype = tokens[1]
+	}
+	r, err := mq.Mk_reader( *rexch, etype, &ekey )		// collector expected to close r on return
+	sheep.Baa( 1, "attaching reader to %s ex=%s etype=%s rkey=%s", mq, *rexch, etype, ekey )
+	if err != nil {
+		fmt.Fprintf( os.Stderr, "abort: unable to attach a reader on %s: %s\n", *rexch, err )
+		os.Exit( 1 )
+	}
+
+	if *script != "" {
+		var sf io.Reader = os.Stdin
+		if *script != "-" {
+			f, err := os.Open( *script )
+			if err != nil {
+				fmt.Fprintf( os.Stderr, "abort: unable to open script: %s\n", err )
+				os.Exit( 1 )
+			}
+			defer f.Close()
+			sf = f
+		}
+
+		rc := run_script( sf, w, r, *timeout, format, sheep )
+		w.Close()
+		os.Exit( rc )
+	}
+
+	if shell {
+		rc := run_shell( w, r, *timeout, format, sheep )
+		w.Close()
+		os.Exit( rc )
+	}
+
+	if *fan_keys != "" {
+		base := strings.SplitN( etype_req, "+", 2 )[0]
+		var senders []string
+		if *expect != "" {
+			senders = strings.Split( *expect, "," )
+		}
+		rc := run_fanout( req, strings.Split( *fan_keys, "," ), senders, w, r, *timeout, base == "topic" || base == "fanout", format, sheep )
+		w.Close()
+		os.Exit( rc )
+	}
+
+	go collector( *rexch, r, 1, format, done, sheep )		// wait for the one message we expect, write to stdout and stop
+	sheep.Baa( 1, "bidirectional communication established" )
+
+	w.Port() <- req						// send the request, then hang tight until collector hears back
+
+	var tmo <-chan time.Time			// nil (never fires) if no timeout
+	if *timeout > 0 {
+		tmo = time.After( time.Duration( *timeout ) * time.Second )
+	}
+	rc := RC_no_response
+	select {
+		case rc = <- done:
+
+		case <- tmo:
+			fmt.Fprintf( os.Stderr, "no response from tokay within %ds\n", *timeout )
+	}
+
+	w.Close()
+	os.Exit( rc )
+}
@@ -0,0 +1,99 @@
+// vi: sw=4 ts=4:
+/*
+	Mnemonic:	tokay_req_test.go
+	Abstract:	Tests for the fix up of script and shell lines before they are made
+				into requests.
+
+	Date:		18 October 2026
+*/
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLineArgv( t *testing.T ) {
+	for _, c := range []struct {
+		line	string
+		want	[]string
+	} {
+		{ `add vm1 { "pciid": "0000:01:00.0", "vfid": 1 }`, []string { "add", "vm1", `{ "pciid": "0000:01:00.0", "vfid": 1 }` } },
+		{ `add vm1 '{ "pciid": "0000:01:00.0", "vfid": 1 }'`, []string { "add", "vm1", `{ "pciid": "0000:01:00.0", "vfid": 1 }` } },		// as the shell help shows it
+		{ `add vm1 '{"pciid":"0000:01:00.0","vfid":1}'`, []string { "add", "vm1", `{"pciid":"0000:01:00.0","vfid":1}` } },
+		{ `add vm1 "{ 'vfid': 1 }"`, []string { "add", "vm1", `{ 'vfid': 1 }` } },
+		{ `add vm1 ''{ "vfid": 1 }''`, []string { "add", "vm1", `'{ "vfid": 1 }'` } },							// only one level removed
+		{ `add vm1 '{ "vfid": 1 }`, []string { "add", "vm1", `'{ "vfid": 1 }` } },								// unbalanced; left for validation to reject
+		{ `add vm1 '`, []string { "add", "vm1", `'` } },
+		{ `add vm1 @/tmp/vm1.json`, []string { "add", "vm1", "-f", "/tmp/vm1.json" } },
+		{ `add vm1 '@/tmp/vm1.json'`, []string { "add", "vm1", "-f", "/tmp/vm1.json" } },
+		{ `add vm1 -f /tmp/vm1.json`, []string { "add", "vm1", "-f", "/tmp/vm1.json" } },
+		{ `add vm1`, []string { "add", "vm1" } },
+		{ `show 'all'`, []string { "show", "'all'" } },															// only add configs are unquoted
+		{ `delete vm1`, []string { "delete", "vm1" } },
+	} {
+		got := line_argv( strings.Fields( c.line ) )
+		if strings.Join( got, "|" ) != strings.Join( c.want, "|" ) {
+			t.Errorf( "%s: expected %q, got %q", c.line, c.want, got )
+		}
+	}
+}
+
+/*
+	The quoted config, as given in the shell, must pass validation once the line
+	is fixed up; without that the quote is taken as part of the json.
+*/
+func TestLineArgvRequest( t *testing.T ) {
+	argv := strings.Fields( `add vm1 '{ "pciid": "0000:01:00.0", "vfid": 1 }'` )
+
+	if _, problems := mk_request( []string { argv[0], argv[1], strings.Join( argv[2:], " " ) } ); len( problems ) == 0 {
+		t.Errorf( "expected the quoted config to be rejected when not fixed up" )
+	}
+
+	req, problems := mk_request( line_argv( argv ) )
+	if len( problems ) > 0 {
+		t.Fatalf( "quoted config not accepted: %v", problems )
+	}
+	if ! strings.Contains( req, `"target": "vm1"` ) || ! strings.Contains( req, `"req_data": {"pciid":"0000:01:00.0","vfid":1}` ) {
+		t.Errorf( "unexpected request: %s", req )
+	}
+}
+
+/*
+	The shell's completions: actions and builtins first, then show types and the
+	targets used so far (which the shell adds to after the completer is made).
+*/
+func TestShellCompleter( t *testing.T ) {
+	targets := make( map[string]bool )
+	complete := shell_completer( targets )
+	targets["vm2"] = true
+	targets["vm1"] = true
+
+	first := strings.Join( complete( nil, "" ), " " )
+	for _, w := range []string { "add", "delete", "ping", "Ping", "show", "help", "history", "exit" } {
+		if ! strings.Contains( " " + first + " ", " " + w + " " ) {
+			t.Errorf( "%s missing from the first word completions: %s", w, first )
+		}
+	}
+
+	for _, c := range []struct {
+		before	string
+		want	string
+	} {
+		{ "show", "all extended mirror pfs vm1 vm2" },
+		{ "add", "vm1 vm2" },
+		{ "delete", "vm1 vm2" },
+		{ "get", "vm1 vm2" },
+		{ "ping", "" },
+		{ "show all", "" },
+	} {
+		if got := strings.Join( complete( strings.Fields( c.before ), "" ), " " ); got != c.want {
+			t.Errorf( "%s: expected %q, got %q", c.before, c.want, got )
+		}
+	}
+
+	if got := strings.Join( complete( []string { "format" }, "" ), " " ); ! strings.Contains( got, "raw" ) || ! strings.Contains( got, "pretty" ) {
+		t.Errorf( "format: expected raw and pretty among %q", got )
+	}
+}
@@ -0,0 +1,222 @@
+// vi: sw=4 ts=4:
+/*
+	Mnemonic:	tokay_test.go
+	Abstract:	Runs the pipeline end to end without rabbit or VFd: requests are
+				published on an in memory broker and VFd is replaced by the fake,
+				connected through a fifo pair or a unix socket (stream or
+				seqpacket) in a scratch directory. Each case in the standard
+				harness set is a subtest; they run in order as later cases depend
+				on the VFs added by earlier ones. The set is run over each
+				transport, and once for each of the configurations which change
+				what tokay does; the socket transports are also disconnected to
+				check that tokay fails cleanly and reconnects.
+
+				go test -v lists the cases; the pipeline's own log is written when
+				TOKAY_TEST_VERBOSE is set to a bleater level.
+
+	Date:		18 October 2026
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/att/gopkgs/bleater"
+	"github.com/att/gopkgs/jsontools"
+
+	"github.com/att/vfd.gaol/tokay/lib/broker"
+	"github.com/att/vfd.gaol/tokay/lib/cfgstore"
+	"github.com/att/vfd.gaol/tokay/lib/chcom"
+	"github.com/att/vfd.gaol/tokay/lib/eom"
+	"github.com/att/vfd.gaol/tokay/lib/fakevfd"
+	"github.com/att/vfd.gaol/tokay/lib/harness"
+	"github.com/att/vfd.gaol/tokay/lib/inflight"
+	"github.com/att/vfd.gaol/tokay/lib/throttle"
+	"github.com/att/vfd.gaol/tokay/lib/vfcfg"
+	"github.com/att/vfd.gaol/tokay/lib/vfdlink"
+)
+
+/*
+	Start the fake VFd and the pipeline in a scratch directory, linked by the
+	transport (fifo, unix or unixpacket). The fake is returned so that cases can
+	change its behaviour. If setup is not nil it is called to change the context
+	before the pipeline is started.
+*/
+func mk_test_pipeline( t *testing.T, transport string, setup func( *context ) ) ( *context, *fakevfd.Vfd, *broker.Mem ) {
+	var vlevel uint
+
+	if v, err := strconv.Atoi( os.Getenv( "TOKAY_TEST_VERBOSE" ) ); err == nil {
+		vlevel = uint( v )
+	}
+	sheep := bleater.Mk_bleater( vlevel, os.Stderr )
+	sheep.Set_prefix( "tokay_test" )
+	sheep.Set_level( vlevel )
+
+	tdir := t.TempDir()
+
+	fake := fakevfd.Mk_vfd( &fakevfd.Options {
+		Log:	func( format string, args ...interface{} ) { sheep.Baa( 2, "fake VFd: " + format, args... ) },
+	} )
+	req_fifo := tdir + "/request"
+	sock_path := tdir + "/vfd.sock"
+	if transport == "fifo" {
+		f, err := vfdlink.Mk_fifo( req_fifo )					// must exist before we open our end
+		if err != nil {
+			t.Fatalf( "unable to create request fifo: %s", err )
+		}
+		f.Close()
+		go fake.Serve_fifo( req_fifo )
+	} else {
+		go fake.Serve_socket( transport, sock_path )
+	}
+
+	mem := broker.Mk_mem()
+	ctx := &context {
+		flags:			FL_forreal,
+		wg:				&sync.WaitGroup{},
+		synch_ch:		make( chan *chcom.Request, 2048 ),
+		lowpri_ch:		make( chan *chcom.Request, 16 ),
+		resp_ch:		make( chan interface{}, 1024 ),
+		sid:			gen_sender_id(),
+		req_fifo:		req_fifo,
+		resp_fifo:		tdir + "/tokay_fifo",
+		max_resp:		eom.Default_max,
+		resp_timeout:	2,
+		resp_grace:		1,
+		cdir:			tdir,
+		inflight:		inflight.Mk_tracker(),
+		tpolicy:		&vfcfg.Name_policy { },
+		broker:			mem,
+		rpc_broker:		mem,
+		wr_exch:		"tokay_resp",
+	}
+	ctx.transport = fmt.Sprintf( "fifo: %s/%s", ctx.req_fifo, ctx.resp_fifo )
+	if transport != "fifo" {
+		ctx.transport = fmt.Sprintf( "%s: %s", transport, sock_path )
+	}
+
+	var err error
+	if ctx.store, err = cfgstore.Mk_store( ctx.cdir, ctx.cdir + "/tokay_store.idx" ); err != nil {
+		t.Fatalf( "unable to create config store: %s", err )
+	}
+	for i := 0; i < 20; i++ {									// the fake may not be listening yet
+		if ctx.link, err = vfdlink.Mk_link( transport, ctx.req_fifo, ctx.resp_fifo, sock_path, ctx.max_resp ); err == nil {
+			break
+		}
+		time.Sleep( 50 * time.Millisecond )
+	}
+	if err != nil {
+		t.Fatalf( "unable to establish link to fake VFd: %s", err )
+	}
+
+	if setup != nil {
+		setup( ctx )
+	}
+	start_pipeline( ctx, "tokay_req", sheep )
+	time.Sleep( 250 * time.Millisecond )							// let collector bind
+
+	return ctx, fake, mem
+}
+
+const (
+	sender_burst	int = 3				// sender limit burst for the pipeline cases; the harness gives each case its own sender
+)
+
+/*
+	Start a pipeline over the transport with a sender rate limit and run the
+	standard cases against it, each as a subtest; the reconnect cases follow for
+	a socket transport. Setup (if not nil) makes further changes to the context.
+*/
+func run_std_cases( t *testing.T, transport string, setup func( *context ) ) {
+	ctx, fake, mem := mk_test_pipeline( t, transport, func( ctx *context ) {
+		ctx.sender_limit = throttle.Mk_limiter( 1, sender_burst )
+		if setup != nil {
+			setup( ctx )
+		}
+	} )
+	h := harness.Mk_harness( mem, "tokay_req", "tokay_req", "tokay_resp" )
+
+	env := &harness.Env {
+		Fake:		fake,
+		Conf_dir:	ctx.cdir,
+		Timeout:	time.Duration( ctx.resp_timeout ) * time.Second,
+		Reject_conflicts:	ctx.reject_conflicts,
+		Sender_burst:		sender_burst,
+		Vfd_update:			ctx.vfd_update,
+	}
+	cases := harness.Std_cases( env )
+	if transport != "fifo" {
+		cases = append( cases, harness.Reconnect_cases( env )... )
+	}
+	for _, c := range cases {
+		c := c
+		t.Run( c.Name, func( t *testing.T ) {
+			for _, r := range h.Run( []harness.Case { c } ) {
+				if ! r.Ok {
+					t.Errorf( "%s (after %s)", r.Why, r.Elapsed.Round( time.Millisecond ) )
+				}
+			}
+		} )
+	}
+}
+
+func TestPipeline( t *testing.T ) {
+	for _, transport := range []string { "fifo", "unix", "unixpacket" } {
+		t.Run( transport, func( t *testing.T ) {
+			run_std_cases( t, transport, nil )
+		} )
+	}
+}
+
+/*
+	The standard cases with the non-default settings: requests for a busy target
+	rejected (conflict_mode reject) rather than queued, and updates sent to VFd
+	(update_mode vfd) rather than done as a delete and add.
+*/
+func TestOtherModes( t *testing.T ) {
+	run_std_cases( t, "fifo", func( ctx *context ) {
+		ctx.reject_conflicts = true
+		ctx.vfd_update = true
+	} )
+}
+
+/*
+	Each limit is keyed on its own part of the request, and tokens taken by the
+	limits which allowed a request are given back when a later one rejects it.
+*/
+func TestThrottled( t *testing.T ) {
+	ctx := &context {
+		sender_limit:	throttle.Mk_limiter( 1, 1 ),
+		user_limit:		throttle.Mk_limiter( 1, 2 ),
+		exch_limit:		throttle.Mk_limiter( 1, 3 ),
+	}
+
+	mk_req := func( sender string, user string, source string ) ( *chcom.Request ) {
+		jt, _ := jsontools.Json2tree( []byte( fmt.Sprintf( `{ "action": "ping", "sender": %q }`, sender ) ) )
+		return &chcom.Request { User: user, Source: source, Jtree: jt }
+	}
+
+	for i, c := range []struct {
+		sender, user, source	string
+		want					string
+	} {
+		{ "s1", "u1", "ex1", "" },
+		{ "s1", "u1", "ex1", "sender s1" },
+		{ "s2", "u1", "ex1", "" },
+		{ "s3", "u1", "ex1", "user u1" },				// s3's token is refunded
+		{ "s3", "u2", "ex1", "" },
+		{ "s4", "u3", "ex1", "exchange ex1" },			// s4 and u3 refunded
+		{ "s4", "u3", "ex2", "" },
+		{ "s5", "", "ex2", "" },						// no user id; the user limit doesn't apply
+	} {
+		if why := throttled( ctx, mk_req( c.sender, c.user, c.source ) ); why != c.want {
+			t.Errorf( "request %d (%s/%s/%s): expected %q, got %q", i, c.sender, c.user, c.source, c.want, why )
+		}
+	}
+}